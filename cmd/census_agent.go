@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dollarshaveclub/thermite/pkg/agent"
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/spf13/cobra"
+)
+
+var (
+	agentListenAddress  string
+	agentTokenFile      string
+	agentTLSCertFile    string
+	agentTLSKeyFile     string
+	agentClientCAFile   string
+	agentSurveyInterval time.Duration
+)
+
+func runCensusAgent(logger *log.Logger) error {
+	if agentTokenFile == "" && agentClientCAFile == "" {
+		return fmt.Errorf("a token file or client CA file is required to authenticate requests")
+	}
+	if agentClientCAFile != "" && agentTLSCertFile == "" {
+		return fmt.Errorf("a TLS certificate is required to verify client certificates")
+	}
+	serverOpts := []agent.ServerOption{
+		agent.WithServerLogger(logger),
+	}
+	if agentTokenFile != "" {
+		token, err := readToken(agentTokenFile)
+		if err != nil {
+			return err
+		}
+		serverOpts = append(serverOpts, agent.WithServerToken(token))
+	}
+	censusOpts := []census.Option{
+		census.WithLogger(logger),
+	}
+	if pageSize > 0 {
+		censusOpts = append(censusOpts, census.WithPageSize(pageSize))
+	}
+	clientset, err := newKubernetesClientset(logger)
+	if err != nil {
+		return err
+	}
+	censusClient, err := census.NewDefaultClient(clientset, censusOpts...)
+	if err != nil {
+		return fmt.Errorf("error creating census client: %w", err)
+	}
+	server, err := agent.NewServer(censusClient, serverOpts...)
+	if err != nil {
+		return fmt.Errorf("error creating census agent server: %w", err)
+	}
+	httpServer := &http.Server{
+		Addr:              agentListenAddress,
+		Handler:           server,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if agentClientCAFile != "" {
+		pool, err := readCertPool(agentClientCAFile)
+		if err != nil {
+			return err
+		}
+		httpServer.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  pool,
+		}
+	}
+	if agentTLSCertFile == "" {
+		logger.Printf("serving census over plain HTTP; bearer tokens will be sent unencrypted")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go server.Run(ctx, agentSurveyInterval)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("error shutting down census agent: %v", err)
+		}
+	}()
+	logger.Printf("serving census at %s%s", agentListenAddress, agent.SurveyPath)
+	if agentTLSCertFile != "" {
+		err = httpServer.ListenAndServeTLS(agentTLSCertFile, agentTLSKeyFile)
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serving census: %w", err)
+	}
+	return nil
+}
+
+var CensusAgentCmd = &cobra.Command{
+	Use:   "census-agent",
+	Short: "Serve a survey of deployed images to a central Thermite",
+	Long: `The census agent surveys the images deployed in the Kubernetes cluster it is
+running in, and serves the most recent survey as JSON over HTTP, so that a
+central Thermite which cannot reach the cluster directly can exclude those
+images from removal (see the --census-agent flag).
+
+Requests must be authenticated with a bearer token, a client certificate
+signed by a trusted CA, or both.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runCensusAgent(logger); err != nil {
+			logger.Fatalf("error running census agent: %v", err)
+		}
+	},
+}
+
+func init() {
+	flags := CensusAgentCmd.Flags()
+	flags.StringVar(
+		&agentListenAddress,
+		"listen-address",
+		":8443",
+		"address to serve the census on",
+	)
+	flags.StringVar(
+		&agentTokenFile,
+		"token-file",
+		"",
+		"file containing a bearer token that requests must present",
+	)
+	flags.StringVar(
+		&agentTLSCertFile,
+		"tls-cert-file",
+		"",
+		"file containing a PEM certificate to serve TLS with",
+	)
+	flags.StringVar(
+		&agentTLSKeyFile,
+		"tls-key-file",
+		"",
+		"file containing the PEM private key of the TLS certificate",
+	)
+	flags.StringVar(
+		&agentClientCAFile,
+		"client-ca-file",
+		"",
+		"file containing PEM certificates of CAs that must sign client certificates",
+	)
+	flags.DurationVar(
+		&agentSurveyInterval,
+		"survey-interval",
+		5*time.Minute,
+		"interval at which to refresh the survey",
+	)
+	flags.UintVar(&pageSize, "page-size", 0, "number of items returned in paginated API responses")
+	RootCmd.AddCommand(CensusAgentCmd)
+}
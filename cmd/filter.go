@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/spf13/pflag"
+)
+
+var (
+	includeRepos      []string
+	includeRepoRegexp string
+	repoPrefixes      []string
+	excludeRepos      []string
+	excludeRepoRegexp string
+	repoTags          map[string]string
+)
+
+// addFilterFlags adds the flags that select the repositories to prune to
+// flags.
+func addFilterFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVar(
+		&includeRepos,
+		"include-repo",
+		[]string{},
+		"pattern of names of repositories to prune, such as team-a/* (supports multiple flags)",
+	)
+	flags.StringVar(
+		&includeRepoRegexp,
+		"include-repo-regexp",
+		"",
+		"regular expression matching names of repositories to prune",
+	)
+	flags.StringSliceVar(
+		&repoPrefixes,
+		"repo-prefix",
+		[]string{},
+		"namespace of repositories to prune, such as team-a (supports multiple flags)",
+	)
+	flags.StringSliceVar(
+		&excludeRepos,
+		"exclude-repo",
+		[]string{},
+		"pattern of names of repositories not to prune (supports multiple flags)",
+	)
+	flags.StringVar(
+		&excludeRepoRegexp,
+		"exclude-repo-regexp",
+		"",
+		"regular expression matching names of repositories not to prune",
+	)
+	flags.StringToStringVar(
+		&repoTags,
+		"repo-tag",
+		nil,
+		"resource tag key and value pattern that repositories to prune must have, e.g. owner=team-a",
+	)
+}
+
+// filterOptions returns the prune options specified by the flags added by
+// addFilterFlags.
+func filterOptions() []prune.Option {
+	filter := prune.RepositoryFilter{
+		Include:       includeRepos,
+		IncludeRegexp: includeRepoRegexp,
+		Prefixes:      repoPrefixes,
+		Exclude:       excludeRepos,
+		ExcludeRegexp: excludeRepoRegexp,
+		Tags:          repoTags,
+	}
+	if len(filter.Include) == 0 && filter.IncludeRegexp == "" && len(filter.Prefixes) == 0 &&
+		len(filter.Exclude) == 0 && filter.ExcludeRegexp == "" && len(filter.Tags) == 0 {
+		return nil
+	}
+	return []prune.Option{prune.WithRepositoryFilter(filter)}
+}
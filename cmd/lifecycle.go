@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/dollarshaveclub/thermite/pkg/agent"
+	"github.com/dollarshaveclub/thermite/pkg/audit"
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	lifecyclePolicyFile string
+	lifecycleAuditFail  bool
+)
+
+// newPolicyPruneClient returns a prune client with the options specified by
+// the flags added by addPolicyFlags.
+func newPolicyPruneClient() (*prune.Client, error) {
+	opts, err := policyOptions()
+	if err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating AWS session: %w", err)
+	}
+	if pageSize > 0 {
+		opts = append(opts, prune.WithPageSize(pageSize))
+	}
+	pruneClient, err := prune.NewClient(ecr.New(sess), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating prune client: %w", err)
+	}
+	return pruneClient, nil
+}
+
+func runLifecycleExport(cmd *cobra.Command, name string) error {
+	pruneClient, err := newPolicyPruneClient()
+	if err != nil {
+		return err
+	}
+	policy, _, ok, err := pruneClient.EffectivePolicy(context.Background(), name)
+	if err != nil {
+		return fmt.Errorf("error finding policy of repository %s: %w", name, err)
+	}
+	if !ok {
+		return fmt.Errorf("repository %s has no Thermite policy", name)
+	}
+	lp, err := policy.LifecyclePolicy()
+	if err != nil {
+		return fmt.Errorf("error translating policy of repository %s: %w", name, err)
+	}
+	data, err := json.MarshalIndent(lp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding lifecycle policy: %w", err)
+	}
+	_, err = fmt.Fprintf(cmd.OutOrStdout(), "%s\n", data)
+	return err
+}
+
+func runLifecycleImport(cmd *cobra.Command, name string) error {
+	pruneClient, err := newPolicyPruneClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	var lp prune.LifecyclePolicy
+	if lifecyclePolicyFile != "" {
+		data, err := os.ReadFile(lifecyclePolicyFile)
+		if err != nil {
+			return fmt.Errorf("error reading lifecycle policy file: %w", err)
+		}
+		if err := json.Unmarshal(data, &lp); err != nil {
+			return fmt.Errorf("error decoding lifecycle policy file: %w", err)
+		}
+	} else {
+		var ok bool
+		lp, ok, err = pruneClient.RepositoryLifecyclePolicy(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("repository %s has no lifecycle policy", name)
+		}
+	}
+	settings, err := lp.Settings()
+	if err != nil {
+		return fmt.Errorf("error translating lifecycle policy: %w", err)
+	}
+	data, err := yaml.Marshal(prune.PolicyFile{
+		Repositories: []prune.RepositoryPolicy{{Match: name, PolicySettings: settings}},
+	})
+	if err != nil {
+		return fmt.Errorf("error encoding policy file: %w", err)
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "%s\n", data)
+	differences, err := pruneClient.CompareLifecyclePolicy(ctx, name, lp, settings.Policy(), time.Now())
+	if err != nil {
+		return err
+	}
+	if len(differences) == 0 {
+		fmt.Fprintf(out, "# the lifecycle policy and Thermite would expire the same images\n")
+		return nil
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "# IMAGE\tPUSHED\tLIFECYCLE\tTHERMITE")
+	for _, d := range differences {
+		lifecycle := "keep"
+		if d.Expired {
+			lifecycle = fmt.Sprintf("expire (rule %d)", d.RulePriority)
+		}
+		thermite := "keep"
+		if d.Pruned {
+			thermite = "prune"
+		}
+		fmt.Fprintf(
+			tw,
+			"# %s\t%s\t%s\t%s (rule %s)\n",
+			strings.Join(d.ImageRefs, ", "),
+			d.PushedAt.Format(time.RFC3339),
+			lifecycle,
+			thermite,
+			d.Rule,
+		)
+	}
+	return tw.Flush()
+}
+
+func runLifecycleAudit(cmd *cobra.Command, logger *log.Logger) error {
+	ctx := context.Background()
+	censusOpts := []census.Option{
+		census.WithLogger(logger),
+	}
+	agentOpts := []agent.Option{
+		agent.WithLogger(logger),
+		agent.WithMaxAge(censusAgentMaxAge),
+	}
+	auditOpts := []audit.Option{
+		audit.WithLogger(logger),
+		audit.WithWindow(auditLogWindow),
+	}
+	pruneOpts := append(filterOptions(), prune.WithLogger(logger))
+	if pageSize > 0 {
+		censusOpts = append(censusOpts, census.WithPageSize(pageSize))
+		pruneOpts = append(pruneOpts, prune.WithPageSize(pageSize))
+	}
+	clientset, err := newKubernetesClientset(logger)
+	if err != nil {
+		return err
+	}
+	surveyor, err := newSurveyor(logger, clientset, censusOpts, agentOpts, auditOpts)
+	if err != nil {
+		return err
+	}
+	deployed, err := surveyor.SurveyDeployedImages(ctx)
+	if err != nil {
+		return fmt.Errorf("error surveying Kubernetes images: %w", err)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating AWS session: %w", err)
+	}
+	pruneClient, err := prune.NewClient(ecr.New(sess), pruneOpts...)
+	if err != nil {
+		return fmt.Errorf("error creating prune client: %w", err)
+	}
+	violations, err := pruneClient.AuditLifecyclePolicies(ctx, deployed...)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		logger.Printf("no lifecycle policy would expire any of %d deployed images", len(deployed))
+		return nil
+	}
+	tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tIMAGE\tPUSHED\tLIFECYCLE RULE")
+	for _, v := range violations {
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%d\n",
+			v.Repository,
+			strings.Join(v.ImageRefs, ", "),
+			v.PushedAt.Format(time.RFC3339),
+			v.RulePriority,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if lifecycleAuditFail {
+		return fmt.Errorf("lifecycle policies would expire %d deployed images", len(violations))
+	}
+	return nil
+}
+
+var PolicyLifecycleCmd = &cobra.Command{
+	Use:   "lifecycle",
+	Short: "Translate between Thermite policies and Elastic Container Registry lifecycle policies",
+	Long: `Lifecycle translates the retention policy of a repository between Thermite and
+native Elastic Container Registry lifecycle policies, which expire images
+without running Thermite but cannot see which images are deployed, and audits
+lifecycle policies for deployed images that they would expire.`,
+}
+
+var PolicyLifecycleExportCmd = &cobra.Command{
+	Use:   "export REPOSITORY",
+	Short: "Print the Thermite policy of a repository as a lifecycle policy",
+	Long: `Export prints the effective Thermite policy of a repository, combining its tags
+with the policy file and retention rules, as lifecycle policy JSON that can be
+applied with "aws ecr put-lifecycle-policy". Policies with regexp or semver
+rules, never rules, pull windows, severity periods, rules that combine a period
+with a keep count, or periods measured from the last pull, as in pull-through
+cache repositories, cannot be exported.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runLifecycleExport(cmd, args[0]); err != nil {
+			logger.Fatalf("error exporting lifecycle policy: %v", err)
+		}
+	},
+}
+
+var PolicyLifecycleImportCmd = &cobra.Command{
+	Use:   "import REPOSITORY",
+	Short: "Print the lifecycle policy of a repository as a Thermite policy",
+	Long: `Import reads the lifecycle policy of a repository, or the file given by
+--lifecycle-policy, and prints it as a policy file entry for the repository.
+Each tagged lifecycle rule becomes a retention rule named for its priority.
+
+Import then previews the lifecycle policy on the repository with
+GetLifecyclePolicyPreview, and lists, as comments, each image that the
+lifecycle policy and the imported Thermite policy would treat differently.
+Deployed images are not considered, since lifecycle policies cannot see them.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runLifecycleImport(cmd, args[0]); err != nil {
+			logger.Fatalf("error importing lifecycle policy: %v", err)
+		}
+	},
+}
+
+var PolicyLifecycleAuditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Find deployed images that lifecycle policies would expire",
+	Long: `Audit surveys deployed images like thermite does, then previews the lifecycle
+policy of every repository that has one with GetLifecyclePolicyPreview, and
+lists each deployed image that its lifecycle policy would expire. The
+per-platform images of a deployed multi-architecture image count as deployed.
+With --fail, audit exits with an error if any deployed image would be expired.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runLifecycleAudit(cmd, logger); err != nil {
+			logger.Fatalf("error auditing lifecycle policies: %v", err)
+		}
+	},
+}
+
+func init() {
+	exportFlags := PolicyLifecycleExportCmd.Flags()
+	addPolicyFlags(exportFlags)
+	exportFlags.UintVar(&pageSize, "page-size", 0, "number of items returned in paginated API responses")
+	importFlags := PolicyLifecycleImportCmd.Flags()
+	importFlags.StringVar(
+		&lifecyclePolicyFile,
+		"lifecycle-policy",
+		"",
+		"JSON lifecycle policy file to import instead of the policy of the repository",
+	)
+	importFlags.UintVar(&pageSize, "page-size", 0, "number of items returned in paginated API responses")
+	auditFlags := PolicyLifecycleAuditCmd.Flags()
+	addSurveyFlags(auditFlags)
+	addFilterFlags(auditFlags)
+	auditFlags.BoolVar(
+		&lifecycleAuditFail,
+		"fail",
+		false,
+		"exit with an error if any deployed image would be expired",
+	)
+	auditFlags.UintVar(&pageSize, "page-size", 0, "number of items returned in paginated API responses")
+	PolicyLifecycleCmd.AddCommand(PolicyLifecycleAuditCmd)
+	PolicyLifecycleCmd.AddCommand(PolicyLifecycleExportCmd)
+	PolicyLifecycleCmd.AddCommand(PolicyLifecycleImportCmd)
+	PolicyCmd.AddCommand(PolicyLifecycleCmd)
+}
@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	periodTagKey         string
+	keepCountTagKey      string
+	untaggedPeriodTagKey string
+	pullWindowTagKey     string
+	protectTagsTagKey    string
+	protectTags          []string
+	severityPeriods      map[string]int
+	retentionRulesFile   string
+	policyFile           string
+	policyOffline        bool
+	strictTags           bool
+	ignoreCacheRules     bool
+)
+
+// addPolicyFlags adds the flags that determine the policy of each repository
+// to flags.
+func addPolicyFlags(flags *pflag.FlagSet) {
+	flags.StringVar(
+		&periodTagKey,
+		"period-tag-key",
+		prune.DefaultPeriodTagKey,
+		"AWS resource tag to check for prune period, in days or with units such as 36h, 2w, or 3mo",
+	)
+	flags.StringVar(
+		&keepCountTagKey,
+		"keep-count-tag-key",
+		prune.DefaultKeepCountTagKey,
+		"AWS resource tag to check for number of newest images to keep",
+	)
+	flags.StringVar(
+		&untaggedPeriodTagKey,
+		"untagged-period-tag-key",
+		prune.DefaultUntaggedPeriodTagKey,
+		"AWS resource tag to check for untagged image prune period",
+	)
+	flags.StringVar(
+		&pullWindowTagKey,
+		"pull-window-tag-key",
+		prune.DefaultPullWindowTagKey,
+		"AWS resource tag to check for number of days to keep recently pulled images",
+	)
+	flags.StringVar(
+		&protectTagsTagKey,
+		"protect-tags-tag-key",
+		prune.DefaultProtectTagsTagKey,
+		"AWS resource tag to check for space-separated patterns of tags that are never pruned",
+	)
+	flags.StringSliceVar(
+		&protectTags,
+		"protect-tags",
+		[]string{},
+		"pattern of tags that are never pruned in any repository (supports multiple flags)",
+	)
+	flags.StringToIntVar(
+		&severityPeriods,
+		"severity-periods",
+		nil,
+		"shorter prune periods in days for undeployed images with scan findings of each severity, e.g. CRITICAL=7,HIGH=30",
+	)
+	flags.BoolVar(
+		&strictTags,
+		"strict-tags",
+		false,
+		"fail instead of ignoring repository tags with invalid values",
+	)
+	flags.BoolVar(
+		&ignoreCacheRules,
+		"ignore-pull-through-cache-rules",
+		false,
+		"treat no repository as a pull-through cache, instead of describing pull-through cache rules",
+	)
+	flags.StringVar(
+		&retentionRulesFile,
+		"retention-rules",
+		"",
+		"YAML file of tag retention rules for each repository",
+	)
+	flags.StringVar(
+		&policyFile,
+		"policy",
+		"",
+		"YAML policy file of retention settings for repositories matching name patterns",
+	)
+}
+
+// policyOptions returns the prune options specified by the flags added by
+// addPolicyFlags.
+func policyOptions() ([]prune.Option, error) {
+	opts := []prune.Option{
+		prune.WithPeriodTagKey(periodTagKey),
+		prune.WithKeepCountTagKey(keepCountTagKey),
+		prune.WithUntaggedPeriodTagKey(untaggedPeriodTagKey),
+		prune.WithPullWindowTagKey(pullWindowTagKey),
+		prune.WithProtectTagsTagKey(protectTagsTagKey),
+		prune.WithProtectedTags(protectTags...),
+		prune.WithSeverityPeriods(severityPeriods),
+	}
+	if strictTags {
+		opts = append(opts, prune.WithStrictTags())
+	}
+	if ignoreCacheRules {
+		opts = append(opts, prune.WithIgnorePullThroughCacheRules())
+	}
+	if retentionRulesFile != "" {
+		rulesByRepo, err := readRules(retentionRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, prune.WithRepoRules(rulesByRepo))
+	}
+	if policyFile != "" {
+		pf, err := readPolicyFile(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, prune.WithPolicyFile(pf))
+	}
+	return opts, nil
+}
+
+// readPolicyFile returns the PolicyFile in the YAML file at path.
+func readPolicyFile(path string) (*prune.PolicyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy file: %w", err)
+	}
+	pf := &prune.PolicyFile{}
+	if err := yaml.UnmarshalStrict(data, pf); err != nil {
+		return nil, fmt.Errorf("error decoding policy file: %w", err)
+	}
+	if err := pf.Validate(); err != nil {
+		return nil, fmt.Errorf("error in policy file: %w", err)
+	}
+	return pf, nil
+}
+
+func runPolicyValidate(cmd *cobra.Command) error {
+	if policyFile == "" {
+		return fmt.Errorf("a policy file is required")
+	}
+	opts, err := policyOptions()
+	if err != nil {
+		return err
+	}
+	out := cmd.OutOrStdout()
+	fmt.Fprintf(out, "policy file %s is valid\n", policyFile)
+	if policyOffline {
+		return nil
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating AWS session: %w", err)
+	}
+	ecrClient := ecr.New(sess)
+	if pageSize > 0 {
+		opts = append(opts, prune.WithPageSize(pageSize))
+	}
+	pruneClient, err := prune.NewClient(ecrClient, opts...)
+	if err != nil {
+		return fmt.Errorf("error creating prune client: %w", err)
+	}
+	ctx := context.Background()
+	names := []string{}
+	input := &ecr.DescribeRepositoriesInput{}
+	if pageSize > 0 {
+		input.MaxResults = aws.Int64(int64(pageSize))
+	}
+	if err := ecrClient.DescribeRepositoriesPagesWithContext(
+		ctx,
+		input,
+		func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+			for _, repo := range page.Repositories {
+				names = append(names, *repo.RepositoryName)
+			}
+			return true
+		},
+	); err != nil {
+		return fmt.Errorf("error describing Elastic Container Registry repositories: %w", err)
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPOSITORY\tMATCH\tPRUNED\tPERIOD\tKEEP COUNT\tUNTAGGED PERIOD\tPULL WINDOW\tRULES\tPROTECTED TAGS")
+	for _, name := range names {
+		policy, match, ok, err := pruneClient.EffectivePolicy(ctx, name)
+		if err != nil {
+			return fmt.Errorf("error finding policy of repository %s: %w", name, err)
+		}
+		if match == "" {
+			match = "-"
+		}
+		rules := make([]string, 0, len(policy.Rules))
+		for _, rule := range policy.Rules {
+			rules = append(rules, rule.Name)
+		}
+		ruleNames := strings.Join(rules, ",")
+		if ruleNames == "" {
+			ruleNames = "-"
+		}
+		protected := strings.Join(policy.ProtectTags, ",")
+		if protected == "" {
+			protected = "-"
+		}
+		pruned := "no"
+		if ok {
+			pruned = "yes"
+		}
+		periodText := period(policy.Period)
+		if policy.FromLastPull && !policy.Period.IsZero() {
+			periodText += " since pull"
+		}
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			name,
+			match,
+			pruned,
+			periodText,
+			policy.KeepCount,
+			days(policy.UntaggedPeriod),
+			days(policy.PullWindow),
+			ruleNames,
+			protected,
+		)
+	}
+	return tw.Flush()
+}
+
+// period formats p, or - if it is zero.
+func period(p prune.Period) string {
+	if p.IsZero() {
+		return "-"
+	}
+	return p.String()
+}
+
+// days formats a number of days, or - if it is zero.
+func days(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.Itoa(n) + "d"
+}
+
+var PolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Work with Thermite retention policies",
+}
+
+var PolicyValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate a policy file and show the policy of each repository",
+	Long: `Validate checks a policy file (see the --policy flag of thermite) against its
+schema, rejecting unknown fields, invalid patterns and rules, and negative
+settings. Unless --offline is given, it then lists every repository in the
+Elastic Container Registry with the policy that Thermite would apply to it,
+combining the policy file with repository tags and retention rules.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runPolicyValidate(cmd); err != nil {
+			logger.Fatalf("error validating policy: %v", err)
+		}
+	},
+}
+
+func init() {
+	flags := PolicyValidateCmd.Flags()
+	addPolicyFlags(flags)
+	flags.BoolVar(
+		&policyOffline,
+		"offline",
+		false,
+		"only validate the policy file, without listing repositories",
+	)
+	flags.UintVar(&pageSize, "page-size", 0, "number of items returned in paginated API responses")
+	PolicyCmd.AddCommand(PolicyValidateCmd)
+	RootCmd.AddCommand(PolicyCmd)
+}
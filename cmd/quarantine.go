@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/spf13/cobra"
+)
+
+var (
+	quarantinePeriod time.Duration
+	unquarantineRole string
+)
+
+// ecrImageRefPattern matches a reference to an image in an Elastic Container
+// Registry repository by tag or digest, capturing the account ID, region,
+// repository name, and tag or digest.
+var ecrImageRefPattern = regexp.MustCompile(
+	`^(\d{12})\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?/([^:@]+)(?::([^:@]+)|@(sha256:[0-9a-f]+))$`,
+)
+
+// parseECRImageRef returns the registry, repository name, and tag or digest of
+// an Elastic Container Registry image reference.
+func parseECRImageRef(imageRef string) (target registryTarget, name, tagOrDigest string, err error) {
+	matches := ecrImageRefPattern.FindStringSubmatch(imageRef)
+	if matches == nil {
+		return registryTarget{}, "", "", fmt.Errorf(
+			"image %q must be of the form ACCOUNT.dkr.ecr.REGION.amazonaws.com/NAME:TAG or @DIGEST",
+			imageRef,
+		)
+	}
+	tagOrDigest = matches[4]
+	if tagOrDigest == "" {
+		tagOrDigest = matches[5]
+	}
+	return registryTarget{AccountID: matches[1], Region: matches[2]}, matches[3], tagOrDigest, nil
+}
+
+func runUnquarantine(cmd *cobra.Command, logger *log.Logger, imageRef string) error {
+	target, name, tagOrDigest, err := parseECRImageRef(imageRef)
+	if err != nil {
+		return err
+	}
+	target.RoleARN = unquarantineRole
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating AWS session: %w", err)
+	}
+	ecrClient, _ := target.ecrClients(sess)
+	pruneClient, err := prune.NewClient(
+		ecrClient,
+		prune.WithRegistryID(target.AccountID),
+		prune.WithLogger(logger),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating prune client: %w", err)
+	}
+	restored, err := pruneClient.Unquarantine(context.Background(), name, tagOrDigest)
+	if err != nil {
+		return err
+	}
+	for _, imageRef := range restored {
+		fmt.Fprintln(cmd.OutOrStdout(), imageRef)
+	}
+	return nil
+}
+
+var UnquarantineCmd = &cobra.Command{
+	Use:   "unquarantine IMAGE",
+	Short: "Restore an image quarantined by Thermite",
+	Long: `Unquarantine restores the original tags of an image that Thermite quarantined
+(see the --quarantine-period flag), and removes its quarantine tags, so that it
+is no longer deleted once its quarantine period has passed. The image can be
+given by an original tag, a quarantine tag, or its digest, such as:
+
+    000123456789.dkr.ecr.us-east-1.amazonaws.com/web:v1.2.3
+    000123456789.dkr.ecr.us-east-1.amazonaws.com/web:thermite-quarantine-20210801T120000Z-v1.2.3
+    000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:...
+
+If several quarantined images had the same original tag, the one quarantined
+last is restored. Unquarantine refuses to move an original tag that has since
+been pushed again. The restored image references are printed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runUnquarantine(cmd, logger, args[0]); err != nil {
+			logger.Fatalf("error restoring quarantined image: %v", err)
+		}
+	},
+}
+
+func init() {
+	flags := UnquarantineCmd.Flags()
+	flags.StringVar(
+		&unquarantineRole,
+		"role",
+		"",
+		"IAM role to assume, with the shared credentials, to restore the image",
+	)
+	RootCmd.AddCommand(UnquarantineCmd)
+}
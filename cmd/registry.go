@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/spf13/pflag"
+)
+
+var (
+	registries         []string
+	replicateDeletions bool
+)
+
+// A registryTarget is an Elastic Container Registry to prune, specified by
+// the --registry flag.
+type registryTarget struct {
+	AccountID string
+	Region    string
+	RoleARN   string
+}
+
+// parseRegistryTarget parses a registryTarget from comma-separated key=value
+// pairs with the keys account, region, and role.
+func parseRegistryTarget(s string) (registryTarget, error) {
+	var target registryTarget
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return registryTarget{}, fmt.Errorf("registry %q must be of the form account=ID,region=REGION,role=ARN", s)
+		}
+		switch key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]); key {
+		case "account":
+			if len(value) != 12 || strings.Trim(value, "0123456789") != "" {
+				return registryTarget{}, fmt.Errorf("registry %q account must be a 12-digit AWS account ID", s)
+			}
+			target.AccountID = value
+		case "region":
+			target.Region = value
+		case "role":
+			if !strings.HasPrefix(value, "arn:") {
+				return registryTarget{}, fmt.Errorf("registry %q role must be an IAM role ARN", s)
+			}
+			target.RoleARN = value
+		default:
+			return registryTarget{}, fmt.Errorf("registry %q has unknown key %s", s, key)
+		}
+	}
+	return target, nil
+}
+
+// String returns the name under which the results of pruning t are reported.
+func (t registryTarget) String() string {
+	account := t.AccountID
+	if account == "" {
+		account = "default"
+	}
+	region := t.Region
+	if region == "" {
+		region = "default"
+	}
+	return account + "/" + region
+}
+
+// ecrClients returns an Elastic Container Registry client for the region of t,
+// using sess, or credentials for the role of t obtained using sess, and a
+// function returning clients for other regions with the same credentials.
+func (t registryTarget) ecrClients(sess *session.Session) (*ecr.ECR, prune.ReplicaClientFunc) {
+	config := aws.NewConfig()
+	if t.RoleARN != "" {
+		config = config.WithCredentials(stscreds.NewCredentials(sess, t.RoleARN))
+	}
+	replicaClient := func(region string) (ecriface.ECRAPI, error) {
+		return ecr.New(sess, config.Copy().WithRegion(region)), nil
+	}
+	if t.Region != "" {
+		return ecr.New(sess, config.Copy().WithRegion(t.Region)), replicaClient
+	}
+	return ecr.New(sess, config), replicaClient
+}
+
+// registryTargets returns the registryTargets specified by the --registry
+// flags.
+func registryTargets() ([]registryTarget, error) {
+	targets := make([]registryTarget, 0, len(registries))
+	seen := make(map[string]bool, len(registries))
+	for _, s := range registries {
+		target, err := parseRegistryTarget(s)
+		if err != nil {
+			return nil, err
+		}
+		if seen[target.String()] {
+			return nil, fmt.Errorf("registry %s is specified more than once", target)
+		}
+		seen[target.String()] = true
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// addRegistryFlags adds the flags that select the registries to prune to
+// flags.
+func addRegistryFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(
+		&registries,
+		"registry",
+		[]string{},
+		"registry to prune, e.g. account=000123456789,region=us-west-2,role=arn:aws:iam::000123456789:role/thermite (supports multiple flags)",
+	)
+	flags.BoolVar(
+		&replicateDeletions,
+		"replicate-deletions",
+		false,
+		"also delete pruned images from the replication destinations of each registry",
+	)
+}
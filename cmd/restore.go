@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dollarshaveclub/thermite/pkg/journal"
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/spf13/cobra"
+)
+
+var (
+	journalRetention time.Duration
+	restoreRole      string
+)
+
+func runRestore(cmd *cobra.Command, logger *log.Logger, imageRef string) error {
+	target, name, tagOrDigest, err := parseECRImageRef(imageRef)
+	if err != nil {
+		return err
+	}
+	target.RoleARN = restoreRole
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating AWS session: %w", err)
+	}
+	if stateConfigMap != "" {
+		return fmt.Errorf("a ConfigMap is too small to hold a deletion journal")
+	}
+	state, err := newStateStore(nil, sess)
+	if err != nil {
+		return fmt.Errorf("error creating state store: %w", err)
+	}
+	if state == nil {
+		return fmt.Errorf("a state store is required to restore deleted images")
+	}
+	journalClient, err := journal.NewClient(state, 0, journal.WithLogger(logger))
+	if err != nil {
+		return fmt.Errorf("error creating journal client: %w", err)
+	}
+	ecrClient, _ := target.ecrClients(sess)
+	pruneClient, err := prune.NewClient(
+		ecrClient,
+		prune.WithRegistryID(target.AccountID),
+		prune.WithJournal(journalClient),
+		prune.WithLogger(logger),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating prune client: %w", err)
+	}
+	restored, err := pruneClient.Restore(context.Background(), name, tagOrDigest)
+	if err != nil {
+		return err
+	}
+	for _, imageRef := range restored {
+		fmt.Fprintln(cmd.OutOrStdout(), imageRef)
+	}
+	return nil
+}
+
+var RestoreCmd = &cobra.Command{
+	Use:   "restore IMAGE",
+	Short: "Restore an image deleted by Thermite from its deletion journal",
+	Long: `Restore puts an image that Thermite deleted back into its repository, with all
+of the tags it had, from the deletion journal in the state store (see the
+--deletion-journal-retention flag). The image can be given by any of its tags or
+its digest, such as:
+
+    000123456789.dkr.ecr.us-east-1.amazonaws.com/web:v1.2.3
+    000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:...
+
+A quarantined image that was deleted once its quarantine period passed is
+restored with its original tags. If several deleted images had the same tag,
+the one deleted last is restored.
+The per-platform images of a multi-architecture image are restored with it.
+Restore refuses to move a tag that has since been pushed again, and fails once
+Elastic Container Registry has removed the layers of the image. The restored
+image references are printed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.Default()
+		if err := runRestore(cmd, logger, args[0]); err != nil {
+			logger.Fatalf("error restoring deleted image: %v", err)
+		}
+	},
+}
+
+func init() {
+	flags := RestoreCmd.Flags()
+	addStateFlags(flags)
+	flags.StringVar(
+		&restoreRole,
+		"role",
+		"",
+		"IAM role to assume, with the shared credentials, to restore the image",
+	)
+	RootCmd.AddCommand(RestoreCmd)
+}
@@ -2,22 +2,31 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dollarshaveclub/thermite/pkg/agent"
+	"github.com/dollarshaveclub/thermite/pkg/audit"
 	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/dollarshaveclub/thermite/pkg/history"
+	"github.com/dollarshaveclub/thermite/pkg/journal"
+	"github.com/dollarshaveclub/thermite/pkg/ledger"
 	"github.com/dollarshaveclub/thermite/pkg/prune"
 	"github.com/dollarshaveclub/thermite/pkg/thermite"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 	"gopkg.in/DataDog/dd-trace-go.v1/profiler"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
 
 	_ "k8s.io/client-go/plugin/pkg/client/auth/azure"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/exec"
@@ -29,13 +38,141 @@ import (
 )
 
 var (
-	removeImages    bool
-	periodTagKey    string
-	pageSize        uint
-	statsdNamespace string
-	statsdTags      []string
+	removeImages            bool
+	deleteByDigest          bool
+	allowNoRegistryExcl     bool
+	maxDeletions            int
+	maxDeletePercent        float64
+	budgetAction            string
+	pageSize                uint
+	statsdNamespace         string
+	statsdTags              []string
+	stateDir                string
+	stateConfigMap          string
+	stateS3Bucket           string
+	stateS3Prefix           string
+	recentGracePeriod       time.Duration
+	markSweepInterval       time.Duration
+	maxListerDropPercent    float64
+	maxNamespaceDropPercent float64
+	censusAgents            []string
+	censusAgentTokenFile    string
+	censusAgentCAFile       string
+	censusAgentCertFile     string
+	censusAgentKeyFile      string
+	censusAgentMaxAge       time.Duration
+	auditLogs               []string
+	auditLogWindow          time.Duration
 )
 
+func newKubernetesClientset(logger *log.Logger) (kubernetes.Interface, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, nil)
+	config, err := kubeConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error creating Kubernetes config: %v", err)
+	}
+	logger.Printf("created Kubernetes config")
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Kubernetes clientset: %v", err)
+	}
+	return clientset, nil
+}
+
+func newAgentClient(logger *log.Logger, opts ...agent.Option) (*agent.Client, error) {
+	if censusAgentTokenFile != "" {
+		token, err := readToken(censusAgentTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, agent.WithToken(token))
+	}
+	if censusAgentCAFile != "" || censusAgentCertFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if censusAgentCAFile != "" {
+			pool, err := readCertPool(censusAgentCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if censusAgentCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(censusAgentCertFile, censusAgentKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("error loading client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		opts = append(opts, agent.WithHTTPClient(&http.Client{
+			Transport: transport,
+			Timeout:   agent.DefaultTimeout,
+		}))
+	}
+	return agent.NewClient(censusAgents, opts...)
+}
+
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading token file: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+func readCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// newSurveyor returns a census.Surveyor of the Kubernetes cluster of
+// clientset, combined with the census agents and audit logs specified by the
+// flags added by addSurveyFlags.
+func newSurveyor(
+	logger *log.Logger,
+	clientset kubernetes.Interface,
+	censusOpts []census.Option,
+	agentOpts []agent.Option,
+	auditOpts []audit.Option,
+) (census.Surveyor, error) {
+	censusClient, err := census.NewDefaultClient(clientset, censusOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("error crearing census client: %w", err)
+	}
+	logger.Printf("created census client")
+	surveyors := []census.Surveyor{censusClient}
+	if len(censusAgents) > 0 {
+		agentClient, err := newAgentClient(logger, agentOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating census agent client: %w", err)
+		}
+		logger.Printf("created census agent client for %d agents", len(censusAgents))
+		surveyors = append(surveyors, agentClient)
+	}
+	if len(auditLogs) > 0 {
+		auditClient, err := audit.NewClient(auditLogs, auditOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating audit log client: %w", err)
+		}
+		logger.Printf("created audit log client")
+		surveyors = append(surveyors, auditClient)
+	}
+	return census.Combine(surveyors...), nil
+}
+
 func run(logger *log.Logger) (pruned []string, err error) {
 	if os.Getenv("DD_AGENT_HOST") != "" && os.Getenv("DD_TRACE_AGENT_PORT") != "" {
 		tracer.Start()
@@ -55,9 +192,33 @@ func run(logger *log.Logger) (pruned []string, err error) {
 	censusOpts := []census.Option{
 		census.WithLogger(logger),
 	}
-	pruneOpts := []prune.Option{
-		prune.WithPeriodTagKey(periodTagKey),
-		prune.WithLogger(logger),
+	agentOpts := []agent.Option{
+		agent.WithLogger(logger),
+		agent.WithMaxAge(censusAgentMaxAge),
+	}
+	auditOpts := []audit.Option{
+		audit.WithLogger(logger),
+		audit.WithWindow(auditLogWindow),
+	}
+	historyOpts := []history.Option{
+		history.WithLogger(logger),
+	}
+	ledgerOpts := []ledger.Option{
+		ledger.WithLogger(logger),
+	}
+	journalOpts := []journal.Option{
+		journal.WithLogger(logger),
+	}
+	pruneOpts, err := policyOptions()
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	pruneOpts = append(pruneOpts, filterOptions()...)
+	pruneOpts = append(pruneOpts, prune.WithLogger(logger))
+	thermiteOpts := []thermite.Option{
+		thermite.WithMaxListerDropPercent(maxListerDropPercent),
+		thermite.WithMaxNamespaceDropPercent(maxNamespaceDropPercent),
 	}
 	if pageSize > 0 {
 		censusOpts = append(censusOpts, census.WithPageSize(pageSize))
@@ -66,6 +227,25 @@ func run(logger *log.Logger) (pruned []string, err error) {
 	if removeImages {
 		pruneOpts = append(pruneOpts, prune.WithRemoveImages())
 	}
+	if deleteByDigest {
+		pruneOpts = append(pruneOpts, prune.WithDeleteByDigest())
+	}
+	if quarantinePeriod > 0 {
+		pruneOpts = append(pruneOpts, prune.WithQuarantine(quarantinePeriod))
+	}
+	if allowNoRegistryExcl {
+		pruneOpts = append(pruneOpts, prune.WithAllowNoRegistryExclusions())
+	}
+	budget, err := prune.NewBudget(maxDeletions, maxDeletePercent)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error creating deletion budget: %w", err)
+	}
+	pruneOpts = append(
+		pruneOpts,
+		prune.WithBudget(budget),
+		prune.WithBudgetAction(budgetAction),
+	)
 	if os.Getenv("DD_AGENT_HOST") != "" && os.Getenv("DD_DOGSTATSD_PORT") != "" {
 		client, err := statsd.New(
 			"",
@@ -79,27 +259,23 @@ func run(logger *log.Logger) (pruned []string, err error) {
 		defer client.Close()
 		logger.Printf("created statsd client")
 		censusOpts = append(censusOpts, census.WithStatsdClient(client))
+		agentOpts = append(agentOpts, agent.WithStatsdClient(client))
+		auditOpts = append(auditOpts, audit.WithStatsdClient(client))
+		historyOpts = append(historyOpts, history.WithStatsdClient(client))
+		ledgerOpts = append(ledgerOpts, ledger.WithStatsdClient(client))
+		journalOpts = append(journalOpts, journal.WithStatsdClient(client))
 		pruneOpts = append(pruneOpts, prune.WithStatsdClient(client))
 	}
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, nil)
-	config, err := kubeConfig.ClientConfig()
-	if err != nil {
-		span.Finish(tracer.WithError(err))
-		return nil, fmt.Errorf("error creating Kubernetes config: %v", err)
-	}
-	logger.Printf("created Kubernetes config")
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := newKubernetesClientset(logger)
 	if err != nil {
 		span.Finish(tracer.WithError(err))
-		return nil, fmt.Errorf("error creating Kubernetes clientset: %v", err)
+		return nil, err
 	}
-	censusClient, err := census.NewDefaultClient(clientset, censusOpts...)
+	taker, err := newSurveyor(logger, clientset, censusOpts, agentOpts, auditOpts)
 	if err != nil {
 		span.Finish(tracer.WithError(err))
-		return nil, fmt.Errorf("error crearing census client: %w", err)
+		return nil, err
 	}
-	logger.Printf("created census client")
 	sess, err := session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	})
@@ -108,24 +284,132 @@ func run(logger *log.Logger) (pruned []string, err error) {
 		return nil, fmt.Errorf("error creating AWS session: %w", err)
 	}
 	logger.Printf("created ECR session")
-	ecrClient := ecr.New(sess)
-	pruneClient, err := prune.NewClient(ecrClient, pruneOpts...)
+	state, err := newStateStore(clientset, sess)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error creating state store: %w", err)
+	}
+	if state != nil {
+		logger.Printf("created state store")
+		thermiteOpts = append(thermiteOpts, thermite.WithSummaryStore(state))
+	}
+	if recentGracePeriod > 0 {
+		if state == nil {
+			err := fmt.Errorf("a state store is required to keep recently deployed images")
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		historyClient, err := history.NewClient(state, recentGracePeriod, historyOpts...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error creating history client: %w", err)
+		}
+		thermiteOpts = append(thermiteOpts, thermite.WithHistory(historyClient))
+	}
+	if markSweepInterval > 0 {
+		if state == nil {
+			err := fmt.Errorf("a state store is required to mark images for deletion")
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		ledgerClient, err := ledger.NewClient(state, markSweepInterval, ledgerOpts...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error creating ledger client: %w", err)
+		}
+		pruneOpts = append(pruneOpts, prune.WithLedger(ledgerClient))
+	}
+	if journalRetention > 0 {
+		if state == nil {
+			err := fmt.Errorf("a state store is required to journal deleted images")
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		journalClient, err := journal.NewClient(state, journalRetention, journalOpts...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error creating journal client: %w", err)
+		}
+		pruneOpts = append(pruneOpts, prune.WithJournal(journalClient))
+	}
+	targets, err := registryTargets()
 	if err != nil {
 		span.Finish(tracer.WithError(err))
-		return nil, fmt.Errorf("error creating prune client: %w", err)
+		return nil, err
 	}
-	logger.Printf("created prune client")
-	client, err := thermite.NewClient(censusClient, pruneClient)
+	if len(targets) == 0 {
+		ecrClient, replicaClient := registryTarget{}.ecrClients(sess)
+		if replicateDeletions {
+			pruneOpts = append(pruneOpts, prune.WithReplication(replicaClient))
+		}
+		pruneClient, err := prune.NewClient(ecrClient, pruneOpts...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error creating prune client: %w", err)
+		}
+		logger.Printf("created prune client")
+		client, err := thermite.NewClient(taker, pruneClient, thermiteOpts...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error crearting Thermite client: %w", err)
+		}
+		log.Printf("created Thermite client")
+		pruned, err = client.Run(ctx, time.Now().UTC())
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		return pruned, nil
+	}
+	pruneClients := make([]*prune.Client, 0, len(targets))
+	for _, target := range targets {
+		targetOpts := append([]prune.Option{}, pruneOpts...)
+		targetOpts = append(targetOpts, prune.WithRegistryID(target.AccountID))
+		ecrClient, replicaClient := target.ecrClients(sess)
+		if replicateDeletions {
+			targetOpts = append(targetOpts, prune.WithReplication(replicaClient))
+		}
+		pruneClient, err := prune.NewClient(ecrClient, targetOpts...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error creating prune client for registry %s: %w", target, err)
+		}
+		logger.Printf("created prune client for registry %s", target)
+		pruneClients = append(pruneClients, pruneClient)
+	}
+	thermiteOpts = append(thermiteOpts, thermite.WithRegistryName(targets[0].String()))
+	for i, target := range targets[1:] {
+		thermiteOpts = append(thermiteOpts, thermite.WithRegistry(thermite.Registry{
+			Name:             target.String(),
+			GarbageCollector: pruneClients[i+1],
+		}))
+	}
+	client, err := thermite.NewClient(taker, pruneClients[0], thermiteOpts...)
 	if err != nil {
 		span.Finish(tracer.WithError(err))
 		return nil, fmt.Errorf("error crearting Thermite client: %w", err)
 	}
 	log.Printf("created Thermite client")
-	pruned, err = client.Run(ctx, time.Now().UTC())
+	results, err := client.RunRegistries(ctx, time.Now().UTC())
 	if err != nil {
 		span.Finish(tracer.WithError(err))
 		return nil, err
 	}
+	failed := []string{}
+	for _, result := range results {
+		pruned = append(pruned, result.Pruned...)
+		if result.Err != nil {
+			logger.Printf("failed to prune registry %s after pruning %d images: %v", result.Registry, len(result.Pruned), result.Err)
+			failed = append(failed, result.Registry)
+			continue
+		}
+		logger.Printf("pruned %d images from registry %s", len(result.Pruned), result.Registry)
+	}
+	if len(failed) > 0 {
+		err := fmt.Errorf("error pruning registries %s", strings.Join(failed, ", "))
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
 	return pruned, nil
 }
 
@@ -138,18 +422,235 @@ deployed in a Kubernetes cluster.
 
 Thermite checks for a resource tag (thermite:prune-period by default) on each
 repository in an Elastic Container Registry. This tag specifies the number of
-days that must pass after an image in the repository has been pushed before
-is pruned.
+days that must pass after an image in the repository has been pushed before it
+is pruned, or a period with units, such as 36h, 2w, 3mo, or 1mo2w (months are
+calendar months). Tags with invalid values are logged and ignored, unless
+--strict-tags is given, in which case they fail the run. An optional second tag
+(thermite:keep-count by default) specifies a number of the most recently pushed
+tagged images in the repository that are never pruned, whether or not they are
+deployed. Untagged images are only pruned, by digest, from repositories with a
+third tag (thermite:untagged-period by default), which specifies the number of
+days that must pass after an untagged image has been pushed before it is
+pruned. A fourth tag (thermite:pull-window by default) specifies a number of
+days during which any image that Elastic Container Registry recorded being
+pulled is kept, whatever its push date. ECR updates recorded pull times at most
+about once a day.
+
+Images with a tag matching a protected tag pattern, such as "latest" or
+"release-*", are never pruned, whether or not they are deployed, and are logged
+as protected. Patterns can be given for every repository with --protect-tags,
+and for a repository by a space-separated tag (thermite:protect-tags by
+default) or the policy file.
+
+A retention rules file can give repositories ordered rules that match image
+tags by glob or regular expression, each with its own period in days, keep
+count, or "never" action, which take the place of the prune period and keep
+count for matching tags. The file maps repository names to lists of rules:
+
+    web:
+      - name: pull-requests
+        glob: "pr-*"
+        period: 7
+      - name: main
+        regexp: "^main-[0-9a-f]+$"
+        period: 60
+        keepCount: 10
+      - name: releases
+        regexp: "^v[0-9]+[.][0-9]+[.][0-9]+$"
+        never: true
+
+Instead of a glob or regular expression, a rule can match semantic version tags
+(with an optional "v" prefix) and keep the newest patch versions of the newest
+minor versions, and the newest version of every major version. Pre-release
+versions only match if the rule includes them. Tags that are not semantic
+versions fall through to later rules and the prune period:
+
+    api:
+      - name: releases
+        semver:
+          minors: 5
+          patches: 3
+          newestPerMajor: true
+          prereleases: false
+
+A policy file (--policy) can specify these settings for repositories that are
+not tagged, or override their tags. Its repositories are matched in order by
+name pattern, and the first match applies, on top of the defaults:
+
+    precedence: tags    # or "file", to override repository tags
+    defaults:
+      untaggedPeriod: 7
+      protectTags: ["latest", "stable"]
+    repositories:
+      - match: "team-a/*"
+        period: 30
+        keepCount: 5
+        rules:
+          - name: releases
+            semver:
+              newestPerMajor: true
+      - match: "*"
+        period: 90
+
+Each setting (period, keepCount, untaggedPeriod, pullWindow, rules, and
+protectTags) comes from repository tags or the policy file, according to the
+precedence, and rules from --retention-rules override both. Use "thermite
+policy validate" to check a policy file and see the policy of each repository.
+
+Repositories created by Elastic Container Registry pull-through cache rules,
+which Thermite finds with DescribePullThroughCacheRules, mirror images from an
+upstream registry. Their periods are measured from when each image was last
+pulled, or pushed if it was never pulled, and deployed images are recognized by
+their upstream references (such as nginx:1.25 or docker.io/library/nginx:1.25)
+as well as their references in the cache. The pullThroughCache section of the
+policy file gives default settings to the repositories of the rules whose
+repository prefixes match, beneath those of the repositories section:
+
+    pullThroughCache:
+      - prefix: docker-hub
+        period: 30
+      - prefix: "*"
+        period: 90
+
+Thermite fails if it is not allowed to describe pull-through cache rules,
+rather than prune cache repositories as ordinary ones. With
+--ignore-pull-through-cache-rules, it treats no repository as a cache instead.
+
+Thermite prunes every repository in the registry, unless it is given filters
+that select repositories by name pattern (--include-repo and --exclude-repo),
+regular expression, namespace prefix (--repo-prefix), or resource tag
+(--repo-tag), so that a registry can be divided among several Thermite
+deployments. A policy file can also specify a filter:
+
+    filter:
+      prefixes: ["team-a"]
+      exclude: ["team-a/legacy-*"]
+      tags:
+        owner: "team-a"
+
+A repository is pruned only if it is selected by every filter.
+
+Deletion budgets guard against a bad survey wiping out a registry. With
+--max-deletions or --max-delete-percent, Thermite decides which images to prune
+from every repository before deleting any, and if there are more than the
+maximum number, or percentage of the images in the pruned repositories, it
+aborts the run without deleting anything. With --deletion-budget-action oldest,
+it deletes only the oldest images, up to the budget, instead. A repository can
+have its own budget, applied first, with the maxDeletions and maxDeletePercent
+settings of the policy file. When several registries are pruned, they share a
+single budget: each registry may delete only what earlier registries in the run
+left of it, and the percentage applies to the images in the repositories pruned
+so far. Images held back by a budget are logged with the rule "budget", and
+counted by the prune.budget_held_back metric.
+
+Thermite logs the rule that decided whether to prune each image, along with the
+time it was pushed and last pulled.
+
+Severity periods (for example --severity-periods CRITICAL=7,HIGH=30) prune
+undeployed images with scan findings sooner than their usual period. Thermite
+reads the findings of the most recent basic or enhanced scan of each image that
+would otherwise be kept for its age, and prunes it once the shortest period
+that applies to its findings has passed. The period of a severity also applies
+to more severe findings. Images kept for other reasons, such as a keep count,
+are unaffected, and the finding counts are logged for each image pruned early.
+
+By default, Thermite prunes tagged images by deleting their tags, which leaves
+an image's manifest and layers in place until its last tag is gone. With
+--delete-by-digest, Thermite deletes each pruned image by digest instead,
+removing all of its tags and its manifest at once, and logs the number of bytes
+reclaimed in each repository.
+
+With --quarantine-period, Thermite quarantines tagged images instead of deleting
+them: it tags each with thermite-quarantine-TIME-TAG for each of its tags, where
+TIME is the time of quarantine in UTC, such as
+thermite-quarantine-20210801T120000Z-v1.2.3, and removes the original tags. A
+later run deletes quarantined images once the quarantine period has passed,
+unless they are deployed by digest or by an original tag, and until then
+"thermite unquarantine" restores their original tags. Quarantined images are
+logged with the rule "quarantine", and neither count towards keep counts nor
+are deleted from replicas. Untagged images are deleted without quarantine,
+except for the per-platform images of a quarantined index.
+
+Thermite reads the manifest of every multi-architecture image index (Docker
+manifest list or OCI image index). The per-platform images of an index that is
+kept are kept too, and those of an index that is pruned are pruned with it
+unless another kept index refers to them.
 
 Thermite surveys the image names of the containers associated with every
 CronJob, DaemonSet, Deployment, Job, and StatefulSet in a Kubernetes
-cluster, and excludes these images from removal.
+cluster, and excludes these images from removal. Thermite refuses to prune if
+none of the surveyed images belong to the registry being pruned, unless
+--allow-no-registry-exclusions is given.
+
+Thermite can also read Kubernetes audit log files (JSON lines, optionally
+gzipped) and exclude every image that was admitted to the cluster by a
+successful create, update, or patch request within the audit log window, even
+if the resource that used it has since been deleted. The audit policy must log
+requests to pod-bearing resources at the Request level or above. Images
+admitted in each namespace are counted under AuditLog/NAMESPACE, apart from
+those deployed there, when checking the survey for drops.
+
+Thermite can also survey Kubernetes clusters that it cannot reach directly, by
+querying census agents (see "thermite census-agent") running in each of them.
+Thermite refuses to prune if any census agent is unreachable or serves a stale
+survey.
+
+Thermite can persist state between runs in a local directory, a Kubernetes
+ConfigMap, or an Amazon S3 bucket. If a state store is specified, Thermite saves
+a summary of each survey there, and refuses to prune if the number of images
+found by any kind of resource or in any namespace has dropped by more than the
+maximum percentage since the previous survey. If a recently deployed grace
+period is also specified, Thermite records when each image was last seen
+deployed, and excludes images seen deployed within the grace period from
+removal.
+
+With --mark-sweep-interval, Thermite deletes images in two phases, so that a
+single bad survey cannot cause a deletion. Each run marks the images that it
+would prune in a ledger in the state store, forgets the marks of images that
+are no longer pruneable, and deletes only images that an earlier run marked at
+least the interval before. Images that are only marked are logged with the rule
+"marked", and counted by the prune.marked_held_back metric. Dry runs read the
+ledger without updating it, so that they cannot bring deletions forward.
+
+With --deletion-journal-retention, Thermite records the digest, tags, manifest,
+media type, and push time of each image in a journal of its repository in the
+state store before deleting it, and keeps them for the retention period.
+Quarantined images are journaled with their original tags. "thermite restore"
+puts a deleted image back from the journal, as long as Elastic Container
+Registry still has its layers. Images deleted from replicas are not journaled.
+The journal holds full manifests, so it must be kept in a local directory or an
+Amazon S3 bucket rather than a ConfigMap.
 
 Thermite expects shared environment configuration and credentials to exist for
 the AWS account whose default Elastic Container Registry is to be pruned, as
 described by the "Configuration and credentials" subsection of the "Configuring
 the AWS CLI" section of the AWS Command Line Interface User Guide.
 
+Thermite can instead prune several registries, in other accounts or regions,
+against the same survey. Each --registry flag specifies the account ID and
+region of a registry, and optionally an IAM role to assume, with the shared
+credentials, to prune it:
+
+    --registry account=000123456789,region=us-east-1
+    --registry account=000987654321,region=us-west-2,role=arn:aws:iam::000987654321:role/thermite
+
+Thermite logs the number of images pruned from each registry. A registry that
+fails to be pruned does not stop the others from being pruned, but fails the
+run.
+
+Elastic Container Registry replicates pushed images to the destinations of a
+registry's replication configuration, but never replicates deletions. With
+--replicate-deletions, Thermite reads the replication configuration of each
+registry, and deletes every image that it prunes from a repository, by digest,
+from the replicas of the repository in each destination too. An image that is
+deployed from a replica, according to the census (for example, a census agent
+in the destination region), is kept in that replica. The credentials used for
+a registry must belong to it, so that its replication configuration can be
+read, and must be allowed to delete images in its destinations. Replicas follow
+the source repository: images are deleted from them only once deleted from the
+source, but deletions from replicas are not journaled, marked in the ledger, or
+counted against deletion budgets.
+
 If Thermite is not running inside the Kubernetes cluster that is to be surveyed,
 Thermite expects a Kubernetes configuration to exist as described in the
 "Organizing Cluster Access Using kubeconfig Files" subsection of the
@@ -186,13 +687,78 @@ func init() {
 		false,
 		"enables removal of eligible images from ECR",
 	)
+	flags.BoolVar(
+		&deleteByDigest,
+		"delete-by-digest",
+		false,
+		"delete pruned images by digest, removing all of their tags and their manifest at once",
+	)
+	flags.BoolVar(
+		&allowNoRegistryExcl,
+		"allow-no-registry-exclusions",
+		false,
+		"prune a registry even if none of the surveyed images belong to it",
+	)
+	flags.DurationVar(
+		&quarantinePeriod,
+		"quarantine-period",
+		0,
+		"quarantine pruned tagged images for this period before deleting them, instead of deleting them immediately",
+	)
+	flags.IntVar(
+		&maxDeletions,
+		"max-deletions",
+		0,
+		"maximum number of images to delete across all registries in a run (0 for no maximum)",
+	)
+	flags.Float64Var(
+		&maxDeletePercent,
+		"max-delete-percent",
+		0,
+		"maximum percentage of the images in pruned repositories to delete across all registries in a run (0 for no maximum)",
+	)
 	flags.StringVar(
-		&periodTagKey,
-		"period-tag-key",
-		prune.DefaultPeriodTagKey,
-		"AWS resource tag to check for prune period",
+		&budgetAction,
+		"deletion-budget-action",
+		prune.BudgetActionAbort,
+		"action when a deletion budget would be exceeded: abort the run, or delete only the oldest images",
 	)
+	addPolicyFlags(flags)
+	addFilterFlags(flags)
+	addRegistryFlags(flags)
 	flags.UintVar(&pageSize, "page-size", 0, "number of items returned in paginated API responses")
+	addStateFlags(flags)
+	flags.DurationVar(
+		&recentGracePeriod,
+		"recently-deployed-grace-period",
+		0,
+		"period after an image was last seen deployed during which it is excluded from removal",
+	)
+	flags.DurationVar(
+		&markSweepInterval,
+		"mark-sweep-interval",
+		0,
+		"minimum period for which an image must stay pruneable, across at least two runs, before it is deleted",
+	)
+	flags.DurationVar(
+		&journalRetention,
+		"deletion-journal-retention",
+		0,
+		"period for which to keep the manifest and tags of each deleted image in a journal, to restore it from",
+	)
+	flags.Float64Var(
+		&maxListerDropPercent,
+		"max-lister-drop-percent",
+		thermite.DefaultMaxDropPercent,
+		"maximum percentage by which images surveyed from a kind of resource may drop between runs",
+	)
+	flags.Float64Var(
+		&maxNamespaceDropPercent,
+		"max-namespace-drop-percent",
+		thermite.DefaultMaxDropPercent,
+		"maximum percentage by which images surveyed from a namespace may drop between runs",
+	)
+	addSurveyFlags(flags)
 	flags.StringVar(
 		&statsdNamespace,
 		"statsd-namespace",
@@ -206,3 +772,56 @@ func init() {
 		"tag to add to statsd metrics (supports multiple flags)",
 	)
 }
+
+// addSurveyFlags adds the flags that determine where deployed images are
+// surveyed, besides the Kubernetes cluster, to flags.
+func addSurveyFlags(flags *pflag.FlagSet) {
+	flags.StringSliceVar(
+		&censusAgents,
+		"census-agent",
+		[]string{},
+		"base URL of a census agent to survey (supports multiple flags)",
+	)
+	flags.StringVar(
+		&censusAgentTokenFile,
+		"census-agent-token-file",
+		"",
+		"file containing a bearer token to present to census agents",
+	)
+	flags.StringVar(
+		&censusAgentCAFile,
+		"census-agent-ca-file",
+		"",
+		"file containing PEM certificates of CAs to trust for census agents",
+	)
+	flags.StringVar(
+		&censusAgentCertFile,
+		"census-agent-cert-file",
+		"",
+		"file containing a PEM client certificate to present to census agents",
+	)
+	flags.StringVar(
+		&censusAgentKeyFile,
+		"census-agent-key-file",
+		"",
+		"file containing the PEM private key of the census agent client certificate",
+	)
+	flags.DurationVar(
+		&censusAgentMaxAge,
+		"census-agent-max-age",
+		agent.DefaultMaxAge,
+		"age beyond which a survey served by a census agent is stale",
+	)
+	flags.StringSliceVar(
+		&auditLogs,
+		"audit-log",
+		[]string{},
+		"Kubernetes audit log file or file name pattern to survey (supports multiple flags)",
+	)
+	flags.DurationVar(
+		&auditLogWindow,
+		"audit-log-window",
+		audit.DefaultWindow,
+		"window of time within which images admitted in audit logs are excluded",
+	)
+}
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"sigs.k8s.io/yaml"
+)
+
+// readRules returns the retention rules of each repository listed in the YAML
+// file at path.
+func readRules(path string) (map[string][]prune.Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading retention rules: %w", err)
+	}
+	rulesByRepo := map[string][]prune.Rule{}
+	if err := yaml.UnmarshalStrict(data, &rulesByRepo); err != nil {
+		return nil, fmt.Errorf("error decoding retention rules: %w", err)
+	}
+	return rulesByRepo, nil
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/kubernetes"
+)
+
+// newStateStore returns the store.Store selected by the state flags, or nil if
+// none of them were specified.
+func newStateStore(clientset kubernetes.Interface, sess *session.Session) (store.Store, error) {
+	selected := 0
+	for _, flag := range []string{stateDir, stateConfigMap, stateS3Bucket} {
+		if flag != "" {
+			selected++
+		}
+	}
+	if selected > 1 {
+		return nil, fmt.Errorf("only one of --state-dir, --state-configmap, and --state-s3-bucket may be specified")
+	}
+	switch {
+	case stateDir != "":
+		return store.NewFileStore(stateDir)
+	case stateConfigMap != "":
+		parts := strings.SplitN(stateConfigMap, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("--state-configmap must be of the form namespace/name")
+		}
+		return store.NewConfigMapStore(clientset, parts[0], parts[1])
+	case stateS3Bucket != "":
+		return store.NewS3Store(s3.New(sess), stateS3Bucket, stateS3Prefix)
+	}
+	return nil, nil
+}
+
+// addStateFlags adds the flags that select a state store to flags.
+func addStateFlags(flags *pflag.FlagSet) {
+	flags.StringVar(
+		&stateDir,
+		"state-dir",
+		"",
+		"directory in which to persist state between runs",
+	)
+	flags.StringVar(
+		&stateConfigMap,
+		"state-configmap",
+		"",
+		"Kubernetes ConfigMap (namespace/name) in which to persist state between runs",
+	)
+	flags.StringVar(
+		&stateS3Bucket,
+		"state-s3-bucket",
+		"",
+		"Amazon S3 bucket in which to persist state between runs",
+	)
+	flags.StringVar(
+		&stateS3Prefix,
+		"state-s3-prefix",
+		"thermite/",
+		"prefix of Amazon S3 object keys in which to persist state between runs",
+	)
+}
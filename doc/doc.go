@@ -4,8 +4,10 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"github.com/dollarshaveclub/thermite/cmd"
+	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
 
 	_ "embed"
@@ -14,6 +16,25 @@ import (
 //go:embed README.md
 var fm string
 
+// anchor links to the section of README.md generated for the command whose
+// documentation would otherwise be written to name.
+func anchor(name string) string {
+	return "#" + strings.ReplaceAll(strings.TrimSuffix(name, ".md"), "_", "-")
+}
+
+func genMarkdown(c *cobra.Command, file *os.File) {
+	if err := doc.GenMarkdownCustom(c, file, anchor); err != nil {
+		panic(err)
+	}
+	for _, sub := range c.Commands() {
+		if !sub.IsAvailableCommand() || sub.IsAdditionalHelpTopicCommand() {
+			continue
+		}
+		sub.DisableAutoGenTag = true
+		genMarkdown(sub, file)
+	}
+}
+
 func main() {
 	file, err := os.Create("README.md")
 	if err != nil {
@@ -23,10 +44,5 @@ func main() {
 	if _, err := file.Write([]byte(fm + "\n")); err != nil {
 		panic(err)
 	}
-	if err := doc.GenMarkdown(
-		cmd.RootCmd,
-		file,
-	); err != nil {
-		panic(err)
-	}
+	genMarkdown(cmd.RootCmd, file)
 }
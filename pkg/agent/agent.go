@@ -0,0 +1,320 @@
+// Package agent serves census surveys over HTTP, so that Kubernetes clusters
+// which cannot be reached directly can still be surveyed by a central Thermite.
+package agent
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// SurveyPath is the path at which a Server serves its survey.
+const SurveyPath = "/survey"
+
+// DefaultMaxAge is the default age beyond which a Client treats a survey served
+// by an agent as stale.
+const DefaultMaxAge = 15 * time.Minute
+
+// DefaultTimeout is the default time limit for each request that a Client
+// makes to an agent.
+const DefaultTimeout = time.Minute
+
+// A Server is an http.Handler that serves the most recent survey taken by a
+// census.Surveyor as JSON.
+type Server struct {
+	surveyor census.Surveyor
+	token    string
+	logger   *log.Logger
+	statsd   statsd.ClientInterface
+
+	mu     sync.RWMutex
+	survey *census.Survey
+}
+
+// A ServerOption is an option applied when creating a Server.
+type ServerOption func(s *Server)
+
+// WithServerToken sets a bearer token that requests to a Server must present.
+func WithServerToken(token string) ServerOption {
+	return func(s *Server) {
+		s.token = token
+	}
+}
+
+// WithServerLogger sets a logger for a Server to output to.
+func WithServerLogger(logger *log.Logger) ServerOption {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithServerStatsdClient sets a statsd client to use to report metrics from a
+// Server.
+func WithServerStatsdClient(client statsd.ClientInterface) ServerOption {
+	return func(s *Server) {
+		s.statsd = client
+	}
+}
+
+// NewServer returns a Server that serves surveys taken by surveyor. The Server
+// responds with 503 Service Unavailable until Refresh has succeeded once.
+func NewServer(surveyor census.Surveyor, opts ...ServerOption) (*Server, error) {
+	if surveyor == nil {
+		return nil, fmt.Errorf("surveyor must not be nil")
+	}
+	s := &Server{
+		surveyor: surveyor,
+		logger:   log.New(io.Discard, "", 0),
+		statsd:   &statsd.NoOpClient{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Refresh takes a new survey and serves it in place of the previous one.
+func (s *Server) Refresh(ctx context.Context) error {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "agent.Server.Refresh")
+	defer span.Finish()
+	survey, err := s.surveyor.TakeSurvey(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		s.statsd.Incr("agent.refresh_failed", nil, 1)
+		return fmt.Errorf("error taking survey: %w", err)
+	}
+	s.mu.Lock()
+	s.survey = &survey
+	s.mu.Unlock()
+	s.logger.Printf("refreshed survey of %d images", len(survey.Images))
+	return nil
+}
+
+// Run calls Refresh every interval until ctx is done. Errors are logged rather
+// than returned, so that clients see the survey grow stale instead of
+// disappearing.
+func (s *Server) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx); err != nil {
+			s.logger.Printf("error refreshing survey: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP serves the most recent survey at SurveyPath.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != SurveyPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.RLock()
+	survey := s.survey
+	s.mu.RUnlock()
+	if survey == nil {
+		http.Error(w, "no survey has been taken yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(survey); err != nil {
+		s.logger.Printf("error encoding survey: %v", err)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token, ok := cutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// cutPrefix returns s without prefix, and whether s began with prefix.
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// A Client is a census.Surveyor that combines the surveys served by remote
+// agents.
+type Client struct {
+	endpoints  []*url.URL
+	httpClient *http.Client
+	token      string
+	maxAge     time.Duration
+	logger     *log.Logger
+	statsd     statsd.ClientInterface
+}
+
+// An Option is an option applied when creating a Client.
+type Option func(c *Client)
+
+// WithHTTPClient sets the HTTP client used by a Client, for example to present
+// a client certificate to agents that require mutual TLS. The default client
+// gives up on each request after DefaultTimeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithToken sets a bearer token that a Client presents to agents.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithMaxAge sets the age beyond which a Client treats a survey served by an
+// agent as stale.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(c *Client) {
+		c.maxAge = maxAge
+	}
+}
+
+// WithLogger sets a logger for a Client to output to.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithStatsdClient sets a statsd client to use to report metrics from a Client.
+func WithStatsdClient(client statsd.ClientInterface) Option {
+	return func(c *Client) {
+		c.statsd = client
+	}
+}
+
+// NewClient returns a Client that surveys the agents at endpoints, each of
+// which is the base URL of a Server. If no WithMaxAge option is specified in
+// opts, DefaultMaxAge will be used.
+func NewClient(endpoints []string, opts ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("endpoints must not be empty")
+	}
+	c := &Client{
+		endpoints:  make([]*url.URL, 0, len(endpoints)),
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+		maxAge:     DefaultMaxAge,
+		logger:     log.New(io.Discard, "", 0),
+		statsd:     &statsd.NoOpClient{},
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing endpoint %s: %w", endpoint, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("endpoint %s must be an HTTP or HTTPS URL", endpoint)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + SurveyPath
+		c.endpoints = append(c.endpoints, u)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// SurveyDeployedImages returns the image references surveyed by every agent
+// known to c.
+func (c *Client) SurveyDeployedImages(ctx context.Context) ([]string, error) {
+	survey, err := c.TakeSurvey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return survey.Images, nil
+}
+
+// TakeSurvey fetches the survey served by every agent known to c and merges
+// them, prefixing the PodSpecLister and namespace names in the Summary of each
+// with the host of its agent. TakeSurvey fails if any agent is unreachable or
+// serves a survey older than the maximum age.
+func (c *Client) TakeSurvey(ctx context.Context) (census.Survey, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "agent.Client.TakeSurvey")
+	defer span.Finish()
+	defer c.statsd.Flush()
+	combined := census.Survey{Images: []string{}}
+	for _, endpoint := range c.endpoints {
+		survey, err := c.fetch(ctx, endpoint)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			c.statsd.Incr("agent.survey_failed", []string{"agent:" + endpoint.Host}, 1)
+			return census.Survey{}, fmt.Errorf("error surveying agent %s: %w", endpoint.Host, err)
+		}
+		if age := time.Since(survey.Summary.TakenAt); age > c.maxAge {
+			err := fmt.Errorf(
+				"survey from agent %s was taken %s ago, more than %s",
+				endpoint.Host,
+				age.Round(time.Second),
+				c.maxAge,
+			)
+			span.Finish(tracer.WithError(err))
+			c.statsd.Incr("agent.survey_stale", []string{"agent:" + endpoint.Host}, 1)
+			return census.Survey{}, err
+		}
+		c.logger.Printf("surveyed %d images from agent %s", len(survey.Images), endpoint.Host)
+		combined.Merge(endpoint.Host, survey)
+	}
+	return combined, nil
+}
+
+func (c *Client) fetch(ctx context.Context, endpoint *url.URL) (census.Survey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return census.Survey{}, fmt.Errorf("error creating request: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return census.Survey{}, fmt.Errorf("error requesting survey: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return census.Survey{}, fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	var survey census.Survey
+	if err := json.NewDecoder(resp.Body).Decode(&survey); err != nil {
+		return census.Survey{}, fmt.Errorf("error decoding survey: %w", err)
+	}
+	return survey, nil
+}
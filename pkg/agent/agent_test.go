@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/google/go-cmp/cmp"
+)
+
+type mockedSurveyor struct {
+	Survey census.Survey
+}
+
+func (m mockedSurveyor) SurveyDeployedImages(ctx context.Context) ([]string, error) {
+	return m.Survey.Images, nil
+}
+
+func (m mockedSurveyor) TakeSurvey(ctx context.Context) (census.Survey, error) {
+	return m.Survey, nil
+}
+
+func TestClient_TakeSurvey(t *testing.T) {
+	tests := []struct {
+		Name        string
+		TakenAt     time.Time
+		ServerToken string
+		ClientToken string
+		Refresh     bool
+		Error       bool
+	}{
+		{
+			Name:        "",
+			TakenAt:     time.Now().UTC(),
+			ServerToken: "secret",
+			ClientToken: "secret",
+			Refresh:     true,
+		},
+		{
+			Name:        "WrongToken",
+			TakenAt:     time.Now().UTC(),
+			ServerToken: "secret",
+			ClientToken: "guess",
+			Refresh:     true,
+			Error:       true,
+		},
+		{
+			Name:    "Stale",
+			TakenAt: time.Now().UTC().Add(-time.Hour),
+			Refresh: true,
+			Error:   true,
+		},
+		{
+			Name:    "NotRefreshed",
+			TakenAt: time.Now().UTC(),
+			Error:   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			surveyor := mockedSurveyor{
+				Survey: census.Survey{
+					Images: []string{"golang:1.15"},
+					Summary: census.Summary{
+						TakenAt:     test.TakenAt,
+						Images:      1,
+						ByLister:    map[string]int{"Deployment": 1},
+						ByNamespace: map[string]int{"default": 1},
+					},
+				},
+			}
+			server, err := NewServer(surveyor, WithServerToken(test.ServerToken))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.Refresh {
+				if err := server.Refresh(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			httpServer := httptest.NewServer(server)
+			defer httpServer.Close()
+			client, err := NewClient(
+				[]string{httpServer.URL},
+				WithToken(test.ClientToken),
+				WithMaxAge(time.Minute),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := client.TakeSurvey(context.Background())
+			if gotError := err != nil; gotError != test.Error {
+				t.Fatalf("expected error %t, got %v", test.Error, err)
+			}
+			if test.Error {
+				return
+			}
+			host := httpServer.Listener.Addr().String()
+			want := census.Survey{
+				Images: []string{"golang:1.15"},
+				Summary: census.Summary{
+					TakenAt:     test.TakenAt,
+					Images:      1,
+					ByLister:    map[string]int{host + "/Deployment": 1},
+					ByNamespace: map[string]int{host + "/default": 1},
+				},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestClient_TakeSurveyUnreachable(t *testing.T) {
+	httpServer := httptest.NewServer(nil)
+	url := httpServer.URL
+	httpServer.Close()
+	client, err := NewClient([]string{url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.TakeSurvey(context.Background()); err == nil {
+		t.Fatal("expected error surveying unreachable agent")
+	}
+}
+
+func TestServer_ServeHTTPAuthorization(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Authorization string
+		Status        int
+	}{
+		{
+			Name:          "",
+			Authorization: "Bearer secret",
+			Status:        http.StatusOK,
+		},
+		{
+			Name:          "BareToken",
+			Authorization: "secret",
+			Status:        http.StatusUnauthorized,
+		},
+		{
+			Name:          "WrongScheme",
+			Authorization: "Basic secret",
+			Status:        http.StatusUnauthorized,
+		},
+		{
+			Name:          "Missing",
+			Authorization: "",
+			Status:        http.StatusUnauthorized,
+		},
+	}
+	surveyor := mockedSurveyor{
+		Survey: census.Survey{
+			Images:  []string{"golang:1.15"},
+			Summary: census.Summary{TakenAt: time.Now().UTC(), Images: 1},
+		},
+	}
+	server, err := NewServer(surveyor, WithServerToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, SurveyPath, nil)
+			if test.Authorization != "" {
+				req.Header.Set("Authorization", test.Authorization)
+			}
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, req)
+			if rec.Code != test.Status {
+				t.Fatalf("expected status %d, got %d", test.Status, rec.Code)
+			}
+		})
+	}
+}
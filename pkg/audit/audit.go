@@ -0,0 +1,325 @@
+// Package audit surveys the container images admitted to a Kubernetes cluster
+// within a recent window by reading Kubernetes audit log files.
+package audit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// ListerName is the name under which images found in audit logs are counted
+// in a census.Summary. It also prefixes, followed by a slash, the namespaces
+// that they are counted under, so that images admitted in a namespace are not
+// mistaken for images deployed there when surveys are merged.
+const ListerName = "AuditLog"
+
+// DefaultWindow is the default window of time before a survey within which a
+// Client considers admitted images.
+const DefaultWindow = 7 * 24 * time.Hour
+
+// PodBearingResources are the resources whose create, update, and patch
+// requests are searched for images.
+var PodBearingResources = []string{
+	"cronjobs",
+	"daemonsets",
+	"deployments",
+	"jobs",
+	"pods",
+	"replicasets",
+	"replicationcontrollers",
+	"statefulsets",
+}
+
+// event holds the fields of an audit.k8s.io/v1 Event that a Client reads.
+type event struct {
+	Stage     string `json:"stage"`
+	Verb      string `json:"verb"`
+	ObjectRef *struct {
+		Resource    string `json:"resource"`
+		Namespace   string `json:"namespace"`
+		Subresource string `json:"subresource"`
+	} `json:"objectRef"`
+	ResponseStatus *struct {
+		Code int `json:"code"`
+	} `json:"responseStatus"`
+	RequestObject  json.RawMessage `json:"requestObject"`
+	ResponseObject json.RawMessage `json:"responseObject"`
+	StageTimestamp time.Time       `json:"stageTimestamp"`
+}
+
+// A Client is a census.Surveyor that reads Kubernetes audit log files.
+type Client struct {
+	patterns  []string
+	window    time.Duration
+	resources map[string]bool
+	now       func() time.Time
+	logger    *log.Logger
+	statsd    statsd.ClientInterface
+}
+
+// An Option is an option applied when creating a Client.
+type Option func(c *Client)
+
+// WithWindow sets the window of time before a survey within which a Client
+// considers admitted images.
+func WithWindow(window time.Duration) Option {
+	return func(c *Client) {
+		c.window = window
+	}
+}
+
+// WithLogger sets a logger for a Client to output to.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithStatsdClient sets a statsd client to use to report metrics from a Client.
+func WithStatsdClient(client statsd.ClientInterface) Option {
+	return func(c *Client) {
+		c.statsd = client
+	}
+}
+
+// NewClient returns a Client that reads the audit log files matching patterns,
+// which may contain shell file name patterns to match rotated files. Files
+// whose names end in .gz are decompressed. If no WithWindow option is
+// specified in opts, DefaultWindow will be used.
+func NewClient(patterns []string, opts ...Option) (*Client, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("patterns must not be empty")
+	}
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("error parsing pattern %s: %w", pattern, err)
+		}
+	}
+	c := &Client{
+		patterns:  patterns,
+		window:    DefaultWindow,
+		resources: make(map[string]bool, len(PodBearingResources)),
+		now:       time.Now,
+		logger:    log.New(io.Discard, "", 0),
+		statsd:    &statsd.NoOpClient{},
+	}
+	for _, resource := range PodBearingResources {
+		c.resources[resource] = true
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// SurveyDeployedImages returns the image references admitted within the window
+// of c.
+func (c *Client) SurveyDeployedImages(ctx context.Context) ([]string, error) {
+	survey, err := c.TakeSurvey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return survey.Images, nil
+}
+
+// TakeSurvey returns the image references found in the request and response
+// objects of successful create, update, and patch requests on
+// PodBearingResources that completed within the window of c. TakeSurvey fails
+// if no file matches the patterns of c, so that a missing log cannot silently
+// empty the survey, or if any complete line of a file cannot be decoded. An
+// unterminated last line that cannot be decoded is skipped, since it may still
+// be being written.
+func (c *Client) TakeSurvey(ctx context.Context) (census.Survey, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "audit.Client.TakeSurvey")
+	defer span.Finish()
+	defer c.statsd.Flush()
+	now := c.now().UTC()
+	since := now.Add(-c.window)
+	paths := []string{}
+	for _, pattern := range c.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return census.Survey{}, fmt.Errorf("error matching pattern %s: %w", pattern, err)
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		err := fmt.Errorf("no audit log files match %s", strings.Join(c.patterns, ", "))
+		span.Finish(tracer.WithError(err))
+		return census.Survey{}, err
+	}
+	imageSet := make(map[string]interface{})
+	namespaceImageSets := make(map[string]map[string]interface{})
+	for _, path := range paths {
+		if err := c.readFile(ctx, path, since, now, func(namespace, image string) {
+			imageSet[image] = nil
+			if namespaceImageSets[namespace] == nil {
+				namespaceImageSets[namespace] = make(map[string]interface{})
+			}
+			namespaceImageSets[namespace][image] = nil
+		}); err != nil {
+			span.Finish(tracer.WithError(err))
+			return census.Survey{}, err
+		}
+		c.logger.Printf("read audit log %s", path)
+	}
+	survey := census.Survey{
+		Images: make([]string, 0, len(imageSet)),
+		Summary: census.Summary{
+			TakenAt:     now,
+			Images:      len(imageSet),
+			ByLister:    map[string]int{ListerName: len(imageSet)},
+			ByNamespace: make(map[string]int, len(namespaceImageSets)),
+		},
+	}
+	for image := range imageSet {
+		survey.Images = append(survey.Images, image)
+	}
+	sort.Strings(survey.Images)
+	for namespace, namespaceImageSet := range namespaceImageSets {
+		survey.Summary.ByNamespace[ListerName+"/"+namespace] = len(namespaceImageSet)
+	}
+	c.logger.Printf(
+		"surveyed %d unique images admitted since %s",
+		len(survey.Images),
+		since.Format(time.RFC3339),
+	)
+	c.statsd.Gauge("audit.survey_admitted_images", float64(len(survey.Images)), nil, 1)
+	return survey, nil
+}
+
+func (c *Client) readFile(
+	ctx context.Context,
+	path string,
+	since time.Time,
+	until time.Time,
+	found func(namespace, image string),
+) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("error decompressing audit log %s: %w", path, err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	br := bufio.NewReader(r)
+	for lineNumber := 1; ; lineNumber++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := br.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var e event
+			if jsonErr := json.Unmarshal(line, &e); jsonErr != nil {
+				if errors.Is(err, io.EOF) {
+					// The API server may still be writing the last line
+					// of a live log, so it is left for the next survey.
+					c.logger.Printf("skipping unterminated line %d of audit log %s", lineNumber, path)
+					return nil
+				}
+				return fmt.Errorf("error decoding line %d of audit log %s: %w", lineNumber, path, jsonErr)
+			}
+			if c.admitted(e, since, until) {
+				for _, obj := range []json.RawMessage{e.RequestObject, e.ResponseObject} {
+					for _, image := range imagesFromObject(obj) {
+						found(e.ObjectRef.Namespace, image)
+					}
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading audit log %s: %w", path, err)
+		}
+	}
+}
+
+// admitted returns whether e records a successful change to the PodSpec of a
+// pod-bearing resource between since and until.
+func (c *Client) admitted(e event, since, until time.Time) bool {
+	if e.Stage != "ResponseComplete" || e.ObjectRef == nil || e.ObjectRef.Subresource != "" {
+		return false
+	}
+	if e.Verb != "create" && e.Verb != "update" && e.Verb != "patch" {
+		return false
+	}
+	if !c.resources[e.ObjectRef.Resource] {
+		return false
+	}
+	if e.ResponseStatus != nil && e.ResponseStatus.Code >= 300 {
+		return false
+	}
+	return !e.StageTimestamp.Before(since) && !e.StageTimestamp.After(until)
+}
+
+// imagesFromObject returns the image of every container listed under a
+// containers, initContainers, or ephemeralContainers key anywhere in obj, which
+// covers pods, pod templates, and patches of either.
+func imagesFromObject(obj json.RawMessage) []string {
+	if len(obj) == 0 {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(obj, &v); err != nil {
+		return nil
+	}
+	images := []string{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, value := range v {
+				switch key {
+				case "containers", "initContainers", "ephemeralContainers":
+					containers, ok := value.([]interface{})
+					if !ok {
+						break
+					}
+					for _, container := range containers {
+						container, ok := container.(map[string]interface{})
+						if !ok {
+							continue
+						}
+						if image, ok := container["image"].(string); ok && image != "" {
+							images = append(images, image)
+						}
+					}
+				default:
+					walk(value)
+				}
+			}
+		case []interface{}:
+			for _, value := range v {
+				walk(value)
+			}
+		}
+	}
+	walk(v)
+	return images
+}
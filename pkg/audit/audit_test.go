@@ -0,0 +1,94 @@
+package audit
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/google/go-cmp/cmp"
+)
+
+const auditLog = `{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"ResponseComplete","verb":"create","objectRef":{"resource":"jobs","namespace":"preview-1234","name":"migrate","apiGroup":"batch"},"responseStatus":{"code":201},"requestObject":{"kind":"Job","spec":{"template":{"spec":{"containers":[{"name":"migrate","image":"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"}]}}}},"stageTimestamp":"2021-08-05T12:00:00Z"}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"ResponseComplete","verb":"patch","objectRef":{"resource":"deployments","namespace":"default","name":"web","apiGroup":"apps"},"responseStatus":{"code":200},"requestObject":{"spec":{"template":{"spec":{"containers":[{"name":"web","image":"golang:1.15"}],"initContainers":[{"name":"init","image":"amazonlinux:2.0.20201218.1"}]}}}},"stageTimestamp":"2021-08-05T13:00:00Z"}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"ResponseComplete","verb":"create","objectRef":{"resource":"pods","namespace":"default","name":"denied"},"responseStatus":{"code":403},"requestObject":{"spec":{"containers":[{"name":"denied","image":"denied:latest"}]}},"stageTimestamp":"2021-08-05T13:00:00Z"}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"RequestReceived","verb":"create","objectRef":{"resource":"pods","namespace":"default","name":"received"},"requestObject":{"spec":{"containers":[{"name":"received","image":"received:latest"}]}},"stageTimestamp":"2021-08-05T13:00:00Z"}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"ResponseComplete","verb":"create","objectRef":{"resource":"configmaps","namespace":"default","name":"config"},"responseStatus":{"code":201},"requestObject":{"data":{"containers":"image"}},"stageTimestamp":"2021-08-05T13:00:00Z"}
+{"kind":"Event","apiVersion":"audit.k8s.io/v1","stage":"ResponseComplete","verb":"create","objectRef":{"resource":"pods","namespace":"default","name":"old"},"responseStatus":{"code":201},"requestObject":{"spec":{"containers":[{"name":"old","image":"old:latest"}]}},"stageTimestamp":"2021-07-01T00:00:00Z"}
+`
+
+func TestClient_TakeSurvey(t *testing.T) {
+	dir := t.TempDir()
+	lines := strings.SplitAfter(auditLog, "\n")
+	// The live log ends with a line that is still being written.
+	live := strings.Join(lines[:3], "") + lines[3][:40]
+	if err := os.WriteFile(filepath.Join(dir, "audit.log"), []byte(live), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(filepath.Join(dir, "audit-2021-08-05T12-00-00.000.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(file)
+	if _, err := gw.Write([]byte(strings.Join(lines[3:], ""))); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 8, 6, 0, 0, 0, 0, time.UTC)
+	client, err := NewClient([]string{filepath.Join(dir, "audit*.log*")}, WithWindow(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.now = func() time.Time { return now }
+	got, err := client.TakeSurvey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := census.Survey{
+		Images: []string{
+			"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+			"amazonlinux:2.0.20201218.1",
+			"golang:1.15",
+		},
+		Summary: census.Summary{
+			TakenAt:  now,
+			Images:   3,
+			ByLister: map[string]int{ListerName: 3},
+			ByNamespace: map[string]int{
+				ListerName + "/default":      2,
+				ListerName + "/preview-1234": 1,
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	malformed := filepath.Join(dir, "malformed.log")
+	if err := os.WriteFile(malformed, []byte(lines[3][:40]+"\n"+lines[0]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	malformedClient, err := NewClient([]string{malformed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformedClient.now = func() time.Time { return now }
+	if _, err := malformedClient.TakeSurvey(context.Background()); err == nil {
+		t.Fatal("expected error surveying audit log with a malformed complete line")
+	}
+	missing, err := NewClient([]string{filepath.Join(dir, "missing*.log")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := missing.TakeSurvey(context.Background()); err == nil {
+		t.Fatal("expected error surveying missing audit logs")
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"io"
 	"log"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
@@ -14,6 +16,7 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	batchV1beta1 "k8s.io/api/batch/v1beta1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/apimachinery/pkg/runtime"
@@ -26,6 +29,138 @@ type Taker interface {
 	SurveyDeployedImages(ctx context.Context) (deployed []string, err error)
 }
 
+// A Surveyor is a Taker that can also describe how the images it surveyed
+// were distributed across PodSpecListers and namespaces.
+type Surveyor interface {
+	Taker
+	TakeSurvey(ctx context.Context) (Survey, error)
+}
+
+// A Summary counts the unique images found by a survey, in total and for each
+// PodSpecLister and namespace that was surveyed.
+type Summary struct {
+	TakenAt     time.Time      `json:"takenAt"`
+	Images      int            `json:"images"`
+	ByLister    map[string]int `json:"byLister"`
+	ByNamespace map[string]int `json:"byNamespace"`
+}
+
+// A Survey is the sorted list of image references found by a Surveyor, along
+// with its Summary.
+type Survey struct {
+	Images  []string `json:"images"`
+	Summary Summary  `json:"summary"`
+}
+
+// CheckDrop compares s with a Summary taken by an earlier survey, and returns
+// an error describing every PodSpecLister whose image count has dropped by
+// more than maxListerDropPercent, and every namespace whose image count has
+// dropped by more than maxNamespaceDropPercent. A namespace or PodSpecLister
+// that is missing from s is treated as having dropped to zero.
+func (s Summary) CheckDrop(previous Summary, maxListerDropPercent, maxNamespaceDropPercent float64) error {
+	dropped := append(
+		drops("PodSpecLister", previous.ByLister, s.ByLister, maxListerDropPercent),
+		drops("namespace", previous.ByNamespace, s.ByNamespace, maxNamespaceDropPercent)...,
+	)
+	if len(dropped) > 0 {
+		return fmt.Errorf(
+			"survey dropped too far since %s: %s",
+			previous.TakenAt.Format(time.RFC3339),
+			strings.Join(dropped, ", "),
+		)
+	}
+	return nil
+}
+
+func drops(kind string, previous, current map[string]int, maxDropPercent float64) []string {
+	dropped := []string{}
+	for name, before := range previous {
+		if before <= 0 {
+			continue
+		}
+		after := current[name]
+		percent := float64(before-after) / float64(before) * 100
+		if percent <= maxDropPercent {
+			continue
+		}
+		dropped = append(dropped, fmt.Sprintf(
+			"%s %s from %d to %d images (%.0f%%)",
+			kind,
+			name,
+			before,
+			after,
+			percent,
+		))
+	}
+	sort.Strings(dropped)
+	return dropped
+}
+
+// Merge adds the images and counts of other to s. If prefix is not empty, the
+// PodSpecLister and namespace names of other are prefixed with it, followed by
+// a slash.
+func (s *Survey) Merge(prefix string, other Survey) {
+	imageSet := make(map[string]interface{}, len(s.Images)+len(other.Images))
+	for _, image := range s.Images {
+		imageSet[image] = nil
+	}
+	for _, image := range other.Images {
+		imageSet[image] = nil
+	}
+	s.Images = make([]string, 0, len(imageSet))
+	for image := range imageSet {
+		s.Images = append(s.Images, image)
+	}
+	sort.Strings(s.Images)
+	if s.Summary.TakenAt.IsZero() || other.Summary.TakenAt.Before(s.Summary.TakenAt) {
+		s.Summary.TakenAt = other.Summary.TakenAt
+	}
+	s.Summary.Images = len(s.Images)
+	if s.Summary.ByLister == nil {
+		s.Summary.ByLister = make(map[string]int, len(other.Summary.ByLister))
+	}
+	if s.Summary.ByNamespace == nil {
+		s.Summary.ByNamespace = make(map[string]int, len(other.Summary.ByNamespace))
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	for name, count := range other.Summary.ByLister {
+		s.Summary.ByLister[prefix+name] += count
+	}
+	for name, count := range other.Summary.ByNamespace {
+		s.Summary.ByNamespace[prefix+name] += count
+	}
+}
+
+type combinedSurveyor []Surveyor
+
+// Combine returns a Surveyor that merges the surveys taken by each of
+// surveyors, and fails if any of them fails.
+func Combine(surveyors ...Surveyor) Surveyor {
+	return combinedSurveyor(surveyors)
+}
+
+func (cs combinedSurveyor) SurveyDeployedImages(ctx context.Context) ([]string, error) {
+	survey, err := cs.TakeSurvey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return survey.Images, nil
+}
+
+func (cs combinedSurveyor) TakeSurvey(ctx context.Context) (Survey, error) {
+	combined := Survey{Images: []string{}}
+	for _, surveyor := range cs {
+		survey, err := surveyor.TakeSurvey(ctx)
+		if err != nil {
+			return Survey{}, err
+		}
+		combined.Merge("", survey)
+	}
+	return combined, nil
+}
+
 // PodSpecLister is implemented for resource kinds which contain a PodSpec and
 // can be listed via the Kubernetes API.
 type PodSpecLister interface {
@@ -127,12 +262,30 @@ func NewClient(clientset kubernetes.Interface, opts ...Option) (*Client, error)
 // SurveyDeployedImages returns the image references of the containers and init containers
 // of the PodSpecs surveyed by t.
 func (c *Client) SurveyDeployedImages(ctx context.Context) ([]string, error) {
+	survey, err := c.TakeSurvey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return survey.Images, nil
+}
+
+// TakeSurvey returns the image references of the containers and init
+// containers of the PodSpecs surveyed by c, along with a Summary of the
+// unique images found by each PodSpecLister and in each namespace.
+func (c *Client) TakeSurvey(ctx context.Context) (Survey, error) {
 	var span tracer.Span
-	span, ctx = tracer.StartSpanFromContext(ctx, "census.Client.SurveyDeployedImages")
+	span, ctx = tracer.StartSpanFromContext(ctx, "census.Client.TakeSurvey")
 	defer span.Finish()
 	defer c.statsd.Flush()
 	imageSet := make(map[string]interface{})
+	summary := Summary{
+		TakenAt:     time.Now().UTC(),
+		ByLister:    make(map[string]int, len(c.listers)),
+		ByNamespace: make(map[string]int),
+	}
+	namespaceImageSets := make(map[string]map[string]interface{})
 	for _, l := range c.listers {
+		listerImageSet := make(map[string]interface{})
 		pager := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
 			return l.List(ctx, c.clientset)
 		})
@@ -146,30 +299,55 @@ func (c *Client) SurveyDeployedImages(ctx context.Context) ([]string, error) {
 				if err != nil {
 					return fmt.Errorf("error getting PodSpec from resource: %w", err)
 				}
+				namespace := ""
+				if accessor, err := meta.Accessor(obj); err == nil {
+					namespace = accessor.GetNamespace()
+				}
+				if namespaceImageSets[namespace] == nil {
+					namespaceImageSets[namespace] = make(map[string]interface{})
+				}
 				containers := append(spec.Containers, spec.InitContainers...)
 				for _, c := range containers {
 					imageSet[c.Image] = nil
+					listerImageSet[c.Image] = nil
+					namespaceImageSets[namespace][c.Image] = nil
 				}
 				return nil
 			},
 		); err != nil {
 			span.Finish(tracer.WithError(err))
-			return nil, fmt.Errorf("error listing resources: %w", err)
+			return Survey{}, fmt.Errorf("error listing resources: %w", err)
 		}
+		summary.ByLister[listerName(l)] = len(listerImageSet)
 		c.logger.Printf("listed images from PodSpecLister %T", l)
 	}
+	for namespace, namespaceImageSet := range namespaceImageSets {
+		summary.ByNamespace[namespace] = len(namespaceImageSet)
+	}
 	imageRefs := make([]string, 0, len(imageSet))
 	for image := range imageSet {
 		imageRefs = append(imageRefs, image)
 	}
 	sort.Sort(sort.StringSlice(imageRefs))
+	summary.Images = len(imageRefs)
 	c.logger.Printf("surveyed %d unique deployed images", len(imageRefs))
 	c.statsd.Gauge("census.survey_deployed_images", float64(len(imageRefs)), nil, 1)
-	return imageRefs, nil
+	return Survey{Images: imageRefs, Summary: summary}, nil
+}
+
+// listerName returns the name under which the images found by l are counted in
+// a Summary.
+func listerName(l PodSpecLister) string {
+	if stringer, ok := l.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", l)
 }
 
 type cronJobLister struct{}
 
+func (l *cronJobLister) String() string { return "CronJob" }
+
 func (l *cronJobLister) List(ctx context.Context, clientset kubernetes.Interface) (runtime.Object, error) {
 	list, err := clientset.BatchV1beta1().CronJobs("").List(ctx, metav1.ListOptions{})
 	if err != nil {
@@ -194,6 +372,8 @@ func (l *cronJobLister) GetPodSpec(ctx context.Context, obj runtime.Object) (v1.
 
 type daemonSetLister struct{}
 
+func (l *daemonSetLister) String() string { return "DaemonSet" }
+
 func (l *daemonSetLister) List(ctx context.Context, clientset kubernetes.Interface) (runtime.Object, error) {
 	list, err := clientset.AppsV1().DaemonSets("").List(ctx, metav1.ListOptions{})
 	if err != nil {
@@ -218,6 +398,8 @@ func (l *daemonSetLister) GetPodSpec(ctx context.Context, obj runtime.Object) (v
 
 type deploymentLister struct{}
 
+func (l *deploymentLister) String() string { return "Deployment" }
+
 func (l *deploymentLister) List(ctx context.Context, clientset kubernetes.Interface) (runtime.Object, error) {
 	list, err := clientset.AppsV1().Deployments("").List(ctx, metav1.ListOptions{})
 	if err != nil {
@@ -242,6 +424,8 @@ func (l *deploymentLister) GetPodSpec(ctx context.Context, obj runtime.Object) (
 
 type jobLister struct{}
 
+func (l *jobLister) String() string { return "Job" }
+
 func (l *jobLister) List(ctx context.Context, clientset kubernetes.Interface) (runtime.Object, error) {
 	list, err := clientset.BatchV1().Jobs("").List(ctx, metav1.ListOptions{})
 	if err != nil {
@@ -266,6 +450,8 @@ func (l *jobLister) GetPodSpec(ctx context.Context, obj runtime.Object) (v1.PodS
 
 type statefulSetLister struct{}
 
+func (l *statefulSetLister) String() string { return "StatefulSet" }
+
 func (l *statefulSetLister) List(ctx context.Context, clientset kubernetes.Interface) (runtime.Object, error) {
 	list, err := clientset.AppsV1().StatefulSets("").List(ctx, metav1.ListOptions{})
 	if err != nil {
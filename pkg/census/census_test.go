@@ -4,6 +4,7 @@ import (
 	"context"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	appsv1 "k8s.io/api/apps/v1"
@@ -155,3 +156,183 @@ func TestTaker_ImagesInUse(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_TakeSurvey(t *testing.T) {
+	objects := []runtime.Object{
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "thermite",
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: v1.PodTemplateSpec{
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{Image: "golang:1.15"},
+						},
+						InitContainers: []v1.Container{
+							{Image: "amazonlinux:2.0.20201218.1"},
+						},
+					},
+				},
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "bar",
+				Namespace: "default",
+			},
+			Spec: batchv1.JobSpec{
+				Template: v1.PodTemplateSpec{
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{
+							{Image: "golang:1.15"},
+						},
+					},
+				},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	taker, err := NewDefaultClient(clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := taker.TakeSurvey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Survey{
+		Images: []string{"amazonlinux:2.0.20201218.1", "golang:1.15"},
+		Summary: Summary{
+			Images: 2,
+			ByLister: map[string]int{
+				"CronJob":     0,
+				"DaemonSet":   0,
+				"Deployment":  2,
+				"Job":         1,
+				"StatefulSet": 0,
+			},
+			ByNamespace: map[string]int{
+				"default":  1,
+				"thermite": 2,
+			},
+		},
+	}
+	if got.Summary.TakenAt.IsZero() {
+		t.Fatal("expected non-zero TakenAt")
+	}
+	got.Summary.TakenAt = time.Time{}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestSummary_CheckDrop(t *testing.T) {
+	previous := Summary{
+		Images: 10,
+		ByLister: map[string]int{
+			"Deployment": 8,
+			"CronJob":    2,
+		},
+		ByNamespace: map[string]int{
+			"default":  4,
+			"thermite": 6,
+		},
+	}
+	tests := []struct {
+		Name                    string
+		Current                 Summary
+		MaxListerDropPercent    float64
+		MaxNamespaceDropPercent float64
+		Error                   bool
+	}{
+		{
+			Name:                    "Unchanged",
+			Current:                 previous,
+			MaxListerDropPercent:    0,
+			MaxNamespaceDropPercent: 0,
+		},
+		{
+			Name: "ListerDropWithinLimit",
+			Current: Summary{
+				ByLister:    map[string]int{"Deployment": 4, "CronJob": 2},
+				ByNamespace: map[string]int{"default": 4, "thermite": 6},
+			},
+			MaxListerDropPercent:    50,
+			MaxNamespaceDropPercent: 0,
+		},
+		{
+			Name: "ListerMissing",
+			Current: Summary{
+				ByLister:    map[string]int{"Deployment": 8},
+				ByNamespace: map[string]int{"default": 4, "thermite": 6},
+			},
+			MaxListerDropPercent:    50,
+			MaxNamespaceDropPercent: 50,
+			Error:                   true,
+		},
+		{
+			Name: "NamespaceDropBeyondLimit",
+			Current: Summary{
+				ByLister:    map[string]int{"Deployment": 8, "CronJob": 2},
+				ByNamespace: map[string]int{"default": 1, "thermite": 6},
+			},
+			MaxListerDropPercent:    50,
+			MaxNamespaceDropPercent: 50,
+			Error:                   true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Current.CheckDrop(
+				previous,
+				test.MaxListerDropPercent,
+				test.MaxNamespaceDropPercent,
+			)
+			if gotError := err != nil; gotError != test.Error {
+				t.Fatalf("expected error %t, got %v", test.Error, err)
+			}
+		})
+	}
+}
+
+func TestSurvey_Merge(t *testing.T) {
+	takenAt := time.Now().UTC()
+	got := Survey{
+		Images: []string{"golang:1.15"},
+		Summary: Summary{
+			TakenAt:     takenAt,
+			Images:      1,
+			ByLister:    map[string]int{"Deployment": 1},
+			ByNamespace: map[string]int{"default": 1},
+		},
+	}
+	got.Merge("cluster-b", Survey{
+		Images: []string{"amazonlinux:2.0.20201218.1", "golang:1.15"},
+		Summary: Summary{
+			TakenAt:     takenAt.Add(-time.Minute),
+			Images:      2,
+			ByLister:    map[string]int{"Deployment": 2},
+			ByNamespace: map[string]int{"default": 2},
+		},
+	})
+	want := Survey{
+		Images: []string{"amazonlinux:2.0.20201218.1", "golang:1.15"},
+		Summary: Summary{
+			TakenAt: takenAt.Add(-time.Minute),
+			Images:  2,
+			ByLister: map[string]int{
+				"Deployment":           1,
+				"cluster-b/Deployment": 2,
+			},
+			ByNamespace: map[string]int{
+				"default":           1,
+				"cluster-b/default": 2,
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
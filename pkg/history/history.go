@@ -0,0 +1,142 @@
+// Package history records when each surveyed image was first and last seen
+// deployed, so that recently undeployed images can be kept for a grace period.
+package history
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Key is the key under which a Client persists its history.
+const Key = "image-history.json"
+
+// A Record is the first and last time an image was seen deployed.
+type Record struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// A Client records the images seen in each survey in a store.Store.
+type Client struct {
+	store       store.Store
+	gracePeriod time.Duration
+	logger      *log.Logger
+	statsd      statsd.ClientInterface
+}
+
+// An Option is an option applied when creating a Client.
+type Option func(c *Client)
+
+// WithLogger sets a logger for a Client to output to.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithStatsdClient sets a statsd client to use to report metrics from a Client.
+func WithStatsdClient(client statsd.ClientInterface) Option {
+	return func(c *Client) {
+		c.statsd = client
+	}
+}
+
+// NewClient returns a Client that keeps its history in s, and protects images
+// seen deployed within gracePeriod.
+func NewClient(s store.Store, gracePeriod time.Duration, opts ...Option) (*Client, error) {
+	if s == nil {
+		return nil, fmt.Errorf("s must not be nil")
+	}
+	if gracePeriod <= 0 {
+		return nil, fmt.Errorf("gracePeriod must be positive")
+	}
+	c := &Client{
+		store:       s,
+		gracePeriod: gracePeriod,
+		logger:      log.New(io.Discard, "", 0),
+		statsd:      &statsd.NoOpClient{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Load returns the recorded history of every image, keyed by image reference.
+func (c *Client) Load(ctx context.Context) (map[string]Record, error) {
+	data, err := c.store.Get(ctx, Key)
+	if errors.Is(err, store.ErrNotFound) {
+		return map[string]Record{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading image history: %w", err)
+	}
+	records := map[string]Record{}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("error decoding image history: %w", err)
+	}
+	return records, nil
+}
+
+// Update records that every image referenced by surveyed was seen deployed at
+// seenAt, forgets images that have not been seen within the grace period of c,
+// and returns the sorted references of every image seen deployed within the
+// grace period, including those in surveyed.
+func (c *Client) Update(ctx context.Context, seenAt time.Time, surveyed ...string) (recent []string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "history.Client.Update")
+	defer span.Finish()
+	defer c.statsd.Flush()
+	records, err := c.Load(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	seenAt = seenAt.UTC()
+	for _, imageRef := range surveyed {
+		record, ok := records[imageRef]
+		if !ok {
+			record.FirstSeen = seenAt
+		}
+		if record.LastSeen.Before(seenAt) {
+			record.LastSeen = seenAt
+		}
+		records[imageRef] = record
+	}
+	cutoff := seenAt.Add(-c.gracePeriod)
+	recent = make([]string, 0, len(records))
+	for imageRef, record := range records {
+		if record.LastSeen.Before(cutoff) {
+			delete(records, imageRef)
+			continue
+		}
+		recent = append(recent, imageRef)
+	}
+	sort.Strings(recent)
+	data, err := json.Marshal(records)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error encoding image history: %w", err)
+	}
+	if err := c.store.Put(ctx, Key, data); err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error saving image history: %w", err)
+	}
+	c.logger.Printf(
+		"protecting %d images seen deployed since %s",
+		len(recent),
+		cutoff.Format(time.RFC3339),
+	)
+	c.statsd.Gauge("history.recently_deployed_images", float64(len(recent)), nil, 1)
+	return recent, nil
+}
@@ -0,0 +1,74 @@
+package history
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClient_Update(t *testing.T) {
+	start := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Name     string
+		SeenAt   time.Time
+		Surveyed []string
+		Recent   []string
+	}{
+		{
+			Name:     "Deployed",
+			SeenAt:   start,
+			Surveyed: []string{"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22"},
+			Recent:   []string{"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22"},
+		},
+		{
+			Name:     "Redeployed",
+			SeenAt:   start.Add(24 * time.Hour),
+			Surveyed: []string{"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"},
+			Recent: []string{
+				"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+				"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+			},
+		},
+		{
+			Name:     "GracePeriodElapsed",
+			SeenAt:   start.Add(8 * 24 * time.Hour),
+			Surveyed: []string{"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"},
+			Recent:   []string{"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"},
+		},
+	}
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(s, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got, err := client.Update(context.Background(), test.SeenAt, test.Surveyed...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Recent, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+	records, err := client.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Record{
+		"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6": {
+			FirstSeen: start.Add(24 * time.Hour),
+			LastSeen:  start.Add(8 * 24 * time.Hour),
+		},
+	}
+	if diff := cmp.Diff(want, records); diff != "" {
+		t.Fatal(diff)
+	}
+}
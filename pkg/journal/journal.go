@@ -0,0 +1,171 @@
+// Package journal records the manifest and tags of each image before it is
+// deleted, so that deleted images can be restored while Elastic Container
+// Registry still has their layers.
+package journal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// KeyPrefix prefixes the key under which a Client persists the journal of each
+// repository, which is followed by the escaped repository URI and ".json".
+const KeyPrefix = "deletion-journal-"
+
+// Key returns the key under which a Client persists the journal of the
+// repository with the given URI.
+func Key(repository string) string {
+	return KeyPrefix + url.QueryEscape(repository) + ".json"
+}
+
+// An Entry describes an image as it was just before it was deleted.
+type Entry struct {
+	// Repository is the URI of the repository of the image.
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	Tags       []string  `json:"tags,omitempty"`
+	Manifest   string    `json:"manifest"`
+	MediaType  string    `json:"mediaType,omitempty"`
+	PushedAt   time.Time `json:"pushedAt"`
+	DeletedAt  time.Time `json:"deletedAt"`
+}
+
+// A Client records deleted images in a store.Store.
+type Client struct {
+	store     store.Store
+	retention time.Duration
+	logger    *log.Logger
+	statsd    statsd.ClientInterface
+}
+
+// An Option is an option applied when creating a Client.
+type Option func(c *Client)
+
+// WithLogger sets a logger for a Client to output to.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithStatsdClient sets a statsd client to use to report metrics from a Client.
+func WithStatsdClient(client statsd.ClientInterface) Option {
+	return func(c *Client) {
+		c.statsd = client
+	}
+}
+
+// NewClient returns a Client that keeps its journal in s, and forgets images
+// deleted from a repository more than retention before the latest deletion it
+// records there, or none if retention is zero. Since the journal holds the full
+// manifest of every deleted image, s must not be a *store.ConfigMapStore, whose
+// documents may total no more than 1 MiB.
+func NewClient(s store.Store, retention time.Duration, opts ...Option) (*Client, error) {
+	if s == nil {
+		return nil, fmt.Errorf("s must not be nil")
+	}
+	if _, ok := s.(*store.ConfigMapStore); ok {
+		return nil, fmt.Errorf("a ConfigMap is too small to hold a deletion journal")
+	}
+	if retention < 0 {
+		return nil, fmt.Errorf("retention must not be negative")
+	}
+	c := &Client{
+		store:     s,
+		retention: retention,
+		logger:    log.New(io.Discard, "", 0),
+		statsd:    &statsd.NoOpClient{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Load returns every entry in the journal of the repository with the given URI,
+// in the order they were recorded.
+func (c *Client) Load(ctx context.Context, repository string) ([]Entry, error) {
+	data, err := c.store.Get(ctx, Key(repository))
+	if errors.Is(err, store.ErrNotFound) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading deletion journal of repository %s: %w", repository, err)
+	}
+	entries := []Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("error decoding deletion journal of repository %s: %w", repository, err)
+	}
+	return entries, nil
+}
+
+// Record adds entries for images about to be deleted at deletedAt to the
+// journals of their repositories, and forgets entries in those journals for
+// images deleted more than the nonzero retention of c before deletedAt. Only
+// the journals of the repositories of entries are rewritten. Record returns
+// once they have been saved.
+func (c *Client) Record(ctx context.Context, deletedAt time.Time, entries ...Entry) error {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "journal.Client.Record")
+	defer span.Finish()
+	defer c.statsd.Flush()
+	deletedAt = deletedAt.UTC()
+	repositories := []string{}
+	byRepository := map[string][]Entry{}
+	for _, entry := range entries {
+		if _, ok := byRepository[entry.Repository]; !ok {
+			repositories = append(repositories, entry.Repository)
+		}
+		entry.DeletedAt = deletedAt
+		byRepository[entry.Repository] = append(byRepository[entry.Repository], entry)
+	}
+	for _, repository := range repositories {
+		if err := c.record(ctx, deletedAt, repository, byRepository[repository]); err != nil {
+			span.Finish(tracer.WithError(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// record adds entries to the journal of repository, forgetting those that the
+// retention of c has passed for.
+func (c *Client) record(ctx context.Context, deletedAt time.Time, repository string, entries []Entry) error {
+	recorded, err := c.Load(ctx, repository)
+	if err != nil {
+		return err
+	}
+	cutoff := deletedAt.Add(-c.retention)
+	kept := make([]Entry, 0, len(recorded)+len(entries))
+	for _, entry := range recorded {
+		if c.retention == 0 || !entry.DeletedAt.Before(cutoff) {
+			kept = append(kept, entry)
+		}
+	}
+	kept = append(kept, entries...)
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return fmt.Errorf("error encoding deletion journal of repository %s: %w", repository, err)
+	}
+	if err := c.store.Put(ctx, Key(repository), data); err != nil {
+		return fmt.Errorf("error saving deletion journal of repository %s: %w", repository, err)
+	}
+	c.logger.Printf(
+		"journaled %d images of repository %s before deleting them, and forgot %d deleted earlier",
+		len(entries),
+		repository,
+		len(recorded)+len(entries)-len(kept),
+	)
+	c.statsd.Gauge("journal.entries", float64(len(kept)), []string{"repository:" + repository}, 1)
+	return nil
+}
@@ -0,0 +1,121 @@
+package journal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestClient_Record(t *testing.T) {
+	start := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	uri := "000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite"
+	tests := []struct {
+		Name      string
+		DeletedAt time.Time
+		Entries   []Entry
+		Want      []Entry
+	}{
+		{
+			Name:      "Deleted",
+			DeletedAt: start,
+			Entries: []Entry{
+				{Repository: uri, Digest: "sha256:1", Tags: []string{"v1"}, Manifest: "{}"},
+			},
+			Want: []Entry{
+				{Repository: uri, Digest: "sha256:1", Tags: []string{"v1"}, Manifest: "{}", DeletedAt: start},
+			},
+		},
+		{
+			Name:      "DeletedAgain",
+			DeletedAt: start.Add(24 * time.Hour),
+			Entries: []Entry{
+				{Repository: uri, Digest: "sha256:2", Manifest: "{}"},
+			},
+			Want: []Entry{
+				{Repository: uri, Digest: "sha256:1", Tags: []string{"v1"}, Manifest: "{}", DeletedAt: start},
+				{Repository: uri, Digest: "sha256:2", Manifest: "{}", DeletedAt: start.Add(24 * time.Hour)},
+			},
+		},
+		{
+			Name:      "RetentionElapsed",
+			DeletedAt: start.Add(8 * 24 * time.Hour),
+			Entries: []Entry{
+				{Repository: uri, Digest: "sha256:3", Manifest: "{}"},
+			},
+			Want: []Entry{
+				{Repository: uri, Digest: "sha256:2", Manifest: "{}", DeletedAt: start.Add(24 * time.Hour)},
+				{Repository: uri, Digest: "sha256:3", Manifest: "{}", DeletedAt: start.Add(8 * 24 * time.Hour)},
+			},
+		},
+	}
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(s, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if err := client.Record(context.Background(), test.DeletedAt, test.Entries...); err != nil {
+				t.Fatal(err)
+			}
+			got, err := client.Load(context.Background(), uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestClient_RecordShards(t *testing.T) {
+	deletedAt := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	web := "000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/web"
+	api := "000123456789.dkr.ecr.us-east-1.amazonaws.com/api"
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Record(
+		context.Background(),
+		deletedAt,
+		Entry{Repository: web, Digest: "sha256:1", Manifest: "{}"},
+		Entry{Repository: api, Digest: "sha256:2", Manifest: "{}"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	for repository, want := range map[string][]Entry{
+		web: {{Repository: web, Digest: "sha256:1", Manifest: "{}", DeletedAt: deletedAt}},
+		api: {{Repository: api, Digest: "sha256:2", Manifest: "{}", DeletedAt: deletedAt}},
+	} {
+		if _, err := s.Get(context.Background(), Key(repository)); err != nil {
+			t.Fatalf("expected journal of repository %s under its own key: %v", repository, err)
+		}
+		got, err := client.Load(context.Background(), repository)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+	configMaps, err := store.NewConfigMapStore(fake.NewSimpleClientset(), "default", "thermite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewClient(configMaps, 0); err == nil {
+		t.Fatal("expected error creating Client with a ConfigMap store")
+	}
+}
@@ -0,0 +1,186 @@
+// Package ledger records when each image was first and last marked as a
+// candidate for deletion, so that images are deleted only after they have been
+// found pruneable by several runs.
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Key is the key under which a Client persists its ledger.
+const Key = "deletion-ledger.json"
+
+// A Mark is the first and last time an image was marked as a candidate for
+// deletion.
+type Mark struct {
+	FirstMarked time.Time `json:"firstMarked"`
+	LastMarked  time.Time `json:"lastMarked"`
+}
+
+// A Client marks candidates for deletion in a store.Store, and sweeps those
+// that were marked at least a minimum interval earlier.
+type Client struct {
+	store       store.Store
+	minInterval time.Duration
+	logger      *log.Logger
+	statsd      statsd.ClientInterface
+}
+
+// An Option is an option applied when creating a Client.
+type Option func(c *Client)
+
+// WithLogger sets a logger for a Client to output to.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithStatsdClient sets a statsd client to use to report metrics from a Client.
+func WithStatsdClient(client statsd.ClientInterface) Option {
+	return func(c *Client) {
+		c.statsd = client
+	}
+}
+
+// NewClient returns a Client that keeps its ledger in s, and sweeps images that
+// were first marked at least minInterval before the run sweeping them.
+func NewClient(s store.Store, minInterval time.Duration, opts ...Option) (*Client, error) {
+	if s == nil {
+		return nil, fmt.Errorf("s must not be nil")
+	}
+	if minInterval <= 0 {
+		return nil, fmt.Errorf("minInterval must be positive")
+	}
+	c := &Client{
+		store:       s,
+		minInterval: minInterval,
+		logger:      log.New(io.Discard, "", 0),
+		statsd:      &statsd.NoOpClient{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Load returns the marks of every image, keyed by repository URI and then by
+// image digest.
+func (c *Client) Load(ctx context.Context) (map[string]map[string]Mark, error) {
+	data, err := c.store.Get(ctx, Key)
+	if errors.Is(err, store.ErrNotFound) {
+		return map[string]map[string]Mark{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading deletion ledger: %w", err)
+	}
+	marks := map[string]map[string]Mark{}
+	if err := json.Unmarshal(data, &marks); err != nil {
+		return nil, fmt.Errorf("error decoding deletion ledger: %w", err)
+	}
+	return marks, nil
+}
+
+// Sweep marks the image digests of each repository URI in candidates as
+// candidates for deletion at markedAt, forgets every other mark in those
+// repositories, and returns the sorted digests of the candidates in each of
+// them that were first marked at least the minimum interval of c before
+// markedAt. Marks in repositories missing from candidates are kept, so that
+// runs pruning different repositories can share a ledger.
+func (c *Client) Sweep(ctx context.Context, markedAt time.Time, candidates map[string][]string) (sweepable map[string][]string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "ledger.Client.Sweep")
+	defer span.Finish()
+	defer c.statsd.Flush()
+	marks, err := c.Load(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	sweepable, marked := c.mark(marks, markedAt, candidates)
+	data, err := json.Marshal(marks)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error encoding deletion ledger: %w", err)
+	}
+	if err := c.store.Put(ctx, Key, data); err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error saving deletion ledger: %w", err)
+	}
+	swept := 0
+	for _, digests := range sweepable {
+		swept += len(digests)
+	}
+	c.logger.Printf(
+		"sweeping %d images marked for deletion before %s, and keeping %d marked since",
+		swept,
+		markedAt.UTC().Add(-c.minInterval).Format(time.RFC3339),
+		marked,
+	)
+	c.statsd.Gauge("ledger.marked_images", float64(marked), nil, 1)
+	c.statsd.Gauge("ledger.sweepable_images", float64(swept), nil, 1)
+	return sweepable, nil
+}
+
+// Preview returns the digests that Sweep would return for candidates at
+// markedAt, without saving any marks, so that a dry run cannot bring deletions
+// forward.
+func (c *Client) Preview(ctx context.Context, markedAt time.Time, candidates map[string][]string) (sweepable map[string][]string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "ledger.Client.Preview")
+	defer span.Finish()
+	marks, err := c.Load(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	sweepable, _ = c.mark(marks, markedAt, candidates)
+	return sweepable, nil
+}
+
+// mark updates marks with the candidates marked at markedAt, and returns the
+// sweepable digests of each repository in candidates along with the number of
+// candidates that are only marked.
+func (c *Client) mark(marks map[string]map[string]Mark, markedAt time.Time, candidates map[string][]string) (sweepable map[string][]string, marked int) {
+	markedAt = markedAt.UTC()
+	cutoff := markedAt.Add(-c.minInterval)
+	sweepable = make(map[string][]string, len(candidates))
+	for uri, digests := range candidates {
+		previous := marks[uri]
+		current := make(map[string]Mark, len(digests))
+		sweepable[uri] = []string{}
+		for _, digest := range digests {
+			mark, ok := previous[digest]
+			if !ok {
+				mark.FirstMarked = markedAt
+			}
+			if mark.LastMarked.Before(markedAt) {
+				mark.LastMarked = markedAt
+			}
+			current[digest] = mark
+			if mark.FirstMarked.After(cutoff) {
+				marked++
+				continue
+			}
+			sweepable[uri] = append(sweepable[uri], digest)
+		}
+		sort.Strings(sweepable[uri])
+		if len(current) == 0 {
+			delete(marks, uri)
+			continue
+		}
+		marks[uri] = current
+	}
+	return sweepable, marked
+}
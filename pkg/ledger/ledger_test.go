@@ -0,0 +1,135 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/thermite/pkg/store"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClient_Sweep(t *testing.T) {
+	start := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Name       string
+		MarkedAt   time.Time
+		Candidates map[string][]string
+		Sweepable  map[string][]string
+	}{
+		{
+			Name:     "Mark",
+			MarkedAt: start,
+			Candidates: map[string][]string{
+				"thermite": {"sha256:1", "sha256:2"},
+				"web":      {"sha256:3"},
+			},
+			Sweepable: map[string][]string{
+				"thermite": {},
+				"web":      {},
+			},
+		},
+		{
+			Name:     "TooSoon",
+			MarkedAt: start.Add(12 * time.Hour),
+			Candidates: map[string][]string{
+				"thermite": {"sha256:2", "sha256:1"},
+			},
+			Sweepable: map[string][]string{
+				"thermite": {},
+			},
+		},
+		{
+			Name:     "Sweep",
+			MarkedAt: start.Add(24 * time.Hour),
+			Candidates: map[string][]string{
+				"thermite": {"sha256:2", "sha256:4"},
+			},
+			Sweepable: map[string][]string{
+				"thermite": {"sha256:2"},
+			},
+		},
+		{
+			Name:     "Unmarked",
+			MarkedAt: start.Add(48 * time.Hour),
+			Candidates: map[string][]string{
+				"thermite": {"sha256:1", "sha256:4"},
+			},
+			Sweepable: map[string][]string{
+				"thermite": {"sha256:4"},
+			},
+		},
+	}
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(s, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got, err := client.Sweep(context.Background(), test.MarkedAt, test.Candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Sweepable, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+	marks, err := client.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]Mark{
+		"thermite": {
+			"sha256:1": {FirstMarked: start.Add(48 * time.Hour), LastMarked: start.Add(48 * time.Hour)},
+			"sha256:4": {FirstMarked: start.Add(24 * time.Hour), LastMarked: start.Add(48 * time.Hour)},
+		},
+		"web": {
+			"sha256:3": {FirstMarked: start, LastMarked: start},
+		},
+	}
+	if diff := cmp.Diff(want, marks); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestClient_Preview(t *testing.T) {
+	start := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(s, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := map[string][]string{"thermite": {"sha256:1"}}
+	if _, err := client.Sweep(context.Background(), start, candidates); err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Preview(
+		context.Background(),
+		start.Add(24*time.Hour),
+		map[string][]string{"thermite": {"sha256:1", "sha256:2"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string][]string{"thermite": {"sha256:1"}}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	marks, err := client.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]Mark{
+		"thermite": {"sha256:1": {FirstMarked: start, LastMarked: start}},
+	}
+	if diff := cmp.Diff(want, marks); diff != "" {
+		t.Fatal(diff)
+	}
+}
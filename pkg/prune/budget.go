@@ -0,0 +1,210 @@
+package prune
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// BudgetRuleName is the name of the rule that keeps images which would have
+// been pruned but were held back to stay within a deletion budget.
+const BudgetRuleName = "budget"
+
+// Actions that a Client takes when the images it would prune exceed a deletion
+// budget.
+const (
+	// BudgetActionAbort fails without deleting any image.
+	BudgetActionAbort = "abort"
+	// BudgetActionOldest deletes only the oldest images, up to the budget.
+	BudgetActionOldest = "oldest"
+)
+
+// ErrDeletionBudgetExceeded is returned when the images that would be pruned
+// exceed a deletion budget and the budget action is BudgetActionAbort.
+var ErrDeletionBudgetExceeded = errors.New("deletion budget exceeded")
+
+// WithMaxDeletions sets the maximum number of images that a Client deletes from
+// a registry in a single PruneAllRepos or PruneRepo call.
+func WithMaxDeletions(n int) Option {
+	return func(gc *Client) {
+		gc.maxDeletions = n
+	}
+}
+
+// WithMaxDeletePercent sets the maximum percentage of the images in the pruned
+// repositories of a registry that a Client deletes in a single PruneAllRepos
+// or PruneRepo call.
+func WithMaxDeletePercent(percent float64) Option {
+	return func(gc *Client) {
+		gc.maxDeletePercent = percent
+	}
+}
+
+// A Budget is a deletion budget shared by the Clients that prune several
+// registries in a run, so that together they delete no more than its maximums.
+// A Budget is safe for concurrent use.
+type Budget struct {
+	maxDeletions     int
+	maxDeletePercent float64
+
+	mu      sync.Mutex
+	images  int
+	deleted int
+}
+
+// NewBudget returns a Budget that allows at most maxDeletions deletions, and at
+// most maxDeletePercent percent of the images in the repositories pruned under
+// it so far, where zero means no maximum.
+func NewBudget(maxDeletions int, maxDeletePercent float64) (*Budget, error) {
+	if err := validateBudget(maxDeletions, maxDeletePercent); err != nil {
+		return nil, err
+	}
+	return &Budget{maxDeletions: maxDeletions, maxDeletePercent: maxDeletePercent}, nil
+}
+
+// WithBudget makes a Client charge the images it prunes in each PruneAllRepos
+// or PruneRepo call to b, which may be shared with Clients for other
+// registries, instead of to a budget of its own. It cannot be combined with
+// WithMaxDeletions or WithMaxDeletePercent.
+func WithBudget(b *Budget) Option {
+	return func(gc *Client) {
+		gc.budget = b
+	}
+}
+
+// WithBudgetAction sets the action, BudgetActionAbort or BudgetActionOldest,
+// that a Client takes when the images it would prune exceed a deletion budget.
+// The default is BudgetActionAbort. With BudgetActionOldest, a Client holds
+// back all but the oldest images, by the time from which their periods are
+// measured, and logs them with the rule BudgetRuleName. Budgets of the Policy
+// of a repository are enforced first.
+func WithBudgetAction(action string) Option {
+	return func(gc *Client) {
+		gc.budgetAction = action
+	}
+}
+
+// validateBudget returns an error if maxDeletions or maxDeletePercent is
+// negative, or maxDeletePercent is more than 100.
+func validateBudget(maxDeletions int, maxDeletePercent float64) error {
+	if maxDeletions < 0 {
+		return fmt.Errorf("max deletions must not be negative")
+	}
+	if maxDeletePercent < 0 || maxDeletePercent > 100 {
+		return fmt.Errorf("max delete percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// budget returns the number of images out of total that may be deleted under
+// maxDeletions and maxDeletePercent, where zero means no limit, or -1 if there
+// is no limit.
+func budget(maxDeletions int, maxDeletePercent float64, total int) int {
+	limit := -1
+	if maxDeletions > 0 {
+		limit = maxDeletions
+	}
+	if maxDeletePercent > 0 {
+		percentLimit := int(math.Floor(maxDeletePercent / 100 * float64(total)))
+		if limit < 0 || percentLimit < limit {
+			limit = percentLimit
+		}
+	}
+	return limit
+}
+
+// applyBudgets enforces the deletion budget of the Policy of each of plans,
+// and then the deletion budget of gc across all of them, before any image is
+// deleted. The images left to prune are charged to the Budget specified by
+// WithBudget, if any, so that later calls sharing it can delete fewer.
+func (gc *Client) applyBudgets(plans []*repoPlan) error {
+	total := 0
+	for _, plan := range plans {
+		limit := budget(plan.policy.MaxDeletions, plan.policy.MaxDeletePercent, len(plan.images))
+		scope := fmt.Sprintf("Elastic Container Registry repository %s", *plan.repo.RepositoryName)
+		if err := gc.enforceBudget([]*repoPlan{plan}, limit, scope); err != nil {
+			return err
+		}
+		total += len(plan.images)
+	}
+	b := gc.budget
+	if b == nil {
+		b = &Budget{maxDeletions: gc.maxDeletions, maxDeletePercent: gc.maxDeletePercent}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	limit := budget(b.maxDeletions, b.maxDeletePercent, b.images+total)
+	if limit >= 0 && b.deleted > 0 {
+		gc.logger.Printf("%d images of the shared deletion budget were pruned from other registries", b.deleted)
+		limit -= b.deleted
+		if limit < 0 {
+			limit = 0
+		}
+	}
+	if err := gc.enforceBudget(plans, limit, "Elastic Container Registry"); err != nil {
+		return err
+	}
+	b.images += total
+	for _, plan := range plans {
+		for _, d := range plan.decisions {
+			if d.prune {
+				b.deleted++
+			}
+		}
+	}
+	return nil
+}
+
+// enforceBudget holds back pruned images of plans beyond limit, oldest first,
+// or returns ErrDeletionBudgetExceeded if the budget action of gc is
+// BudgetActionAbort. The children of a held back index are held back too.
+func (gc *Client) enforceBudget(plans []*repoPlan, limit int, scope string) error {
+	if limit < 0 {
+		return nil
+	}
+	type candidate struct {
+		plan *repoPlan
+		i    int
+	}
+	candidates := []candidate{}
+	for _, plan := range plans {
+		for i, d := range plan.decisions {
+			if d.prune {
+				candidates = append(candidates, candidate{plan: plan, i: i})
+			}
+		}
+	}
+	if len(candidates) <= limit {
+		return nil
+	}
+	gc.statsd.Count("prune.budget_exceeded", 1, nil, 1)
+	if gc.budgetAction == BudgetActionAbort {
+		gc.statsd.Count("prune.budget_held_back", int64(len(candidates)), nil, 1)
+		return fmt.Errorf(
+			"%w: found %d pruneable images in %s, more than its deletion budget of %d",
+			ErrDeletionBudgetExceeded,
+			len(candidates),
+			scope,
+			limit,
+		)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		return a.plan.policy.age(a.plan.decisions[a.i].imageDetail).Before(b.plan.policy.age(b.plan.decisions[b.i].imageDetail))
+	})
+	heldBack := 0
+	for _, c := range candidates[limit:] {
+		heldBack += c.plan.holdBack(c.i, BudgetRuleName)
+	}
+	gc.logger.Printf(
+		"holding back %d of %d pruneable images in %s to stay within its deletion budget of %d",
+		heldBack,
+		len(candidates),
+		scope,
+		limit,
+	)
+	gc.statsd.Count("prune.budget_held_back", int64(heldBack), nil, 1)
+	return nil
+}
@@ -0,0 +1,133 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// A PullThroughCachePolicy applies default retention settings to the
+// repositories created by the pull-through cache rules whose Elastic Container
+// Registry repository prefixes match a pattern. Images in every pull-through
+// cache repository are also excluded by references to them in the upstream
+// registry of its rule, such as docker.io/library/nginx:1.25 for
+// docker-hub/library/nginx:1.25.
+type PullThroughCachePolicy struct {
+	// Prefix is a pattern, as accepted by path.Match, that matches the
+	// repository prefixes of pull-through cache rules, such as docker-hub.
+	Prefix string `json:"prefix"`
+	PolicySettings
+}
+
+// WithIgnorePullThroughCacheRules makes a Client treat no repository as a
+// pull-through cache, for credentials that are not allowed to describe
+// pull-through cache rules. Cache repositories are then pruned by push date,
+// and deployed images are not recognized by their upstream references.
+func WithIgnorePullThroughCacheRules() Option {
+	return func(gc *Client) {
+		gc.ignoreCacheRules = true
+	}
+}
+
+// dockerHubHosts are the names of the Docker Hub registry, which is the
+// registry of image references without one.
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+}
+
+// pullThroughCacheRule returns the pull-through cache rule that created the
+// named repository, or nil if it was not created by one. The rules of the
+// registry of gc are described once and then reused, unless
+// WithIgnorePullThroughCacheRules was specified, in which case no repository is
+// treated as a pull-through cache.
+func (gc *Client) pullThroughCacheRule(ctx context.Context, name string) (*ecr.PullThroughCacheRule, error) {
+	if gc.ignoreCacheRules {
+		return nil, nil
+	}
+	if gc.cacheRules == nil {
+		var span tracer.Span
+		span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.pullThroughCacheRule")
+		defer span.Finish()
+		rules := []*ecr.PullThroughCacheRule{}
+		err := gc.client.DescribePullThroughCacheRulesPagesWithContext(
+			ctx,
+			&ecr.DescribePullThroughCacheRulesInput{
+				MaxResults: gc.maxResults(),
+				RegistryId: gc.registryID(),
+			},
+			func(page *ecr.DescribePullThroughCacheRulesOutput, lastPage bool) bool {
+				rules = append(rules, page.PullThroughCacheRules...)
+				return true
+			},
+		)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error describing pull-through cache rules: %w", err)
+		}
+		gc.logger.Printf("found %d Elastic Container Registry pull-through cache rules", len(rules))
+		gc.cacheRules = rules
+	}
+	for _, rule := range gc.cacheRules {
+		if strings.HasPrefix(name, aws.StringValue(rule.EcrRepositoryPrefix)+"/") {
+			return rule, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseImageRef splits imageRef into the normalized host of its registry, its
+// repository path, and its tag (as ":tag") or digest (as "@digest"). Docker
+// Hub references are normalized to the host docker.io, and official images to
+// the path library/name, so that nginx:1.25 and
+// docker.io/library/nginx:1.25 are the same.
+func parseImageRef(imageRef string) (host, repoPath, suffix string) {
+	host = "docker.io"
+	repoPath = imageRef
+	if parts := strings.SplitN(imageRef, "/", 2); len(parts) == 2 &&
+		(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, repoPath = parts[0], parts[1]
+	}
+	if dockerHubHosts[host] {
+		host = "docker.io"
+	}
+	if i := strings.Index(repoPath, "@"); i >= 0 {
+		repoPath, suffix = repoPath[:i], repoPath[i:]
+	} else if i := strings.LastIndex(repoPath, ":"); i >= 0 {
+		repoPath, suffix = repoPath[:i], repoPath[i:]
+	} else {
+		suffix = ":latest"
+	}
+	if host == "docker.io" && !strings.Contains(repoPath, "/") {
+		repoPath = "library/" + repoPath
+	}
+	return host, repoPath, suffix
+}
+
+// cacheImageRefs returns the references, in the registry hosting the
+// repository with the given URI, to the images cached by rule that imageRefs
+// refer to by their upstream references.
+func cacheImageRefs(rule *ecr.PullThroughCacheRule, uri string, imageRefs []string) []string {
+	upstream, _, _ := parseImageRef(aws.StringValue(rule.UpstreamRegistryUrl) + "/x")
+	registryHost := strings.SplitN(uri, "/", 2)[0]
+	cacheRefs := []string{}
+	for _, imageRef := range imageRefs {
+		host, repoPath, suffix := parseImageRef(imageRef)
+		if host != upstream {
+			continue
+		}
+		cacheRefs = append(cacheRefs, fmt.Sprintf(
+			"%s/%s/%s%s",
+			registryHost,
+			aws.StringValue(rule.EcrRepositoryPrefix),
+			repoPath,
+			suffix,
+		))
+	}
+	return cacheRefs
+}
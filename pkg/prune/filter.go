@@ -0,0 +1,151 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// A RepositoryFilter selects the repositories that PruneAllRepos prunes, so that
+// the repositories of a registry can be divided among several Clients. A
+// repository is selected if its name is included and not excluded, and it has
+// every one of Tags.
+type RepositoryFilter struct {
+	// Include are patterns, as accepted by path.Match, of the names of
+	// included repositories.
+	Include []string `json:"include,omitempty"`
+	// IncludeRegexp is a regular expression matching the names of included
+	// repositories.
+	IncludeRegexp string `json:"includeRegexp,omitempty"`
+	// Prefixes are namespaces, such as team-a, whose repositories are
+	// included. If none of Include, IncludeRegexp, and Prefixes is
+	// specified, every repository is included.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Exclude are patterns, as accepted by path.Match, of the names of
+	// excluded repositories.
+	Exclude []string `json:"exclude,omitempty"`
+	// ExcludeRegexp is a regular expression matching the names of excluded
+	// repositories.
+	ExcludeRegexp string `json:"excludeRegexp,omitempty"`
+	// Tags are resource tags that a repository must have, keyed by tag key.
+	// Each value is a pattern, as accepted by path.Match, that the value of
+	// the tag must match.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	includeRegexp *regexp.Regexp
+	excludeRegexp *regexp.Regexp
+}
+
+// compile validates f and prepares it for matching.
+func (f *RepositoryFilter) compile() error {
+	patterns := append(append([]string{}, f.Include...), f.Exclude...)
+	for _, pattern := range f.Tags {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("error parsing repository filter pattern %s: %w", pattern, err)
+		}
+	}
+	for _, prefix := range f.Prefixes {
+		if strings.Trim(prefix, "/") == "" {
+			return fmt.Errorf("repository filter prefix must not be empty")
+		}
+	}
+	if f.IncludeRegexp != "" {
+		re, err := regexp.Compile(f.IncludeRegexp)
+		if err != nil {
+			return fmt.Errorf("error parsing repository filter include regexp: %w", err)
+		}
+		f.includeRegexp = re
+	}
+	if f.ExcludeRegexp != "" {
+		re, err := regexp.Compile(f.ExcludeRegexp)
+		if err != nil {
+			return fmt.Errorf("error parsing repository filter exclude regexp: %w", err)
+		}
+		f.excludeRegexp = re
+	}
+	return nil
+}
+
+// includesName returns whether f includes the named repository, regardless of
+// its tags.
+func (f *RepositoryFilter) includesName(name string) bool {
+	for _, pattern := range f.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if f.excludeRegexp != nil && f.excludeRegexp.MatchString(name) {
+		return false
+	}
+	if len(f.Include) == 0 && f.includeRegexp == nil && len(f.Prefixes) == 0 {
+		return true
+	}
+	for _, pattern := range f.Include {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	if f.includeRegexp != nil && f.includeRegexp.MatchString(name) {
+		return true
+	}
+	for _, prefix := range f.Prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// includesTags returns whether tags has every one of the Tags of f.
+func (f *RepositoryFilter) includesTags(tags []*ecr.Tag) bool {
+	values := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if tag.Key != nil {
+			values[*tag.Key] = aws.StringValue(tag.Value)
+		}
+	}
+	for key, pattern := range f.Tags {
+		value, ok := values[key]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// includesRepo returns whether every RepositoryFilter of gc includes repo. The
+// tags of repo are only looked up if a filter needs them.
+func (gc *Client) includesRepo(ctx context.Context, repo *ecr.Repository) (bool, error) {
+	needTags := false
+	for _, f := range gc.repoFilters {
+		if !f.includesName(*repo.RepositoryName) {
+			return false, nil
+		}
+		needTags = needTags || len(f.Tags) > 0
+	}
+	if !needTags {
+		return true, nil
+	}
+	tags, err := gc.repoTagsFromARN(ctx, *repo.RepositoryArn)
+	if err != nil {
+		return false, fmt.Errorf("error looking up tags: %w", err)
+	}
+	for _, f := range gc.repoFilters {
+		if !f.includesTags(tags) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
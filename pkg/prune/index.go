@@ -0,0 +1,194 @@
+package prune
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// IndexRuleName is the name of the rule that decides the fate of the child
+// manifests of multi-architecture images, which follow their indexes.
+const IndexRuleName = "index"
+
+// Media types of manifests that refer to other manifests in the same
+// repository.
+const (
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociImageIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+)
+
+// manifestIndex holds the fields of a Docker manifest list or OCI image index
+// that a Client reads.
+type manifestIndex struct {
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// isIndex returns whether imageDetail is a Docker manifest list or OCI image
+// index.
+func isIndex(imageDetail *ecr.ImageDetail) bool {
+	if imageDetail.ImageManifestMediaType == nil {
+		return false
+	}
+	switch *imageDetail.ImageManifestMediaType {
+	case dockerManifestListMediaType, ociImageIndexMediaType:
+		return true
+	}
+	return false
+}
+
+// indexChildren returns the digests of the manifests referred to by each index
+// among images in repo, keyed by the digest of the index.
+func (gc *Client) indexChildren(
+	ctx context.Context,
+	repo *ecr.Repository,
+	images []*ecr.ImageDetail,
+) (map[string][]string, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.indexChildren")
+	defer span.Finish()
+	indexIDs := []*ecr.ImageIdentifier{}
+	for _, imageDetail := range images {
+		if isIndex(imageDetail) && imageDetail.ImageDigest != nil {
+			indexIDs = append(indexIDs, &ecr.ImageIdentifier{ImageDigest: imageDetail.ImageDigest})
+		}
+	}
+	children := make(map[string][]string, len(indexIDs))
+	for len(indexIDs) > 0 {
+		batch := indexIDs
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		indexIDs = indexIDs[len(batch):]
+		bgio, err := gc.client.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			RegistryId: gc.registryID(),
+			AcceptedMediaTypes: aws.StringSlice([]string{
+				dockerManifestListMediaType,
+				ociImageIndexMediaType,
+			}),
+			ImageIds:       batch,
+			RepositoryName: repo.RepositoryName,
+		})
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error getting image manifests: %w", err)
+		}
+		// An index whose children are unknown could protect or orphan
+		// anything, so any failure is fatal.
+		for _, failure := range bgio.Failures {
+			err := fmt.Errorf(
+				"error getting image manifest %s: %s",
+				aws.StringValue(failure.ImageId.ImageDigest),
+				aws.StringValue(failure.FailureReason),
+			)
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		for _, image := range bgio.Images {
+			if image.ImageId == nil || image.ImageId.ImageDigest == nil || image.ImageManifest == nil {
+				err := fmt.Errorf("found unexpected incomplete image in Elastic Container Registry repository %s", *repo.RepositoryUri)
+				span.Finish(tracer.WithError(err))
+				return nil, err
+			}
+			var index manifestIndex
+			if err := json.Unmarshal([]byte(*image.ImageManifest), &index); err != nil {
+				span.Finish(tracer.WithError(err))
+				return nil, fmt.Errorf("error decoding image manifest %s: %w", *image.ImageId.ImageDigest, err)
+			}
+			digests := make([]string, 0, len(index.Manifests))
+			for _, manifest := range index.Manifests {
+				digests = append(digests, manifest.Digest)
+			}
+			children[*image.ImageId.ImageDigest] = digests
+		}
+	}
+	return children, nil
+}
+
+// resolveIndexes revises decisions, which were made for images, so that every
+// manifest referred to by a kept index is kept, and every manifest referred to
+// only by pruned indexes is pruned along with them, unless it was kept on its
+// own account. Manifests referred to by indexes are decided by IndexRuleName.
+// Images without a decision are kept.
+func resolveIndexes(decisions []decision, images []*ecr.ImageDetail, children map[string][]string) []decision {
+	if len(children) == 0 {
+		return decisions
+	}
+	decided := make(map[string]int, len(decisions))
+	for i, d := range decisions {
+		if d.imageDetail.ImageDigest != nil {
+			decided[*d.imageDetail.ImageDigest] = i
+		}
+	}
+	referenced := make(map[string]bool)
+	for _, digests := range children {
+		for _, digest := range digests {
+			referenced[digest] = true
+		}
+	}
+	kept := func(digest string) bool {
+		i, ok := decided[digest]
+		return (ok && !decisions[i].prune) || (!ok && !referenced[digest])
+	}
+	// Protect everything reachable from an index kept on its own account.
+	protected := make(map[string]bool)
+	var protect func(digest string)
+	protect = func(digest string) {
+		for _, child := range children[digest] {
+			if !protected[child] {
+				protected[child] = true
+				protect(child)
+			}
+		}
+	}
+	for digest := range children {
+		if kept(digest) {
+			protect(digest)
+		}
+	}
+	// Orphan everything reachable from a pruned index that is neither
+	// protected nor kept on its own account.
+	orphaned := make(map[string]bool)
+	var orphan func(digest string)
+	orphan = func(digest string) {
+		for _, child := range children[digest] {
+			if protected[child] || orphaned[child] {
+				continue
+			}
+			if i, ok := decided[child]; ok && !decisions[i].prune {
+				continue
+			}
+			orphaned[child] = true
+			orphan(child)
+		}
+	}
+	for digest := range children {
+		if i, ok := decided[digest]; ok && decisions[i].prune && !protected[digest] {
+			orphan(digest)
+		}
+	}
+	resolved := make([]decision, 0, len(decisions))
+	for _, d := range decisions {
+		if d.imageDetail.ImageDigest != nil && protected[*d.imageDetail.ImageDigest] && d.prune {
+			d.prune = false
+			d.rule = IndexRuleName
+		}
+		resolved = append(resolved, d)
+	}
+	for _, imageDetail := range images {
+		if imageDetail.ImageDigest == nil || !orphaned[*imageDetail.ImageDigest] {
+			continue
+		}
+		if i, ok := decided[*imageDetail.ImageDigest]; ok {
+			resolved[i].rule = IndexRuleName
+			continue
+		}
+		resolved = append(resolved, decision{imageDetail: imageDetail, prune: true, rule: IndexRuleName})
+	}
+	return resolved
+}
@@ -0,0 +1,199 @@
+package prune
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/dollarshaveclub/thermite/pkg/journal"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// ErrNotJournaled is returned by Restore when no journaled image matches the
+// given tag or digest.
+var ErrNotJournaled = errors.New("no deleted image found in journal")
+
+// WithJournal makes a Client record the manifest, tags, and push time of each
+// image in j before deleting it from a repository, and fail without deleting
+// anything if it cannot. Images deleted from replicas are not journaled.
+func WithJournal(j *journal.Client) Option {
+	return func(gc *Client) {
+		gc.journal = j
+	}
+}
+
+// journalImages records each of images in repo in the journal of gc as deleted
+// at until. Quarantined images are recorded with their original tags, so that
+// Restore puts them back as they were before they were quarantined.
+func (gc *Client) journalImages(ctx context.Context, repo *ecr.Repository, images []*ecr.ImageDetail, until time.Time) error {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.journalImages")
+	defer span.Finish()
+	if len(images) == 0 {
+		return nil
+	}
+	manifests, err := gc.getManifests(ctx, repo, images)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return err
+	}
+	entries := make([]journal.Entry, 0, len(images))
+	for _, imageDetail := range images {
+		image := manifests[aws.StringValue(imageDetail.ImageDigest)]
+		entries = append(entries, journal.Entry{
+			Repository: *repo.RepositoryUri,
+			Digest:     aws.StringValue(imageDetail.ImageDigest),
+			Tags:       originalTags(imageDetail),
+			Manifest:   aws.StringValue(image.ImageManifest),
+			MediaType:  aws.StringValue(image.ImageManifestMediaType),
+			PushedAt:   aws.TimeValue(imageDetail.ImagePushedAt).UTC(),
+		})
+	}
+	if err := gc.journal.Record(ctx, until, entries...); err != nil {
+		span.Finish(tracer.WithError(err))
+		return err
+	}
+	return nil
+}
+
+// Restore puts the manifest of the image most recently deleted from the named
+// repository that had the given tag or digest back into the repository, with
+// every tag it had, from the journal specified by WithJournal. The children of
+// an index that the repository no longer has are restored untagged first, from
+// the journal too. Restore fails without changing anything if any tag of the
+// image now refers to another image, and returns ErrNotJournaled if no
+// journaled image matches. Putting a manifest fails once Elastic Container
+// Registry has removed the layers of the image. Restore returns references to
+// the restored image by its tags, or by digest if it had none.
+func (gc *Client) Restore(ctx context.Context, name, tagOrDigest string) (restored []string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.Restore")
+	defer span.Finish()
+	restored = []string{}
+	if gc.journal == nil {
+		err := fmt.Errorf("a journal is required to restore images")
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	repo, err := gc.repoFromName(ctx, name)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, fmt.Errorf("error looking up repository: %w", err)
+	}
+	entries, err := gc.journal.Load(ctx, *repo.RepositoryUri)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	// The most recent entry for each digest, and the most recently deleted
+	// image matching tagOrDigest, win.
+	byDigest := map[string]journal.Entry{}
+	var match *journal.Entry
+	for i, entry := range entries {
+		if latest, ok := byDigest[entry.Digest]; !ok || !entry.DeletedAt.Before(latest.DeletedAt) {
+			byDigest[entry.Digest] = entry
+		}
+		matches := entry.Digest == tagOrDigest
+		for _, tag := range entry.Tags {
+			matches = matches || tag == tagOrDigest
+		}
+		if matches && (match == nil || !entry.DeletedAt.Before(match.DeletedAt)) {
+			match = &entries[i]
+		}
+	}
+	if match == nil {
+		err := fmt.Errorf("%w for %s in repository %s", ErrNotJournaled, tagOrDigest, name)
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	images, err := gc.describeImages(ctx, repo)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	present := make(map[string]bool, len(images))
+	for _, imageDetail := range images {
+		present[aws.StringValue(imageDetail.ImageDigest)] = true
+		for _, imageTag := range imageDetail.ImageTags {
+			if aws.StringValue(imageDetail.ImageDigest) == match.Digest {
+				continue
+			}
+			for _, tag := range match.Tags {
+				if *imageTag == tag {
+					err := fmt.Errorf("tag %s of repository %s already refers to image %s", tag, name, aws.StringValue(imageDetail.ImageDigest))
+					span.Finish(tracer.WithError(err))
+					return restored, err
+				}
+			}
+		}
+	}
+	children := []journal.Entry{}
+	if match.MediaType == dockerManifestListMediaType || match.MediaType == ociImageIndexMediaType {
+		var index manifestIndex
+		if err := json.Unmarshal([]byte(match.Manifest), &index); err != nil {
+			span.Finish(tracer.WithError(err))
+			return restored, fmt.Errorf("error decoding image index %s: %w", match.Digest, err)
+		}
+		for _, child := range index.Manifests {
+			if present[child.Digest] {
+				continue
+			}
+			entry, ok := byDigest[child.Digest]
+			if !ok {
+				err := fmt.Errorf("%w for child %s of image index %s", ErrNotJournaled, child.Digest, match.Digest)
+				span.Finish(tracer.WithError(err))
+				return restored, err
+			}
+			children = append(children, entry)
+		}
+	}
+	for _, entry := range children {
+		if err := gc.restoreEntry(ctx, repo, entry, nil); err != nil {
+			span.Finish(tracer.WithError(err))
+			return restored, err
+		}
+	}
+	if len(match.Tags) == 0 {
+		if err := gc.restoreEntry(ctx, repo, *match, nil); err != nil {
+			span.Finish(tracer.WithError(err))
+			return restored, err
+		}
+		restored = append(restored, fmt.Sprintf("%s@%s", *repo.RepositoryUri, match.Digest))
+	}
+	for _, tag := range match.Tags {
+		if err := gc.restoreEntry(ctx, repo, *match, aws.String(tag)); err != nil {
+			span.Finish(tracer.WithError(err))
+			return restored, err
+		}
+		restored = append(restored, fmt.Sprintf("%s:%s", *repo.RepositoryUri, tag))
+	}
+	gc.logger.Printf(
+		"restored %s deleted at %s, with %d per-platform images",
+		strings.Join(restored, ", "),
+		match.DeletedAt.Format(time.RFC3339),
+		len(children),
+	)
+	gc.statsd.Count("prune.restored", 1, nil, 1)
+	return restored, nil
+}
+
+// restoreEntry puts the manifest of entry into repo with tag, or untagged if
+// tag is nil.
+func (gc *Client) restoreEntry(ctx context.Context, repo *ecr.Repository, entry journal.Entry, tag *string) error {
+	var mediaType *string
+	if entry.MediaType != "" {
+		mediaType = aws.String(entry.MediaType)
+	}
+	err := gc.putManifest(ctx, repo, aws.String(entry.Digest), aws.String(entry.Manifest), mediaType, tag)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ecr.ErrCodeLayersNotFoundException {
+		return fmt.Errorf("layers of image %s have been removed from the registry: %w", entry.Digest, err)
+	}
+	return err
+}
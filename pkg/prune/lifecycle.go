@@ -0,0 +1,505 @@
+package prune
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Values of the fields of a LifecycleRule.
+const (
+	LifecycleTagStatusTagged   = "tagged"
+	LifecycleTagStatusUntagged = "untagged"
+	LifecycleTagStatusAny      = "any"
+
+	LifecycleCountTypeImageCountMoreThan = "imageCountMoreThan"
+	LifecycleCountTypeSinceImagePushed   = "sinceImagePushed"
+
+	LifecycleCountUnitDays = "days"
+
+	LifecycleActionTypeExpire = "expire"
+)
+
+// lifecyclePatternWildcards is the number of wildcards that Elastic Container
+// Registry allows in each tag pattern of a lifecycle policy.
+const lifecyclePatternWildcards = 4
+
+// A LifecyclePolicy is an Elastic Container Registry lifecycle policy, which
+// expires images without running Thermite.
+type LifecyclePolicy struct {
+	Rules []LifecycleRule `json:"rules"`
+}
+
+// A LifecycleRule expires the images it selects. Rules are evaluated in order of
+// RulePriority, and an image selected by one rule is never expired by a rule
+// with a higher RulePriority.
+type LifecycleRule struct {
+	RulePriority int                `json:"rulePriority"`
+	Description  string             `json:"description,omitempty"`
+	Selection    LifecycleSelection `json:"selection"`
+	Action       LifecycleAction    `json:"action"`
+}
+
+// A LifecycleSelection selects images by their tags, and either keeps the
+// CountNumber most recently pushed of them or those pushed within CountNumber
+// days.
+type LifecycleSelection struct {
+	TagStatus      string   `json:"tagStatus"`
+	TagPrefixList  []string `json:"tagPrefixList,omitempty"`
+	TagPatternList []string `json:"tagPatternList,omitempty"`
+	CountType      string   `json:"countType"`
+	CountUnit      string   `json:"countUnit,omitempty"`
+	CountNumber    int      `json:"countNumber"`
+}
+
+// A LifecycleAction is what a LifecycleRule does to the images it selects.
+type LifecycleAction struct {
+	Type string `json:"type"`
+}
+
+// LifecyclePolicy returns the LifecyclePolicy that prunes the same images as p,
+// if p can be expressed as one. Lifecycle policies cannot match tags by regular
+// expression or semantic version, keep images forever or by when they were
+// pulled, combine a period with a keep count, or consider scan findings, and
+// they never see which images are deployed.
+func (p Policy) LifecyclePolicy() (LifecyclePolicy, error) {
+	if p.PullWindow > 0 {
+		return LifecyclePolicy{}, fmt.Errorf("lifecycle policies cannot keep recently pulled images")
+	}
+	if len(p.SeverityPeriods) > 0 {
+		return LifecyclePolicy{}, fmt.Errorf("lifecycle policies cannot prune images by their scan findings")
+	}
+	if len(p.ProtectTags) > 0 {
+		return LifecyclePolicy{}, fmt.Errorf("lifecycle policies cannot protect tags forever")
+	}
+	if p.FromLastPull {
+		return LifecyclePolicy{}, fmt.Errorf("lifecycle policies cannot measure periods from when images were last pulled")
+	}
+	lp := LifecyclePolicy{Rules: []LifecycleRule{}}
+	add := func(description string, selection LifecycleSelection) {
+		lp.Rules = append(lp.Rules, LifecycleRule{
+			RulePriority: len(lp.Rules) + 1,
+			Description:  description,
+			Selection:    selection,
+			Action:       LifecycleAction{Type: LifecycleActionTypeExpire},
+		})
+	}
+	if p.UntaggedPeriod > 0 {
+		add(UntaggedRuleName, LifecycleSelection{
+			TagStatus:   LifecycleTagStatusUntagged,
+			CountType:   LifecycleCountTypeSinceImagePushed,
+			CountUnit:   LifecycleCountUnitDays,
+			CountNumber: p.UntaggedPeriod,
+		})
+	}
+	for _, rule := range p.Rules {
+		if rule.Glob == "" {
+			return LifecyclePolicy{}, fmt.Errorf("rule %s cannot be expressed as a lifecycle rule, which only matches tags by wildcard", rule.Name)
+		}
+		if strings.ContainsAny(rule.Glob, `?[\`) || strings.Count(rule.Glob, "*") > lifecyclePatternWildcards {
+			return LifecyclePolicy{}, fmt.Errorf(
+				"glob of rule %s cannot be expressed as a lifecycle tag pattern, which allows up to %d * wildcards",
+				rule.Name,
+				lifecyclePatternWildcards,
+			)
+		}
+		selection, err := lifecycleSelection(rule.Name, rule.Period, rule.KeepCount, rule.Never)
+		if err != nil {
+			return LifecyclePolicy{}, err
+		}
+		selection.TagPatternList = []string{rule.Glob}
+		add(rule.Name, selection)
+	}
+	// Tags that match no rule are never pruned without a prune period, as
+	// they are never expired without a lifecycle rule.
+	if !p.Period.IsZero() {
+		period, ok := p.Period.WholeDays()
+		if !ok {
+			return LifecyclePolicy{}, fmt.Errorf("prune period %s cannot be expressed as a lifecycle rule, which counts whole days", p.Period)
+		}
+		selection, err := lifecycleSelection(DefaultRuleName, period, p.KeepCount, false)
+		if err != nil {
+			return LifecyclePolicy{}, err
+		}
+		selection.TagPatternList = []string{"*"}
+		add(DefaultRuleName, selection)
+	}
+	if len(lp.Rules) == 0 {
+		return LifecyclePolicy{}, fmt.Errorf("policy prunes no images")
+	}
+	return lp, nil
+}
+
+// lifecycleSelection returns the selection of tagged images by the count that
+// the named rule keeps, which is either a period or a keep count.
+func lifecycleSelection(name string, period, keepCount int, never bool) (LifecycleSelection, error) {
+	switch {
+	case never:
+		return LifecycleSelection{}, fmt.Errorf("rule %s cannot be expressed as a lifecycle rule, which cannot keep images forever", name)
+	case period > 0 && keepCount > 0:
+		return LifecycleSelection{}, fmt.Errorf("rule %s cannot be expressed as a lifecycle rule, which cannot combine a period with a keep count", name)
+	case period > 0:
+		return LifecycleSelection{
+			TagStatus:   LifecycleTagStatusTagged,
+			CountType:   LifecycleCountTypeSinceImagePushed,
+			CountUnit:   LifecycleCountUnitDays,
+			CountNumber: period,
+		}, nil
+	}
+	return LifecycleSelection{
+		TagStatus:   LifecycleTagStatusTagged,
+		CountType:   LifecycleCountTypeImageCountMoreThan,
+		CountNumber: keepCount,
+	}, nil
+}
+
+// Settings returns the PolicySettings that prune the same images as lp, if lp
+// can be expressed in them. Each tagged rule of lp becomes a Rule, named for its
+// priority, that matches its single tag prefix or pattern. The keep counts of
+// untagged images, and rules that select images by several prefixes or
+// patterns, cannot be expressed.
+func (lp LifecyclePolicy) Settings() (PolicySettings, error) {
+	rules := make([]LifecycleRule, len(lp.Rules))
+	copy(rules, lp.Rules)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].RulePriority < rules[j].RulePriority
+	})
+	settings := PolicySettings{Rules: []Rule{}}
+	for _, lr := range rules {
+		name := fmt.Sprintf("lifecycle-%d", lr.RulePriority)
+		if lr.Action.Type != LifecycleActionTypeExpire {
+			return PolicySettings{}, fmt.Errorf("lifecycle rule %d has unknown action %s", lr.RulePriority, lr.Action.Type)
+		}
+		s := lr.Selection
+		rule := Rule{Name: name}
+		switch s.CountType {
+		case LifecycleCountTypeSinceImagePushed:
+			if s.CountUnit != LifecycleCountUnitDays {
+				return PolicySettings{}, fmt.Errorf("lifecycle rule %d has unknown count unit %s", lr.RulePriority, s.CountUnit)
+			}
+			rule.Period = s.CountNumber
+		case LifecycleCountTypeImageCountMoreThan:
+			rule.KeepCount = s.CountNumber
+		default:
+			return PolicySettings{}, fmt.Errorf("lifecycle rule %d has unknown count type %s", lr.RulePriority, s.CountType)
+		}
+		if s.CountNumber <= 0 {
+			return PolicySettings{}, fmt.Errorf("lifecycle rule %d must have a positive count", lr.RulePriority)
+		}
+		untagged := s.TagStatus == LifecycleTagStatusUntagged || s.TagStatus == LifecycleTagStatusAny
+		if untagged && settings.UntaggedPeriod == nil {
+			if rule.Period == 0 {
+				return PolicySettings{}, fmt.Errorf("lifecycle rule %d cannot be expressed in Thermite, which cannot keep a number of untagged images", lr.RulePriority)
+			}
+			settings.UntaggedPeriod = aws.Int(rule.Period)
+		}
+		switch s.TagStatus {
+		case LifecycleTagStatusUntagged:
+			continue
+		case LifecycleTagStatusAny:
+			rule.Glob = "*"
+		case LifecycleTagStatusTagged:
+			switch {
+			case len(s.TagPrefixList)+len(s.TagPatternList) != 1:
+				return PolicySettings{}, fmt.Errorf("lifecycle rule %d cannot be expressed in Thermite, which matches each tag by one pattern", lr.RulePriority)
+			case len(s.TagPrefixList) == 1:
+				rule.Glob = s.TagPrefixList[0] + "*"
+			default:
+				rule.Glob = s.TagPatternList[0]
+			}
+		default:
+			return PolicySettings{}, fmt.Errorf("lifecycle rule %d has unknown tag status %s", lr.RulePriority, s.TagStatus)
+		}
+		settings.Rules = append(settings.Rules, rule)
+	}
+	if err := settings.validate(); err != nil {
+		return PolicySettings{}, fmt.Errorf("error in rules imported from lifecycle policy: %w", err)
+	}
+	return settings, nil
+}
+
+// RepositoryLifecyclePolicy returns the lifecycle policy of the named
+// repository. ok is false if it has none.
+func (gc *Client) RepositoryLifecyclePolicy(ctx context.Context, name string) (lp LifecyclePolicy, ok bool, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.RepositoryLifecyclePolicy")
+	defer span.Finish()
+	glpo, err := gc.client.GetLifecyclePolicyWithContext(ctx, &ecr.GetLifecyclePolicyInput{
+		RegistryId:     gc.registryID(),
+		RepositoryName: aws.String(name),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ecr.ErrCodeLifecyclePolicyNotFoundException {
+		return LifecyclePolicy{}, false, nil
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return LifecyclePolicy{}, false, fmt.Errorf("error getting lifecycle policy of repository %s: %w", name, err)
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(glpo.LifecyclePolicyText)), &lp); err != nil {
+		span.Finish(tracer.WithError(err))
+		return LifecyclePolicy{}, false, fmt.Errorf("error decoding lifecycle policy of repository %s: %w", name, err)
+	}
+	return lp, true, nil
+}
+
+// A LifecycleDifference is an image that a LifecyclePolicy and a Policy treat
+// differently.
+type LifecycleDifference struct {
+	// ImageRefs are the references to the image.
+	ImageRefs []string
+	// PushedAt is when the image was pushed.
+	PushedAt time.Time
+	// Expired is whether the LifecyclePolicy expires the image, and
+	// RulePriority the priority of the LifecycleRule that does.
+	Expired      bool
+	RulePriority int
+	// Pruned is whether the Policy prunes the image, and Rule the name of the
+	// rule that decided.
+	Pruned bool
+	Rule   string
+}
+
+// CompareLifecyclePolicy previews lp on the named repository, and returns the
+// images in it that lp would expire but policy would keep, or the reverse, as
+// of until. Since a lifecycle policy cannot see which images are deployed,
+// policy is applied as if none were. A preview takes a while to complete, and
+// only one may run on a repository at a time.
+func (gc *Client) CompareLifecyclePolicy(
+	ctx context.Context,
+	name string,
+	lp LifecyclePolicy,
+	policy Policy,
+	until time.Time,
+) ([]LifecycleDifference, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.CompareLifecyclePolicy")
+	defer span.Finish()
+	repo, err := gc.repoFromName(ctx, name)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error looking up repository: %w", err)
+	}
+	text, err := json.Marshal(lp)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error encoding lifecycle policy: %w", err)
+	}
+	expired, err := gc.previewLifecyclePolicy(ctx, repo, aws.String(string(text)))
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	images, err := gc.describeImages(ctx, repo)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	children, err := gc.indexChildren(ctx, repo, images)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error inspecting image indexes: %w", err)
+	}
+	decisions := resolveIndexes(policy.decide(*repo.RepositoryUri, images, until, newWhitelist()), images, children)
+	decided := make(map[*ecr.ImageDetail]decision, len(decisions))
+	for _, d := range decisions {
+		decided[d.imageDetail] = d
+	}
+	differences := []LifecycleDifference{}
+	for _, imageDetail := range images {
+		// Images without a decision are kept, as by resolveIndexes.
+		d, ok := decided[imageDetail]
+		if !ok {
+			d = decision{imageDetail: imageDetail, rule: UntaggedRuleName}
+		}
+		result, isExpired := expired[aws.StringValue(imageDetail.ImageDigest)]
+		if isExpired == d.prune {
+			continue
+		}
+		difference := LifecycleDifference{
+			ImageRefs: imageRefsFromImageDetail(*repo.RepositoryUri, imageDetail),
+			PushedAt:  imageDetail.ImagePushedAt.UTC(),
+			Expired:   isExpired,
+			Pruned:    d.prune,
+			Rule:      d.rule,
+		}
+		if isExpired {
+			difference.RulePriority = int(aws.Int64Value(result.AppliedRulePriority))
+		}
+		differences = append(differences, difference)
+	}
+	return differences, nil
+}
+
+// previewLifecyclePolicy previews the lifecycle policy with the given text on
+// repo, or the lifecycle policy of repo if text is nil, waits for the preview to
+// complete, and returns the images that it would expire, keyed by digest.
+func (gc *Client) previewLifecyclePolicy(
+	ctx context.Context,
+	repo *ecr.Repository,
+	text *string,
+) (map[string]*ecr.LifecyclePolicyPreviewResult, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.previewLifecyclePolicy")
+	defer span.Finish()
+	if _, err := gc.client.StartLifecyclePolicyPreviewWithContext(ctx, &ecr.StartLifecyclePolicyPreviewInput{
+		RegistryId:          gc.registryID(),
+		LifecyclePolicyText: text,
+		RepositoryName:      repo.RepositoryName,
+	}); err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error starting lifecycle policy preview of repository %s: %w", *repo.RepositoryName, err)
+	}
+	for {
+		status := ""
+		expired := make(map[string]*ecr.LifecyclePolicyPreviewResult)
+		if err := gc.client.GetLifecyclePolicyPreviewPagesWithContext(
+			ctx,
+			&ecr.GetLifecyclePolicyPreviewInput{
+				RegistryId:     gc.registryID(),
+				RepositoryName: repo.RepositoryName,
+			},
+			func(page *ecr.GetLifecyclePolicyPreviewOutput, lastPage bool) bool {
+				status = aws.StringValue(page.Status)
+				if status != ecr.LifecyclePolicyPreviewStatusComplete {
+					return false
+				}
+				for _, result := range page.PreviewResults {
+					if result.Action != nil && aws.StringValue(result.Action.Type) == ecr.ImageActionTypeExpire {
+						expired[aws.StringValue(result.ImageDigest)] = result
+					}
+				}
+				return true
+			},
+		); err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error getting lifecycle policy preview of repository %s: %w", *repo.RepositoryName, err)
+		}
+		switch status {
+		case ecr.LifecyclePolicyPreviewStatusComplete:
+			return expired, nil
+		case ecr.LifecyclePolicyPreviewStatusInProgress:
+		default:
+			err := fmt.Errorf("lifecycle policy preview of repository %s is %s", *repo.RepositoryName, status)
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			span.Finish(tracer.WithError(ctx.Err()))
+			return nil, ctx.Err()
+		case <-time.After(gc.previewPollInterval):
+		}
+	}
+}
+
+// A LifecycleViolation is a deployed image that the lifecycle policy of its
+// repository would expire.
+type LifecycleViolation struct {
+	// Repository is the name of the repository.
+	Repository string
+	// ImageRefs are the references to the image.
+	ImageRefs []string
+	// PushedAt is when the image was pushed.
+	PushedAt time.Time
+	// RulePriority is the priority of the LifecycleRule that would expire
+	// the image.
+	RulePriority int
+}
+
+// AuditLifecyclePolicies previews the lifecycle policy of every repository in
+// the Elastic Container Registry associated with gc that has one and is
+// selected by the filters specified by WithRepositoryFilter, and returns
+// the images with a reference in deployed that it would expire. The manifests
+// referred to by a deployed multi-architecture image index count as deployed.
+func (gc *Client) AuditLifecyclePolicies(ctx context.Context, deployed ...string) ([]LifecycleViolation, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.AuditLifecyclePolicies")
+	defer span.Finish()
+	repos, err := gc.describeRepositories(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	wl := newWhitelist(deployed...)
+	violations := []LifecycleViolation{}
+	for _, repo := range repos {
+		included, err := gc.includesRepo(ctx, repo)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error filtering repository %s: %w", *repo.RepositoryUri, err)
+		}
+		if !included {
+			continue
+		}
+		_, ok, err := gc.RepositoryLifecyclePolicy(ctx, *repo.RepositoryName)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		expired, err := gc.previewLifecyclePolicy(ctx, repo, nil)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		gc.logger.Printf(
+			"lifecycle policy of Elastic Container Registry repository %s would expire %d images",
+			*repo.RepositoryName,
+			len(expired),
+		)
+		if len(expired) == 0 {
+			continue
+		}
+		images, err := gc.describeImages(ctx, repo)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, err
+		}
+		children, err := gc.indexChildren(ctx, repo, images)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error inspecting image indexes: %w", err)
+		}
+		inUse := make(map[string]bool)
+		var use func(digest string)
+		use = func(digest string) {
+			if inUse[digest] {
+				return
+			}
+			inUse[digest] = true
+			for _, child := range children[digest] {
+				use(child)
+			}
+		}
+		for _, imageDetail := range images {
+			if imageDetail.ImageDigest != nil && wl.ExcludesImage(*repo.RepositoryUri, imageDetail) {
+				use(*imageDetail.ImageDigest)
+			}
+		}
+		for _, imageDetail := range images {
+			result, ok := expired[aws.StringValue(imageDetail.ImageDigest)]
+			if !ok || !inUse[*imageDetail.ImageDigest] {
+				continue
+			}
+			violations = append(violations, LifecycleViolation{
+				Repository:   *repo.RepositoryName,
+				ImageRefs:    imageRefsFromImageDetail(*repo.RepositoryUri, imageDetail),
+				PushedAt:     imageDetail.ImagePushedAt.UTC(),
+				RulePriority: int(aws.Int64Value(result.AppliedRulePriority)),
+			})
+		}
+	}
+	return violations, nil
+}
@@ -0,0 +1,121 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// MarkedRuleName is the name of the rule that keeps images which would have
+// been pruned but were only marked for deletion, because no earlier run marked
+// them long enough ago.
+const MarkedRuleName = "marked"
+
+// A Ledger persists the images that a Client marks as candidates for deletion,
+// such as *ledger.Client.
+type Ledger interface {
+	// Sweep marks the image digests of each repository URI in candidates at
+	// markedAt, forgets the other marks in those repositories, and returns the
+	// digests of the candidates that may be deleted now.
+	Sweep(ctx context.Context, markedAt time.Time, candidates map[string][]string) (sweepable map[string][]string, err error)
+	// Preview returns the digests that Sweep would return, without marking
+	// anything.
+	Preview(ctx context.Context, markedAt time.Time, candidates map[string][]string) (sweepable map[string][]string, err error)
+}
+
+// WithLedger makes a Client mark the images that it would prune in l, and
+// delete only those that l returns as sweepable because an earlier run marked
+// them too. An image that a run finds no longer pruneable loses its mark, so a
+// single incomplete survey cannot cause a deletion on its own. Unless
+// WithRemoveImages is also specified, a Client only previews the sweep, so that
+// dry runs leave l unchanged.
+func WithLedger(l Ledger) Option {
+	return func(gc *Client) {
+		gc.ledger = l
+	}
+}
+
+// sweep marks the pruned images of plans in the ledger of gc, if it has one,
+// as of until, and holds back those that it does not return as sweepable,
+// along with the children of held back indexes. Dry runs only preview the
+// sweep.
+func (gc *Client) sweep(ctx context.Context, until time.Time, plans []*repoPlan) error {
+	if gc.ledger == nil {
+		return nil
+	}
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.sweep")
+	defer span.Finish()
+	candidates := make(map[string][]string, len(plans))
+	for _, plan := range plans {
+		digests := []string{}
+		for _, d := range plan.decisions {
+			if d.prune {
+				digests = append(digests, aws.StringValue(d.imageDetail.ImageDigest))
+			}
+		}
+		candidates[*plan.repo.RepositoryUri] = digests
+	}
+	sweepLedger := gc.ledger.Sweep
+	if !gc.removeImages {
+		sweepLedger = gc.ledger.Preview
+	}
+	sweepable, err := sweepLedger(ctx, until, candidates)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error sweeping deletion ledger: %w", err)
+	}
+	heldBack := 0
+	for _, plan := range plans {
+		swept := make(map[string]bool, len(sweepable[*plan.repo.RepositoryUri]))
+		for _, digest := range sweepable[*plan.repo.RepositoryUri] {
+			swept[digest] = true
+		}
+		for i, d := range plan.decisions {
+			if d.prune && !swept[aws.StringValue(d.imageDetail.ImageDigest)] {
+				heldBack += plan.holdBack(i, MarkedRuleName)
+			}
+		}
+	}
+	gc.logger.Printf("holding back %d pruneable images marked for deletion by a later run", heldBack)
+	gc.statsd.Count("prune.marked_held_back", int64(heldBack), nil, 1)
+	return nil
+}
+
+// holdBack keeps the image of the ith decision of plan, and the children of
+// that image if it is an index, under rule, and returns the number of images
+// that it kept which would otherwise have been pruned.
+func (plan *repoPlan) holdBack(i int, rule string) int {
+	heldBack := 0
+	if d := &plan.decisions[i]; d.prune {
+		d.prune, d.rule = false, rule
+		heldBack++
+	}
+	return heldBack + plan.holdBackChildren(aws.StringValue(plan.decisions[i].imageDetail.ImageDigest), rule)
+}
+
+// holdBackChildren keeps the children of the index with the given digest in
+// plan under rule, and returns the number of them that it kept which would
+// otherwise have been pruned.
+func (plan *repoPlan) holdBackChildren(digest string, rule string) int {
+	children := plan.children[digest]
+	if len(children) == 0 {
+		return 0
+	}
+	isChild := make(map[string]bool, len(children))
+	for _, child := range children {
+		isChild[child] = true
+	}
+	heldBack := 0
+	for j := range plan.decisions {
+		d := &plan.decisions[j]
+		if d.prune && isChild[aws.StringValue(d.imageDetail.ImageDigest)] {
+			d.prune, d.rule = false, rule
+			heldBack++
+		}
+	}
+	return heldBack
+}
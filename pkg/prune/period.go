@@ -0,0 +1,135 @@
+package prune
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Period is a span of calendar months and days, and a duration, that must
+// pass after an image is pushed before it may be pruned. Months and days are
+// counted on the calendar in UTC, so a month may have from 28 to 31 days.
+type Period struct {
+	Months   int
+	Days     int
+	Duration time.Duration
+}
+
+// ParsePeriod parses a Period from an unsigned integer number of days, such as
+// "30", or from a sequence of numbers with units, such as "36h", "2w", "3mo",
+// or "1mo2w". Units are "mo" (calendar months), "w" (weeks), "d" (days), and
+// those accepted by time.ParseDuration.
+func ParsePeriod(s string) (Period, error) {
+	if s == "" {
+		return Period{}, fmt.Errorf("period must not be empty")
+	}
+	if days, err := strconv.ParseUint(s, 10, 0); err == nil {
+		return Period{Days: int(days)}, nil
+	}
+	var p Period
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		j := i
+		for j < len(rest) && (rest[j] < '0' || rest[j] > '9') {
+			j++
+		}
+		number, unit := rest[:i], rest[i:j]
+		rest = rest[j:]
+		if number == "" || unit == "" {
+			return Period{}, fmt.Errorf("period %q must be a number of days or a sequence of numbers with units", s)
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return Period{}, fmt.Errorf("error parsing period %q: %w", s, err)
+		}
+		switch unit {
+		case "mo":
+			p.Months += n
+		case "w":
+			p.Days += 7 * n
+		case "d":
+			p.Days += n
+		default:
+			d, err := time.ParseDuration(number + unit)
+			if err != nil {
+				return Period{}, fmt.Errorf("error parsing period %q: %w", s, err)
+			}
+			p.Duration += d
+		}
+	}
+	return p, nil
+}
+
+// IsZero returns whether p is empty.
+func (p Period) IsZero() bool {
+	return p.Months == 0 && p.Days == 0 && p.Duration == 0
+}
+
+// before returns the time p before t.
+func (p Period) before(t time.Time) time.Time {
+	return t.UTC().AddDate(0, -p.Months, -p.Days).Add(-p.Duration)
+}
+
+// WholeDays returns the number of days in p, if it is a whole number of days.
+func (p Period) WholeDays() (days int, ok bool) {
+	if p.Months != 0 || p.Duration%(24*time.Hour) != 0 {
+		return 0, false
+	}
+	return p.Days + int(p.Duration/(24*time.Hour)), true
+}
+
+// String returns p in the syntax accepted by ParsePeriod.
+func (p Period) String() string {
+	if p.Months == 0 && p.Duration == 0 {
+		return strconv.Itoa(p.Days) + "d"
+	}
+	var b strings.Builder
+	if p.Months != 0 {
+		fmt.Fprintf(&b, "%dmo", p.Months)
+	}
+	if p.Days != 0 {
+		fmt.Fprintf(&b, "%dd", p.Days)
+	}
+	if p.Duration != 0 {
+		b.WriteString(p.Duration.String())
+	}
+	return b.String()
+}
+
+// MarshalJSON encodes p as a number of days if it is one, and otherwise as a
+// string accepted by ParsePeriod.
+func (p Period) MarshalJSON() ([]byte, error) {
+	if p.Months == 0 && p.Duration == 0 {
+		return json.Marshal(p.Days)
+	}
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON decodes p from a number of days or a string accepted by
+// ParsePeriod.
+func (p *Period) UnmarshalJSON(data []byte) error {
+	var days int
+	if err := json.Unmarshal(data, &days); err == nil {
+		if days < 0 {
+			return fmt.Errorf("period must not be negative")
+		}
+		*p = Period{Days: days}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("period must be a number of days or a string")
+	}
+	parsed, err := ParsePeriod(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
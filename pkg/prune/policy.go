@@ -0,0 +1,449 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// DefaultRuleName is the name of the rule that decides the fate of images none
+// of whose tags match a Rule of a Policy.
+const DefaultRuleName = "default"
+
+// DeployedRuleName is the name of the rule that keeps images which are
+// excluded from pruning because they are deployed.
+const DeployedRuleName = "deployed"
+
+// UntaggedRuleName is the name of the rule that decides the fate of untagged
+// images.
+const UntaggedRuleName = "untagged"
+
+// PulledRuleName is the name of the rule that keeps images which were pulled
+// within the pull window of a Policy.
+const PulledRuleName = "pulled"
+
+// ProtectedRuleName is the name of the rule that keeps images with a tag
+// matching a protected tag pattern.
+const ProtectedRuleName = "protected"
+
+// A Policy describes which images in an Elastic Container Registry repository
+// may be pruned.
+type Policy struct {
+	// Period must pass after an image is pushed before it may be pruned.
+	Period Period
+	// KeepCount is the number of most recently pushed tagged images that
+	// are never pruned, whether or not they are deployed.
+	KeepCount int
+	// Rules are matched in order against the tags of each image. An image
+	// with a tag matching a Rule is decided by that Rule instead of Period
+	// and KeepCount.
+	Rules []Rule
+	// UntaggedPeriod is the number of days that must pass after an untagged
+	// image is pushed before it may be pruned. If UntaggedPeriod is zero,
+	// untagged images are never pruned.
+	UntaggedPeriod int
+	// PullWindow is the number of days after an image was last pulled during
+	// which it is kept, whatever its push date. If PullWindow is zero, pull
+	// times are ignored.
+	PullWindow int
+	// SeverityPeriods are the numbers of days that must pass after an image
+	// with scan findings of a severity, or of a higher severity, is pushed
+	// before it may be pruned, if they are shorter than the periods that
+	// would otherwise apply. Images that are kept for any other reason than
+	// their age are unaffected.
+	SeverityPeriods map[string]int
+	// ProtectTags are patterns, as accepted by path.Match, of tags that are
+	// never pruned. An image with a matching tag is always kept.
+	ProtectTags []string
+	// FromLastPull measures periods from the time each image was last
+	// pulled, or pushed if it was never pulled, instead of when it was
+	// pushed, as in pull-through cache repositories.
+	FromLastPull bool
+	// MaxDeletions is the maximum number of images that are pruned from the
+	// repository at once. If MaxDeletions is zero, there is no maximum.
+	MaxDeletions int
+	// MaxDeletePercent is the maximum percentage of the images in the
+	// repository, rounded down, that are pruned at once. If MaxDeletePercent
+	// is zero, there is no maximum.
+	MaxDeletePercent float64
+}
+
+// A Rule decides which images with a tag matching a pattern may be pruned.
+type Rule struct {
+	// Name identifies the Rule in output.
+	Name string `json:"name"`
+	// Glob is a pattern, as accepted by path.Match, that matches tags.
+	Glob string `json:"glob,omitempty"`
+	// Regexp is a regular expression that matches tags.
+	Regexp string `json:"regexp,omitempty"`
+	// Period is the number of days that must pass after a matching image is
+	// pushed before it may be pruned. If Period is zero, matching images may
+	// be pruned at any age.
+	Period int `json:"period,omitempty"`
+	// KeepCount is the number of most recently pushed matching images that
+	// are never pruned.
+	KeepCount int `json:"keepCount,omitempty"`
+	// Semver matches tags that are semantic versions, and keeps the images
+	// it selects. Exactly one of Glob, Regexp, and Semver must be specified.
+	Semver *SemverRetention `json:"semver,omitempty"`
+	// Never keeps matching images forever.
+	Never bool `json:"never,omitempty"`
+
+	regexp *regexp.Regexp
+	// period replaces Period, for the default rule of a Policy.
+	period Period
+}
+
+// calendarPeriod returns the Period of r.
+func (r Rule) calendarPeriod() Period {
+	if !r.period.IsZero() {
+		return r.period
+	}
+	return Period{Days: r.Period}
+}
+
+// compile validates r and prepares it for matching.
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name must not be empty")
+	}
+	patterns := 0
+	for _, specified := range []bool{r.Glob != "", r.Regexp != "", r.Semver != nil} {
+		if specified {
+			patterns++
+		}
+	}
+	if patterns != 1 {
+		return fmt.Errorf("rule %s must specify exactly one of glob, regexp, and semver", r.Name)
+	}
+	if r.Semver != nil {
+		if err := r.Semver.validate(); err != nil {
+			return fmt.Errorf("error in rule %s: %w", r.Name, err)
+		}
+	}
+	if r.Glob != "" {
+		if _, err := path.Match(r.Glob, ""); err != nil {
+			return fmt.Errorf("error parsing glob of rule %s: %w", r.Name, err)
+		}
+	}
+	if r.Regexp != "" {
+		re, err := regexp.Compile(r.Regexp)
+		if err != nil {
+			return fmt.Errorf("error parsing regexp of rule %s: %w", r.Name, err)
+		}
+		r.regexp = re
+	}
+	if r.Period < 0 || r.KeepCount < 0 {
+		return fmt.Errorf("rule %s must not have a negative period or keep count", r.Name)
+	}
+	if !r.Never && r.Period == 0 && r.KeepCount == 0 && (r.Semver == nil || !r.Semver.retains()) {
+		return fmt.Errorf("rule %s must specify a period, a keep count, a semver retention, or never", r.Name)
+	}
+	return nil
+}
+
+// Matches returns whether r matches imageTag.
+func (r *Rule) Matches(imageTag string) bool {
+	if r.Semver != nil {
+		return r.Semver.matches(imageTag)
+	}
+	if r.regexp != nil {
+		return r.regexp.MatchString(imageTag)
+	}
+	matched, _ := path.Match(r.Glob, imageTag)
+	return matched
+}
+
+// compileRules returns a compiled copy of rules.
+func compileRules(rules []Rule) ([]Rule, error) {
+	compiled := make([]Rule, len(rules))
+	copy(compiled, rules)
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// A taggedImage is an image and one of its tags.
+type taggedImage struct {
+	imageDetail *ecr.ImageDetail
+	imageTag    string
+}
+
+// A decision records whether an image may be pruned, and the name of the rule
+// that decided.
+type decision struct {
+	imageDetail *ecr.ImageDetail
+	prune       bool
+	rule        string
+}
+
+// decide returns a decision for each image in the repository with the given
+// URI, in the order of images. Any image with a tag matching a ProtectTags
+// pattern of p, or with a reference in wl, is kept. Otherwise, each tag of an
+// image is decided by the first Rule of p that it matches, or by the Period and
+// KeepCount of p if it matches none, and the image is kept if any of its tags
+// is kept. Images selected by the SemverRetention of a Rule are kept like its
+// newest images. Untagged images are decided by the UntaggedPeriod of p, and
+// are omitted if it is zero. Periods are measured from the last pull of each
+// image if p is FromLastPull, and are shortened by the SeverityPeriods of p
+// that apply to the scan findings summary of an image, if it has one. Finally,
+// any image that would be pruned but was pulled within the PullWindow of p is
+// kept.
+func (p Policy) decide(uri string, images []*ecr.ImageDetail, until time.Time, wl whitelist) []decision {
+	defaultRule := Rule{
+		Name:      DefaultRuleName,
+		KeepCount: p.KeepCount,
+		Never:     p.Period.IsZero(),
+		period:    p.Period,
+	}
+	rules := append(append([]Rule{}, p.Rules...), defaultRule)
+	matched := make([][]*ecr.ImageDetail, len(rules))
+	matchedTags := make([][]taggedImage, len(rules))
+	rulesByImage := make(map[*ecr.ImageDetail][]int, len(images))
+	for _, imageDetail := range images {
+		seen := make(map[int]bool, len(imageDetail.ImageTags))
+		for _, imageTag := range imageDetail.ImageTags {
+			i := len(rules) - 1
+			for j := range p.Rules {
+				if rules[j].Matches(*imageTag) {
+					i = j
+					break
+				}
+			}
+			matchedTags[i] = append(matchedTags[i], taggedImage{imageDetail: imageDetail, imageTag: *imageTag})
+			if seen[i] {
+				continue
+			}
+			seen[i] = true
+			rulesByImage[imageDetail] = append(rulesByImage[imageDetail], i)
+			matched[i] = append(matched[i], imageDetail)
+		}
+	}
+	newest := make([]map[*ecr.ImageDetail]struct{}, len(rules))
+	for i, rule := range rules {
+		newest[i] = newestImages(matched[i], rule.KeepCount)
+		if rule.Semver != nil {
+			for imageDetail := range rule.Semver.retained(matchedTags[i]) {
+				newest[i][imageDetail] = struct{}{}
+			}
+		}
+	}
+	decisions := make([]decision, 0, len(images))
+	for _, imageDetail := range images {
+		if len(imageDetail.ImageTags) == 0 && p.UntaggedPeriod == 0 {
+			continue
+		}
+		if p.protects(imageDetail) {
+			decisions = append(decisions, decision{imageDetail: imageDetail, rule: ProtectedRuleName})
+			continue
+		}
+		if wl.ExcludesImage(uri, imageDetail) {
+			decisions = append(decisions, decision{imageDetail: imageDetail, rule: DeployedRuleName})
+			continue
+		}
+		vulnerabilityPeriod, vulnerable := p.vulnerabilityPeriod(imageDetail)
+		accelerated := false
+		// young returns whether imageDetail was pushed (or last pulled,
+		// if p is FromLastPull) within period before until, shortened by
+		// its scan findings, and records in accelerated whether they made
+		// the difference.
+		young := func(period Period) bool {
+			if !p.age(imageDetail).After(period.before(until)) {
+				return false
+			}
+			if vulnerable {
+				cutoff := Period{Days: vulnerabilityPeriod}.before(until)
+				if !p.age(imageDetail).After(cutoff) {
+					accelerated = true
+					return false
+				}
+			}
+			return true
+		}
+		if len(imageDetail.ImageTags) == 0 {
+			d := decision{
+				imageDetail: imageDetail,
+				prune:       !young(Period{Days: p.UntaggedPeriod}),
+				rule:        UntaggedRuleName,
+			}
+			if d.prune && accelerated {
+				d.rule = VulnerableRuleName
+			}
+			decisions = append(decisions, p.keepPulled(d, until))
+			continue
+		}
+		d := decision{imageDetail: imageDetail, prune: true}
+		for _, i := range rulesByImage[imageDetail] {
+			rule := rules[i]
+			if d.rule == "" {
+				d.rule = rule.Name
+			}
+			_, isNewest := newest[i][imageDetail]
+			if rule.Never || isNewest || young(rule.calendarPeriod()) {
+				d.prune, d.rule = false, rule.Name
+				break
+			}
+		}
+		if d.prune && accelerated {
+			d.rule = VulnerableRuleName
+		}
+		decisions = append(decisions, p.keepPulled(d, until))
+	}
+	return decisions
+}
+
+// age returns the time in UTC from which the periods of p are measured for
+// imageDetail.
+func (p Policy) age(imageDetail *ecr.ImageDetail) time.Time {
+	if p.FromLastPull && imageDetail.LastRecordedPullTime != nil &&
+		imageDetail.LastRecordedPullTime.After(*imageDetail.ImagePushedAt) {
+		return imageDetail.LastRecordedPullTime.UTC()
+	}
+	return imageDetail.ImagePushedAt.UTC()
+}
+
+// protects returns whether any tag of imageDetail matches a ProtectTags
+// pattern of p.
+func (p Policy) protects(imageDetail *ecr.ImageDetail) bool {
+	for _, imageTag := range imageDetail.ImageTags {
+		for _, pattern := range p.ProtectTags {
+			if matched, _ := path.Match(pattern, *imageTag); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateProtectTags returns an error if any of patterns is not a valid
+// pattern.
+func validateProtectTags(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("error parsing protected tag pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// keepPulled returns d, revised to keep its image if it would be pruned but was
+// pulled within the PullWindow of p before until.
+func (p Policy) keepPulled(d decision, until time.Time) decision {
+	if !d.prune || p.PullWindow == 0 || d.imageDetail.LastRecordedPullTime == nil {
+		return d
+	}
+	cutoff := until.UTC().Add(-time.Duration(p.PullWindow) * 24 * time.Hour)
+	if d.imageDetail.LastRecordedPullTime.UTC().After(cutoff) {
+		d.prune, d.rule = false, PulledRuleName
+	}
+	return d
+}
+
+// newestImages returns the keepCount most recently pushed images in images.
+func newestImages(images []*ecr.ImageDetail, keepCount int) map[*ecr.ImageDetail]struct{} {
+	sorted := make([]*ecr.ImageDetail, len(images))
+	copy(sorted, images)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ImagePushedAt.After(*sorted[j].ImagePushedAt)
+	})
+	if len(sorted) > keepCount {
+		sorted = sorted[:keepCount]
+	}
+	newest := make(map[*ecr.ImageDetail]struct{}, len(sorted))
+	for _, imageDetail := range sorted {
+		newest[imageDetail] = struct{}{}
+	}
+	return newest
+}
+
+// repoSettingsFromARN returns the PolicySettings specified by the tags of the
+// repository with the given ARN. Tags with invalid values are logged and
+// ignored, unless gc was created with WithStrictTags.
+func (gc *Client) repoSettingsFromARN(ctx context.Context, arn string) (PolicySettings, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.repoSettingsFromARN")
+	defer span.Finish()
+	tags, err := gc.repoTagsFromARN(ctx, arn)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return PolicySettings{}, fmt.Errorf("error looking up tags: %w", err)
+	}
+	var settings PolicySettings
+	// invalid logs that a tag has an invalid value, or returns an error if
+	// gc was created with WithStrictTags.
+	invalid := func(format string, args ...interface{}) error {
+		if gc.strictTags {
+			return fmt.Errorf(format, args...)
+		}
+		log.Printf(format, args...)
+		return nil
+	}
+	for _, tag := range tags {
+		if tag.Key == nil {
+			continue
+		}
+		var name string
+		var setting **int
+		switch *tag.Key {
+		case gc.PeriodTagKey():
+			name = "prune period"
+		case gc.ProtectTagsTagKey():
+			name = "protected tags"
+		case gc.UntaggedPeriodTagKey():
+			name, setting = "untagged period", &settings.UntaggedPeriod
+		case gc.PullWindowTagKey():
+			name, setting = "pull window", &settings.PullWindow
+		case gc.KeepCountTagKey():
+			name, setting = "keep count", &settings.KeepCount
+		default:
+			continue
+		}
+		var err error
+		switch {
+		case tag.Value == nil:
+			err = invalid("%s tag key %s for %s has nil value", name, *tag.Key, arn)
+		case *tag.Key == gc.PeriodTagKey():
+			period, parseErr := ParsePeriod(*tag.Value)
+			switch {
+			case parseErr != nil:
+				err = invalid("%s tag value %s for %s is invalid: %v", name, *tag.Value, arn, parseErr)
+			case period.IsZero():
+				log.Printf("prune period for %s is zero", arn)
+			default:
+				settings.Period = &period
+			}
+		case *tag.Key == gc.ProtectTagsTagKey():
+			patterns := strings.Fields(*tag.Value)
+			if validateErr := validateProtectTags(patterns); validateErr != nil {
+				err = invalid("%s tag value %s for %s is invalid: %v", name, *tag.Value, arn, validateErr)
+				break
+			}
+			settings.ProtectTags = patterns
+		default:
+			value64, parseErr := strconv.ParseUint(*tag.Value, 10, 0)
+			if parseErr != nil {
+				err = invalid("%s tag value %s for %s is not parseable as an unsigned integer", name, *tag.Value, arn)
+				break
+			}
+			value := int(value64)
+			*setting = &value
+		}
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return PolicySettings{}, err
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,311 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// Precedences of the settings in a PolicyFile over repository tags.
+const (
+	// PrecedenceTags lets repository tags override a PolicyFile.
+	PrecedenceTags = "tags"
+	// PrecedenceFile lets a PolicyFile override repository tags.
+	PrecedenceFile = "file"
+)
+
+// PolicySettings are retention settings, each of which may be left
+// unspecified so that settings from several sources can be combined.
+type PolicySettings struct {
+	// Period must pass after an image is pushed before it may be pruned. It
+	// is a number of days, or a string accepted by ParsePeriod.
+	Period *Period `json:"period,omitempty"`
+	// KeepCount is the number of most recently pushed tagged images that
+	// are never pruned.
+	KeepCount *int `json:"keepCount,omitempty"`
+	// UntaggedPeriod is the number of days that must pass after an untagged
+	// image is pushed before it may be pruned.
+	UntaggedPeriod *int `json:"untaggedPeriod,omitempty"`
+	// PullWindow is the number of days after an image was last pulled during
+	// which it is kept.
+	PullWindow *int `json:"pullWindow,omitempty"`
+	// Rules are matched in order against the tags of each image.
+	Rules []Rule `json:"rules,omitempty"`
+	// ProtectTags are patterns, as accepted by path.Match, of tags that are
+	// never pruned.
+	ProtectTags []string `json:"protectTags,omitempty"`
+	// MaxDeletions is the maximum number of images pruned at once.
+	MaxDeletions *int `json:"maxDeletions,omitempty"`
+	// MaxDeletePercent is the maximum percentage of images pruned at once.
+	MaxDeletePercent *float64 `json:"maxDeletePercent,omitempty"`
+}
+
+// over returns s, with any unspecified settings taken from base.
+func (s PolicySettings) over(base PolicySettings) PolicySettings {
+	if s.Period == nil {
+		s.Period = base.Period
+	}
+	if s.KeepCount == nil {
+		s.KeepCount = base.KeepCount
+	}
+	if s.UntaggedPeriod == nil {
+		s.UntaggedPeriod = base.UntaggedPeriod
+	}
+	if s.PullWindow == nil {
+		s.PullWindow = base.PullWindow
+	}
+	if s.Rules == nil {
+		s.Rules = base.Rules
+	}
+	if s.ProtectTags == nil {
+		s.ProtectTags = base.ProtectTags
+	}
+	if s.MaxDeletions == nil {
+		s.MaxDeletions = base.MaxDeletions
+	}
+	if s.MaxDeletePercent == nil {
+		s.MaxDeletePercent = base.MaxDeletePercent
+	}
+	return s
+}
+
+// validate returns an error if s has negative settings, invalid Rules, or
+// invalid protected tag patterns, and compiles its Rules.
+func (s *PolicySettings) validate() error {
+	negative := s.Period != nil && (s.Period.Months < 0 || s.Period.Days < 0 || s.Period.Duration < 0)
+	for _, setting := range []*int{s.KeepCount, s.UntaggedPeriod, s.PullWindow} {
+		negative = negative || (setting != nil && *setting < 0)
+	}
+	if negative {
+		return fmt.Errorf("period, keep count, untagged period, and pull window must not be negative")
+	}
+	if err := validateProtectTags(s.ProtectTags); err != nil {
+		return err
+	}
+	maxDeletions, maxDeletePercent := intValue(s.MaxDeletions), 0.0
+	if s.MaxDeletePercent != nil {
+		maxDeletePercent = *s.MaxDeletePercent
+	}
+	if err := validateBudget(maxDeletions, maxDeletePercent); err != nil {
+		return err
+	}
+	rules, err := compileRules(s.Rules)
+	if err != nil {
+		return err
+	}
+	if s.Rules != nil {
+		s.Rules = rules
+	}
+	return nil
+}
+
+// Policy returns the Policy with the settings of s, leaving unspecified
+// settings zero.
+func (s PolicySettings) Policy() Policy {
+	var period Period
+	if s.Period != nil {
+		period = *s.Period
+	}
+	var maxDeletePercent float64
+	if s.MaxDeletePercent != nil {
+		maxDeletePercent = *s.MaxDeletePercent
+	}
+	return Policy{
+		Period:           period,
+		KeepCount:        intValue(s.KeepCount),
+		UntaggedPeriod:   intValue(s.UntaggedPeriod),
+		PullWindow:       intValue(s.PullWindow),
+		Rules:            s.Rules,
+		ProtectTags:      s.ProtectTags,
+		MaxDeletions:     intValue(s.MaxDeletions),
+		MaxDeletePercent: maxDeletePercent,
+	}
+}
+
+// intValue returns the value of setting, or zero if it is unspecified.
+func intValue(setting *int) int {
+	if setting == nil {
+		return 0
+	}
+	return *setting
+}
+
+// A RepositoryPolicy applies retention settings to the repositories whose
+// names match a pattern.
+type RepositoryPolicy struct {
+	// Match is a pattern, as accepted by path.Match, that matches repository
+	// names.
+	Match string `json:"match"`
+	PolicySettings
+}
+
+// A PolicyFile specifies retention settings for repositories in place of, or
+// in addition to, repository tags.
+type PolicyFile struct {
+	// Precedence is PrecedenceTags, the default, if repository tags override
+	// the file, or PrecedenceFile if the file overrides repository tags.
+	Precedence string `json:"precedence,omitempty"`
+	// Defaults apply to every repository, beneath the settings of the first
+	// of Repositories that matches it.
+	Defaults PolicySettings `json:"defaults,omitempty"`
+	// Repositories are matched in order against the name of each repository.
+	Repositories []RepositoryPolicy `json:"repositories,omitempty"`
+	// PullThroughCache are matched in order against the repository prefix
+	// of the pull-through cache rule that created each repository, if any.
+	// The settings of the first match apply to the repository beneath those
+	// of Repositories, and above Defaults.
+	PullThroughCache []PullThroughCachePolicy `json:"pullThroughCache,omitempty"`
+	// Filter selects the repositories that are pruned, if specified.
+	Filter *RepositoryFilter `json:"filter,omitempty"`
+}
+
+// Validate returns an error if pf has an unknown precedence, an invalid
+// pattern, negative settings, or invalid Rules.
+func (pf *PolicyFile) Validate() error {
+	_, err := pf.compile()
+	return err
+}
+
+// compile returns a validated copy of pf with compiled Rules.
+func (pf *PolicyFile) compile() (*PolicyFile, error) {
+	compiled := &PolicyFile{
+		Precedence:       pf.Precedence,
+		Defaults:         pf.Defaults,
+		Repositories:     make([]RepositoryPolicy, len(pf.Repositories)),
+		PullThroughCache: make([]PullThroughCachePolicy, len(pf.PullThroughCache)),
+	}
+	if pf.Filter != nil {
+		filter := *pf.Filter
+		if err := filter.compile(); err != nil {
+			return nil, fmt.Errorf("error in filter: %w", err)
+		}
+		compiled.Filter = &filter
+	}
+	copy(compiled.Repositories, pf.Repositories)
+	copy(compiled.PullThroughCache, pf.PullThroughCache)
+	switch compiled.Precedence {
+	case "":
+		compiled.Precedence = PrecedenceTags
+	case PrecedenceTags, PrecedenceFile:
+	default:
+		return nil, fmt.Errorf("precedence must be %s or %s", PrecedenceTags, PrecedenceFile)
+	}
+	if err := compiled.Defaults.validate(); err != nil {
+		return nil, fmt.Errorf("error in defaults: %w", err)
+	}
+	for i := range compiled.Repositories {
+		rp := &compiled.Repositories[i]
+		if rp.Match == "" {
+			return nil, fmt.Errorf("repository policy %d must specify match", i+1)
+		}
+		if _, err := path.Match(rp.Match, ""); err != nil {
+			return nil, fmt.Errorf("error parsing match of repository policy %s: %w", rp.Match, err)
+		}
+		if err := rp.PolicySettings.validate(); err != nil {
+			return nil, fmt.Errorf("error in repository policy %s: %w", rp.Match, err)
+		}
+	}
+	for i := range compiled.PullThroughCache {
+		cp := &compiled.PullThroughCache[i]
+		if cp.Prefix == "" {
+			return nil, fmt.Errorf("pull-through cache policy %d must specify prefix", i+1)
+		}
+		if _, err := path.Match(cp.Prefix, ""); err != nil {
+			return nil, fmt.Errorf("error parsing prefix of pull-through cache policy %s: %w", cp.Prefix, err)
+		}
+		if err := cp.PolicySettings.validate(); err != nil {
+			return nil, fmt.Errorf("error in pull-through cache policy %s: %w", cp.Prefix, err)
+		}
+	}
+	return compiled, nil
+}
+
+// settings returns the settings that pf specifies for the named repository, and
+// the pattern of the RepositoryPolicy that matched it, if any. cachePrefix is
+// the repository prefix of the pull-through cache rule that created the
+// repository, or "" if none did.
+func (pf *PolicyFile) settings(name, cachePrefix string) (settings PolicySettings, match string) {
+	defaults := pf.Defaults
+	if cachePrefix != "" {
+		for _, cp := range pf.PullThroughCache {
+			if matched, _ := path.Match(cp.Prefix, cachePrefix); matched {
+				defaults = cp.PolicySettings.over(defaults)
+				break
+			}
+		}
+	}
+	for _, rp := range pf.Repositories {
+		if matched, _ := path.Match(rp.Match, name); matched {
+			return rp.PolicySettings.over(defaults), rp.Match
+		}
+	}
+	return defaults, ""
+}
+
+// EffectivePolicy returns the Policy that gc applies to the named repository,
+// combining its tags, the PolicyFile specified by WithPolicyFile, and the Rules
+// specified by WithRepoRules, which take precedence over any others. The tags
+// protected by WithProtectedTags are added to those of the repository. If the
+// repository was created by a pull-through cache rule, the PullThroughCache
+// settings of the PolicyFile for the rule apply, and the Policy is
+// FromLastPull. ok is false if the Policy would prune nothing, because it has no
+// prune period, untagged period, or Rules. match is the pattern of the
+// RepositoryPolicy of the PolicyFile that applies to the repository, if any.
+func (gc *Client) EffectivePolicy(ctx context.Context, name string) (policy Policy, match string, ok bool, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.EffectivePolicy")
+	defer span.Finish()
+	repo, err := gc.repoFromName(ctx, name)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return Policy{}, "", false, fmt.Errorf("error looking up repository: %w", err)
+	}
+	policy, match, ok, err = gc.repoPolicy(ctx, repo)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return Policy{}, "", false, err
+	}
+	return policy, match, ok, nil
+}
+
+// repoPolicy returns the Policy that gc applies to repo, as described by
+// EffectivePolicy.
+func (gc *Client) repoPolicy(ctx context.Context, repo *ecr.Repository) (policy Policy, match string, ok bool, err error) {
+	settings, err := gc.repoSettingsFromARN(ctx, *repo.RepositoryArn)
+	if err != nil {
+		return Policy{}, "", false, fmt.Errorf("error checking for prune period: %w", err)
+	}
+	name := *repo.RepositoryName
+	cacheRule, err := gc.pullThroughCacheRule(ctx, name)
+	if err != nil {
+		return Policy{}, "", false, err
+	}
+	cachePrefix := ""
+	if cacheRule != nil {
+		cachePrefix = aws.StringValue(cacheRule.EcrRepositoryPrefix)
+	}
+	if gc.policyFile != nil {
+		var fileSettings PolicySettings
+		fileSettings, match = gc.policyFile.settings(name, cachePrefix)
+		if gc.policyFile.Precedence == PrecedenceFile {
+			settings = fileSettings.over(settings)
+		} else {
+			settings = settings.over(fileSettings)
+		}
+	}
+	if rules, ok := gc.rulesByRepo[name]; ok {
+		settings.Rules = rules
+	}
+	policy = settings.Policy()
+	policy.SeverityPeriods = gc.severityPeriods
+	policy.FromLastPull = cacheRule != nil
+	if len(gc.protectedTags) > 0 {
+		policy.ProtectTags = append(append([]string{}, gc.protectedTags...), policy.ProtectTags...)
+	}
+	ok = !policy.Period.IsZero() || policy.UntaggedPeriod > 0 || len(policy.Rules) > 0
+	return policy, match, ok, nil
+}
@@ -8,13 +8,14 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/dollarshaveclub/thermite/pkg/journal"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
@@ -26,10 +27,18 @@ type GarbageCollector interface {
 
 type whitelist map[string]struct{}
 
+// newWhitelist returns a whitelist of imageRefs. A reference by both tag and
+// digest, such as repo:tag@sha256:..., also excludes repo@sha256:....
 func newWhitelist(imageRefs ...string) whitelist {
 	wl := make(whitelist, len(imageRefs))
 	for _, ref := range imageRefs {
 		wl[ref] = struct{}{}
+		if i := strings.LastIndex(ref, "@"); i >= 0 {
+			name := ref[:i]
+			if j := strings.LastIndex(name, ":"); j > strings.LastIndex(name, "/") {
+				wl[name[:j]+ref[i:]] = struct{}{}
+			}
+		}
 	}
 	return wl
 }
@@ -39,20 +48,72 @@ func (wl whitelist) IsExcluded(imageRef string) bool {
 	return ok
 }
 
+// ExcludesImage returns whether any reference to imageDetail in the repository
+// with the given URI, by tag or by digest, is excluded.
+func (wl whitelist) ExcludesImage(uri string, imageDetail *ecr.ImageDetail) bool {
+	for _, imageTag := range imageDetail.ImageTags {
+		if wl.IsExcluded(fmt.Sprintf("%s:%s", uri, *imageTag)) {
+			return true
+		}
+	}
+	return imageDetail.ImageDigest != nil && wl.IsExcluded(uri+"@"+*imageDetail.ImageDigest)
+}
+
 // A Client is a configurable GarbageCollector wrapping ecriface.ECRAPI.
 type Client struct {
 	client              ecriface.ECRAPI
+	registry            string
 	periodTagKey        string
+	keepCountTagKey     string
+	untaggedTagKey      string
+	pullWindowTagKey    string
+	protectTagsTagKey   string
+	protectedTags       []string
+	rulesByRepo         map[string][]Rule
+	policyFile          *PolicyFile
+	repoFilters         []*RepositoryFilter
+	severityPeriods     map[string]int
 	pageSize            uint
 	removeImages        bool
+	deleteByDigest      bool
 	allowZeroExclusions bool
+	allowNoRegistryRefs bool
+	strictTags          bool
 	logger              *log.Logger
 	statsd              statsd.ClientInterface
+	previewPollInterval time.Duration
+	replicaClient       ReplicaClientFunc
+	replication         []replicationDestination
+	cacheRules          []*ecr.PullThroughCacheRule
+	ignoreCacheRules    bool
+	maxDeletions        int
+	maxDeletePercent    float64
+	budgetAction        string
+	budget              *Budget
+	ledger              Ledger
+	quarantine          time.Duration
+	journal             *journal.Client
 }
 
 // An Option is an option applied when creating a Client.
 type Option func(gc *Client)
 
+// WithRegistryID sets the ID of the Amazon Web Services account whose
+// Elastic Container Registry a Client prunes, instead of the default registry
+// of the account whose credentials the ECR client uses. The credentials must
+// be allowed to manage the registry, such as by a repository policy.
+func WithRegistryID(id string) Option {
+	return func(gc *Client) {
+		gc.registry = id
+	}
+}
+
+// RegistryID returns the ID of the registry that gc prunes, or "" if gc prunes
+// the default registry of its credentials.
+func (gc *Client) RegistryID() string {
+	return gc.registry
+}
+
 // WithRemoveImages sets whether a Client should remove images from Elastic
 // Container Registry or just determine which images are eligible.
 func WithRemoveImages() Option {
@@ -61,6 +122,16 @@ func WithRemoveImages() Option {
 	}
 }
 
+// WithDeleteByDigest sets a Client to delete each pruned image by digest,
+// which removes its manifest along with all of its tags, instead of deleting
+// its tags one by one, and to log the number of bytes reclaimed. Indexes are
+// always deleted by digest, before their children.
+func WithDeleteByDigest() Option {
+	return func(gc *Client) {
+		gc.deleteByDigest = true
+	}
+}
+
 // WithAllowZeroExclusions will allow a Client to prune even if no images are
 // excluded.
 func WithAllowZeroExclusions() Option {
@@ -69,6 +140,23 @@ func WithAllowZeroExclusions() Option {
 	}
 }
 
+// WithAllowNoRegistryExclusions will allow a Client to prune all repositories
+// even if none of the excluded images belong to its registry. Unlike
+// WithAllowZeroExclusions, it does not allow pruning with no exclusions at all.
+func WithAllowNoRegistryExclusions() Option {
+	return func(gc *Client) {
+		gc.allowNoRegistryRefs = true
+	}
+}
+
+// WithStrictTags makes a Client fail to prune a repository with a tag that
+// has an invalid value, instead of logging and ignoring the tag.
+func WithStrictTags() Option {
+	return func(gc *Client) {
+		gc.strictTags = true
+	}
+}
+
 // WithPeriodTagKey sets the Amazon Web Services resource tag used to specify
 // ECR repository prune periods to a Client.
 func WithPeriodTagKey(key string) Option {
@@ -87,6 +175,128 @@ func (gc *Client) PeriodTagKey() string {
 	return gc.periodTagKey
 }
 
+// WithKeepCountTagKey sets the Amazon Web Services resource tag used to specify
+// ECR repository keep counts to a Client.
+func WithKeepCountTagKey(key string) Option {
+	return func(gc *Client) {
+		gc.keepCountTagKey = key
+	}
+}
+
+// DefaultKeepCountTagKey is the default Amazon Web Services resource tag used
+// to specify Elastic Container Registry repository keep counts to a Client.
+const DefaultKeepCountTagKey = "thermite:keep-count"
+
+// KeepCountTagKey returns the resource tag used to specify Elastic Container
+// Registry repository keep counts to gc.
+func (gc *Client) KeepCountTagKey() string {
+	return gc.keepCountTagKey
+}
+
+// WithUntaggedPeriodTagKey sets the Amazon Web Services resource tag used to
+// specify ECR repository untagged image prune periods to a Client.
+func WithUntaggedPeriodTagKey(key string) Option {
+	return func(gc *Client) {
+		gc.untaggedTagKey = key
+	}
+}
+
+// DefaultUntaggedPeriodTagKey is the default Amazon Web Services resource tag
+// used to specify Elastic Container Registry repository untagged image prune
+// periods to a Client.
+const DefaultUntaggedPeriodTagKey = "thermite:untagged-period"
+
+// UntaggedPeriodTagKey returns the resource tag used to specify Elastic
+// Container Registry repository untagged image prune periods to gc.
+func (gc *Client) UntaggedPeriodTagKey() string {
+	return gc.untaggedTagKey
+}
+
+// WithPullWindowTagKey sets the Amazon Web Services resource tag used to
+// specify ECR repository pull windows to a Client.
+func WithPullWindowTagKey(key string) Option {
+	return func(gc *Client) {
+		gc.pullWindowTagKey = key
+	}
+}
+
+// DefaultPullWindowTagKey is the default Amazon Web Services resource tag used
+// to specify Elastic Container Registry repository pull windows to a Client.
+const DefaultPullWindowTagKey = "thermite:pull-window"
+
+// PullWindowTagKey returns the resource tag used to specify Elastic Container
+// Registry repository pull windows to gc.
+func (gc *Client) PullWindowTagKey() string {
+	return gc.pullWindowTagKey
+}
+
+// WithProtectTagsTagKey sets the Amazon Web Services resource tag used to
+// specify ECR repository protected tag patterns to a Client.
+func WithProtectTagsTagKey(key string) Option {
+	return func(gc *Client) {
+		gc.protectTagsTagKey = key
+	}
+}
+
+// DefaultProtectTagsTagKey is the default Amazon Web Services resource tag used
+// to specify Elastic Container Registry repository protected tag patterns, which
+// are separated by spaces, to a Client.
+const DefaultProtectTagsTagKey = "thermite:protect-tags"
+
+// ProtectTagsTagKey returns the resource tag used to specify Elastic Container
+// Registry repository protected tag patterns to gc.
+func (gc *Client) ProtectTagsTagKey() string {
+	return gc.protectTagsTagKey
+}
+
+// WithProtectedTags sets patterns, as accepted by path.Match, of tags that a
+// Client never prunes in any repository.
+func WithProtectedTags(patterns ...string) Option {
+	return func(gc *Client) {
+		gc.protectedTags = patterns
+	}
+}
+
+// WithRepoRules sets the ordered Rules that a Client applies to the tags of
+// images in each named repository. Each tag of an image is decided by the first
+// Rule it matches, and an image is pruned only if none of its tags is kept.
+// Tags that match no Rule are kept if the repository has no prune period.
+func WithRepoRules(rulesByRepo map[string][]Rule) Option {
+	return func(gc *Client) {
+		gc.rulesByRepo = rulesByRepo
+	}
+}
+
+// WithPolicyFile sets a PolicyFile that a Client combines with repository tags
+// to find the Policy of each repository.
+func WithPolicyFile(policyFile *PolicyFile) Option {
+	return func(gc *Client) {
+		gc.policyFile = policyFile
+	}
+}
+
+// WithRepositoryFilter adds a RepositoryFilter that selects the repositories
+// that a Client prunes in PruneAllRepos. Every filter must select a repository
+// for it to be pruned.
+func WithRepositoryFilter(filter RepositoryFilter) Option {
+	return func(gc *Client) {
+		gc.repoFilters = append(gc.repoFilters, &filter)
+	}
+}
+
+// WithSeverityPeriods sets the numbers of days that must pass after an image
+// with scan findings of each severity, or of a higher severity, is pushed
+// before a Client may prune it, if they are shorter than its usual period.
+// Severities are those of Elastic Container Registry findings, such as
+// CRITICAL or HIGH. The Client reads the findings of images that would
+// otherwise be kept for their age, and logs the finding counts of those that it
+// prunes early.
+func WithSeverityPeriods(severityPeriods map[string]int) Option {
+	return func(gc *Client) {
+		gc.severityPeriods = severityPeriods
+	}
+}
+
 // WithPageSize sets the maximum number of responses a Client should request
 // in a single Elastic Container Registry API call.
 func WithPageSize(size uint) Option {
@@ -111,68 +321,171 @@ func WithStatsdClient(client statsd.ClientInterface) Option {
 
 // NewClient returns a GarbageCollector that removes images using
 // client. If no WithPeriodTagKey options are specified in opts,
-// DefaultPeriodTagKey will be used.
+// DefaultPeriodTagKey will be used. Likewise, DefaultKeepCountTagKey,
+// DefaultUntaggedPeriodTagKey, DefaultPullWindowTagKey, and
+// DefaultProtectTagsTagKey will be used if no WithKeepCountTagKey,
+// WithUntaggedPeriodTagKey, WithPullWindowTagKey, or WithProtectTagsTagKey
+// options are specified.
 func NewClient(client ecriface.ECRAPI, opts ...Option) (*Client, error) {
 	if client == nil {
 		return nil, fmt.Errorf("client must not be nil")
 	}
 	gc := &Client{
-		client:       client,
-		periodTagKey: DefaultPeriodTagKey,
-		logger:       log.New(io.Discard, "", 0),
-		statsd:       &statsd.NoOpClient{},
+		client:            client,
+		periodTagKey:      DefaultPeriodTagKey,
+		keepCountTagKey:   DefaultKeepCountTagKey,
+		untaggedTagKey:    DefaultUntaggedPeriodTagKey,
+		pullWindowTagKey:  DefaultPullWindowTagKey,
+		protectTagsTagKey: DefaultProtectTagsTagKey,
+		budgetAction:      BudgetActionAbort,
+		logger:            log.New(io.Discard, "", 0),
+		statsd:            &statsd.NoOpClient{},
+		// Lifecycle policy previews typically take several seconds.
+		previewPollInterval: 5 * time.Second,
 	}
 	for _, opt := range opts {
 		opt(gc)
 	}
+	rulesByRepo := make(map[string][]Rule, len(gc.rulesByRepo))
+	for name, rules := range gc.rulesByRepo {
+		compiled, err := compileRules(rules)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling rules for repository %s: %w", name, err)
+		}
+		rulesByRepo[name] = compiled
+	}
+	gc.rulesByRepo = rulesByRepo
+	if err := validateSeverityPeriods(gc.severityPeriods); err != nil {
+		return nil, err
+	}
+	if err := validateProtectTags(gc.protectedTags); err != nil {
+		return nil, err
+	}
+	if err := validateBudget(gc.maxDeletions, gc.maxDeletePercent); err != nil {
+		return nil, err
+	}
+	if gc.budget != nil && (gc.maxDeletions != 0 || gc.maxDeletePercent != 0) {
+		return nil, fmt.Errorf("a shared deletion budget cannot be combined with max deletions or max delete percent")
+	}
+	if gc.budgetAction != BudgetActionAbort && gc.budgetAction != BudgetActionOldest {
+		return nil, fmt.Errorf("budget action must be %s or %s", BudgetActionAbort, BudgetActionOldest)
+	}
+	if gc.quarantine < 0 {
+		return nil, fmt.Errorf("quarantine period must not be negative")
+	}
+	if gc.policyFile != nil {
+		policyFile, err := gc.policyFile.compile()
+		if err != nil {
+			return nil, fmt.Errorf("error in policy file: %w", err)
+		}
+		gc.policyFile = policyFile
+		if policyFile.Filter != nil {
+			gc.repoFilters = append(gc.repoFilters, policyFile.Filter)
+		}
+	}
+	for _, filter := range gc.repoFilters {
+		if err := filter.compile(); err != nil {
+			return nil, err
+		}
+	}
 	return gc, nil
 }
 
 // PruneAllRepos runs PruneRepo for every repository in the Amazon Elastic
-// Container Registry associated with gc, and returns the combined list
-// of pruned image references.
+// Container Registry associated with gc that is selected by the filters
+// specified by WithRepositoryFilter, and returns the combined list of pruned
+// image references. The images to prune from every repository are decided
+// before any is deleted, so that the ledger specified by WithLedger and the
+// deletion budget specified by WithMaxDeletions, WithMaxDeletePercent, or
+// WithBudget apply to the whole registry. PruneAllRepos will fail if none of
+// the image references specified by excluded belong to the registry, unless
+// WithAllowNoRegistryExclusions was specified when creating gc.
 func (gc *Client) PruneAllRepos(ctx context.Context, until time.Time, excluded ...string) (pruned []string, err error) {
 	var span tracer.Span
 	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.PruneAllRepos")
 	defer span.Finish()
 	defer gc.statsd.Flush()
 	pruned = []string{}
-	dro, err := gc.client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
-		MaxResults: gc.maxResults(),
-	})
+	repos, err := gc.describeRepositories(ctx)
 	if err != nil {
 		span.Finish(tracer.WithError(err))
-		return pruned, fmt.Errorf("error describing Elastic Container Registry repositories: %w", err)
+		return pruned, err
+	}
+	if !gc.allowNoRegistryRefs && !anyInRegistry(repos, excluded) {
+		err := ErrNoRegistryExclusions
+		span.Finish(tracer.WithError(err))
+		return pruned, err
 	}
 	taggedRepoCount := 0
-	for _, repo := range dro.Repositories {
-		repoPruned, err := gc.PruneRepo(ctx, *repo.RepositoryName, until, excluded...)
-		pruned = append(pruned, repoPruned...)
-		if err != nil && err != ErrNoPrunePeriodTag {
+	filteredRepoCount := 0
+	plans := []*repoPlan{}
+	for _, repo := range repos {
+		included, err := gc.includesRepo(ctx, repo)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, fmt.Errorf("error filtering repository %s: %w", *repo.RepositoryUri, err)
+		}
+		if !included {
+			gc.logger.Printf("skipping Elastic Container Registry repository %s excluded by repository filters", *repo.RepositoryName)
+			filteredRepoCount++
+			continue
+		}
+		plan, err := gc.planRepo(ctx, repo, until, excluded...)
+		if err == ErrNoPrunePeriodTag {
+			continue
+		}
+		if err != nil {
 			span.Finish(tracer.WithError(err))
 			return pruned, fmt.Errorf("error pruning repository %s: %w", *repo.RepositoryUri, err)
 		}
-		if err == nil {
-			taggedRepoCount++
+		plans = append(plans, plan)
+		taggedRepoCount++
+	}
+	// Every repository is planned before any image is deleted, so that a
+	// run that would exceed its deletion budget can be stopped beforehand.
+	if err := gc.sweep(ctx, until, plans); err != nil {
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
+	if err := gc.applyBudgets(plans); err != nil {
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
+	for _, plan := range plans {
+		repoPruned, err := gc.executePlan(ctx, plan)
+		pruned = append(pruned, repoPruned...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, fmt.Errorf("error pruning repository %s: %w", *plan.repo.RepositoryUri, err)
 		}
 	}
 	gc.logger.Printf("pruned %d Elastic Container Registry images", len(pruned))
 	gc.statsd.Gauge("prune.tagged_repos", float64(taggedRepoCount), nil, 1)
-	gc.statsd.Gauge("prune.prune_all_repos", float64(len(dro.Repositories)), nil, 1)
+	gc.statsd.Gauge("prune.filtered_repos", float64(filteredRepoCount), nil, 1)
+	gc.statsd.Gauge("prune.prune_all_repos", float64(len(repos)), nil, 1)
 	return pruned, nil
 }
 
 var ErrNoPrunePeriodTag = errors.New("no valid prune period tag for repository")
 
+// ErrNoRegistryExclusions is returned by PruneAllRepos when none of the
+// excluded image references belong to the registry being pruned, which
+// usually means that the survey that produced them was incomplete.
+var ErrNoRegistryExclusions = errors.New("zero excluded images belong to registry")
+
 // PruneRepo checks the named repo for a tag with the key identified by
-// gc.PeriodTagKey(), whose value specifies a positive integer representing the
-// number of days that must pass after an image is pushed to the repository
+// gc.PeriodTagKey(), whose value specifies a period, as accepted by
+// ParsePeriod, that must pass after an image is pushed to the repository
 // before it can be removed. If the tag is present, PruneRepo removes any images
-// that were pushed that many days before until, excluding any image referenced
-// by excluded.
+// that were pushed more than that period before until, excluding any image
+// referenced by excluded. The rest of the Policy of the repo, as returned by
+// EffectivePolicy, can keep images longer or prune them sooner, and PruneRepo
+// logs the rule that decided each image. The children of a kept
+// multi-architecture image index are kept, and the children of a pruned index
+// are pruned with it unless another index refers to them.
 //
 // PruneRepo returns the list of image references that were pruned (or would
-// haveb been pruned if WithRemoveImages was not specified as an option when
+// have been pruned if WithRemoveImages was not specified as an option when
 // creating gc). PruneRepo will fail if no image references are specified by
 // excluded, unless WithAllowZeroExclusions was specified when creating gc.
 func (gc *Client) PruneRepo(ctx context.Context, name string, until time.Time, excluded ...string) (pruned []string, err error) {
@@ -181,107 +494,277 @@ func (gc *Client) PruneRepo(ctx context.Context, name string, until time.Time, e
 	defer span.Finish()
 	defer gc.statsd.Flush()
 	pruned = []string{}
-	if len(excluded) == 0 && !gc.allowZeroExclusions {
-		return pruned, fmt.Errorf("zero images excluded from prune")
-	}
 	repo, err := gc.repoFromName(ctx, name)
 	if err != nil {
 		span.Finish(tracer.WithError(err))
 		return pruned, fmt.Errorf("error looking up repository: %w", err)
 	}
-	period, ok, err := gc.repoPrunePeriodFromARN(ctx, *repo.RepositoryArn)
+	plan, err := gc.planRepo(ctx, repo, until, excluded...)
+	if err == ErrNoPrunePeriodTag {
+		return pruned, err
+	}
 	if err != nil {
 		span.Finish(tracer.WithError(err))
-		return pruned, fmt.Errorf("error checking for prune period: %w", err)
+		return pruned, err
+	}
+	if err := gc.sweep(ctx, until, []*repoPlan{plan}); err != nil {
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
+	if err := gc.applyBudgets([]*repoPlan{plan}); err != nil {
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
+	pruned, err = gc.executePlan(ctx, plan)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
+	return pruned, nil
+}
+
+// A repoPlan holds the decisions that a Client has made about the images in a
+// repository, before deleting any of them.
+type repoPlan struct {
+	repo      *ecr.Repository
+	policy    Policy
+	until     time.Time
+	images    []*ecr.ImageDetail
+	children  map[string][]string
+	wl        whitelist
+	decisions []decision
+}
+
+// planRepo decides which images in repo to prune, as described by PruneRepo,
+// without deleting any of them. planRepo returns ErrNoPrunePeriodTag if the
+// Policy of repo would prune nothing.
+func (gc *Client) planRepo(ctx context.Context, repo *ecr.Repository, until time.Time, excluded ...string) (*repoPlan, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.planRepo")
+	defer span.Finish()
+	if len(excluded) == 0 && !gc.allowZeroExclusions {
+		return nil, fmt.Errorf("zero images excluded from prune")
+	}
+	name := *repo.RepositoryName
+	policy, _, ok, err := gc.repoPolicy(ctx, repo)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
 	}
 	if !ok {
-		return pruned, ErrNoPrunePeriodTag
+		return nil, ErrNoPrunePeriodTag
 	}
 	log.Printf(
-		"found prune period of %d days for Elastic Container Registry repository %s",
-		period,
+		"found prune period of %s, keep count of %d, and %d rules for Elastic Container Registry repository %s",
+		policy.Period,
+		policy.KeepCount,
+		len(policy.Rules),
 		name,
 	)
-	whitelist := newWhitelist(excluded...)
-	pruneableImageIDs := []*ecr.ImageIdentifier{}
-	var pageErr error
-	if err := gc.client.DescribeImagesPagesWithContext(
-		ctx,
-		&ecr.DescribeImagesInput{
-			RepositoryName: aws.String(name),
-			MaxResults:     gc.maxResults(),
-		},
-		func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
-			for _, imageDetail := range page.ImageDetails {
-				excluded := false
-				for _, imageTag := range imageDetail.ImageTags {
-					if imageTag == nil {
-						pageErr = fmt.Errorf(
-							"found unexpected nil image tag in Elastic Container Registry repository %s",
-							*repo.RepositoryUri,
-						)
-						return false
-					}
-					imageRef := fmt.Sprintf("%s:%s", *repo.RepositoryUri, *imageTag)
-					if whitelist.IsExcluded(imageRef) {
-						excluded = true
-						break
-					}
-				}
-				if excluded {
-					continue
-				}
-				if imageDetail.ImagePushedAt == nil {
-					pageErr = fmt.Errorf(
-						"found unexpected nil image pushed at time in Elastic Container Registry repository %s",
-						*repo.RepositoryUri,
-					)
-					return false
-				}
-				pushedAt := imageDetail.ImagePushedAt.UTC()
-				period := -time.Duration(period) * 24 * time.Hour
-				cutoff := until.UTC().Add(period)
-				if pushedAt.After(cutoff) {
-					continue
-				}
-				for _, imageTag := range imageDetail.ImageTags {
-					pruneableImageIDs = append(pruneableImageIDs, &ecr.ImageIdentifier{ImageTag: imageTag})
-				}
-			}
-			return true
-		},
-	); err != nil {
+	images, err := gc.describeImages(ctx, repo)
+	if err != nil {
 		span.Finish(tracer.WithError(err))
-		return pruned, fmt.Errorf(
-			"error describing images in Elastic Container Registry repository %s: %w",
+		return nil, err
+	}
+	children, err := gc.indexChildren(ctx, repo, images)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error inspecting image indexes: %w", err)
+	}
+	cacheRule, err := gc.pullThroughCacheRule(ctx, name)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	if cacheRule != nil {
+		cacheRefs := cacheImageRefs(cacheRule, *repo.RepositoryUri, excluded)
+		gc.logger.Printf(
+			"found %d excluded images from upstream registry %s of pull-through cache repository %s",
+			len(cacheRefs),
+			aws.StringValue(cacheRule.UpstreamRegistryUrl),
 			name,
-			err,
 		)
+		excluded = append(append([]string{}, excluded...), cacheRefs...)
 	}
-	if pageErr != nil {
-		span.Finish(tracer.WithError(pageErr))
-		return pruned, pageErr
+	wl := newWhitelist(excluded...)
+	live, isolated := gc.partitionQuarantined(images)
+	decisions := policy.decide(*repo.RepositoryUri, live, until, wl)
+	if len(policy.SeverityPeriods) > 0 {
+		// Scan findings are only described for images that are kept but
+		// old enough that findings could shorten their period.
+		cutoff := until.UTC().Add(-time.Duration(policy.shortestSeverityPeriod()) * 24 * time.Hour)
+		described := 0
+		for _, d := range decisions {
+			if d.prune || d.rule == DeployedRuleName || d.rule == PulledRuleName {
+				continue
+			}
+			if d.imageDetail.ImageDigest == nil || d.imageDetail.ImagePushedAt.UTC().After(cutoff) {
+				continue
+			}
+			if err := gc.describeFindings(ctx, repo, d.imageDetail); err != nil {
+				span.Finish(tracer.WithError(err))
+				return nil, err
+			}
+			described++
+		}
+		if described > 0 {
+			decisions = policy.decide(*repo.RepositoryUri, live, until, wl)
+		}
+	}
+	decisions = append(decisions, gc.decideQuarantined(*repo.RepositoryUri, isolated, until, wl)...)
+	plan := &repoPlan{
+		repo:      repo,
+		policy:    policy,
+		until:     until,
+		images:    images,
+		children:  children,
+		wl:        wl,
+		decisions: resolveIndexes(decisions, images, children),
+	}
+	gc.spareQuarantined(plan)
+	return plan, nil
+}
+
+// executePlan deletes the images that plan prunes, or only reports them if
+// WithRemoveImages was not specified when creating gc, and returns references
+// to them.
+func (gc *Client) executePlan(ctx context.Context, plan *repoPlan) (pruned []string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.executePlan")
+	defer span.Finish()
+	pruned = []string{}
+	repo, children, wl := plan.repo, plan.children, plan.wl
+	name := *repo.RepositoryName
+	// Indexes are deleted before other images, since Elastic Container
+	// Registry refuses to delete a manifest that an index refers to.
+	pruneableIndexIDs := []*ecr.ImageIdentifier{}
+	pruneableImageIDs := []*ecr.ImageIdentifier{}
+	pruneableImagesByDigest := map[string]*ecr.ImageDetail{}
+	pruneableDigests := []string{}
+	quarantineImages := []*ecr.ImageDetail{}
+	pruneableImages := []*ecr.ImageDetail{}
+	for _, d := range plan.decisions {
+		gc.logDecision(*repo.RepositoryUri, d)
+		if !d.prune {
+			continue
+		}
+		if gc.quarantines(d) {
+			quarantineImages = append(quarantineImages, d.imageDetail)
+			continue
+		}
+		pruneableImages = append(pruneableImages, d.imageDetail)
+		if d.imageDetail.ImageDigest != nil {
+			pruneableDigests = append(pruneableDigests, *d.imageDetail.ImageDigest)
+		}
+		if _, ok := children[aws.StringValue(d.imageDetail.ImageDigest)]; ok {
+			pruneableIndexIDs = append(pruneableIndexIDs, &ecr.ImageIdentifier{ImageDigest: d.imageDetail.ImageDigest})
+			pruneableImagesByDigest[*d.imageDetail.ImageDigest] = d.imageDetail
+			continue
+		}
+		if gc.deleteByDigest || len(d.imageDetail.ImageTags) == 0 {
+			pruneableImageIDs = append(pruneableImageIDs, &ecr.ImageIdentifier{ImageDigest: d.imageDetail.ImageDigest})
+			pruneableImagesByDigest[*d.imageDetail.ImageDigest] = d.imageDetail
+			continue
+		}
+		for _, imageTag := range d.imageDetail.ImageTags {
+			pruneableImageIDs = append(pruneableImageIDs, &ecr.ImageIdentifier{ImageTag: imageTag})
+		}
 	}
+	pruneableImageIDs = append(pruneableIndexIDs, pruneableImageIDs...)
 	log.Printf(
 		"found %d unique pruneable images for Elastic Container Registry repository %s",
-		len(pruneableImageIDs),
+		len(pruneableImageIDs)+len(quarantineImages),
 		name,
 	)
-	gc.statsd.Gauge("prune.prune_repo_pruneable", float64(len(pruneableImageIDs)), nil, 1)
+	gc.statsd.Gauge("prune.prune_repo_pruneable", float64(len(pruneableImageIDs)+len(quarantineImages)), nil, 1)
 	if !gc.removeImages {
 		gc.statsd.Count("prune.prune_repo_deleted", 0, nil, 1)
 		pruneableImageTags, err := repoImageRefsFromURIAndImageIDs(
 			ctx,
 			*repo.RepositoryUri,
 			pruneableImageIDs,
+			pruneableImagesByDigest,
 		)
 		if err != nil {
 			return pruned, err
 		}
+		for _, imageDetail := range quarantineImages {
+			pruneableImageTags = append(pruneableImageTags, imageRefsFromImageDetail(*repo.RepositoryUri, imageDetail)...)
+		}
+		log.Printf(
+			"would reclaim %d bytes from Elastic Container Registry repository %s",
+			reclaimedBytes(pruneableImageIDs, pruneableImagesByDigest),
+			name,
+		)
+		if gc.replicaClient != nil {
+			replicaPruned, err := gc.pruneReplicas(ctx, repo, pruneableDigests, children, wl)
+			pruneableImageTags = append(pruneableImageTags, replicaPruned...)
+			if err != nil {
+				span.Finish(tracer.WithError(err))
+				return pruneableImageTags, err
+			}
+		}
 		return pruneableImageTags, nil
 	}
+	if gc.journal != nil {
+		if err := gc.journalImages(ctx, repo, pruneableImages, plan.until); err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, fmt.Errorf("error journaling images: %w", err)
+		}
+	}
 	pruned = make([]string, 0, len(pruneableImageIDs))
-	remaining := pruneableImageIDs
+	var reclaimed int64
+	defer func() {
+		log.Printf(
+			"reclaimed %d bytes from Elastic Container Registry repository %s",
+			reclaimed,
+			name,
+		)
+		gc.statsd.Count("prune.prune_repo_reclaimed_bytes", reclaimed, nil, 1)
+	}()
+	for _, imageIDs := range [][]*ecr.ImageIdentifier{
+		pruneableImageIDs[:len(pruneableIndexIDs)],
+		pruneableImageIDs[len(pruneableIndexIDs):],
+	} {
+		deletedImageRefs, deletedBytes, err := gc.deleteImages(ctx, repo, imageIDs, pruneableImagesByDigest)
+		pruned = append(pruned, deletedImageRefs...)
+		reclaimed += deletedBytes
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, err
+		}
+	}
+	if len(quarantineImages) > 0 {
+		quarantined, err := gc.quarantineImages(ctx, repo, quarantineImages, plan.until)
+		pruned = append(pruned, quarantined...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, err
+		}
+	}
+	if gc.replicaClient != nil {
+		// Replicas are only pruned once every image has been deleted from
+		// the source repository, so that a failure leaves them intact.
+		replicaPruned, err := gc.pruneReplicas(ctx, repo, pruneableDigests, children, wl)
+		pruned = append(pruned, replicaPruned...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// deleteImages deletes imageIDs from repo in batches, and returns references
+// to the deleted images and the number of bytes reclaimed by deleting them.
+func (gc *Client) deleteImages(
+	ctx context.Context,
+	repo *ecr.Repository,
+	imageIDs []*ecr.ImageIdentifier,
+	imagesByDigest map[string]*ecr.ImageDetail,
+) (deleted []string, reclaimed int64, err error) {
+	deleted = make([]string, 0, len(imageIDs))
+	remaining := imageIDs
 	for len(remaining) > 0 {
 		batch := remaining
 		if len(batch) > 100 {
@@ -291,29 +774,60 @@ func (gc *Client) PruneRepo(ctx context.Context, name string, until time.Time, e
 		bdio, batchDeleteImageErr := gc.client.BatchDeleteImageWithContext(
 			ctx,
 			&ecr.BatchDeleteImageInput{
+				RegistryId:     gc.registryID(),
 				ImageIds:       batch,
 				RepositoryName: repo.RepositoryName,
 			},
 		)
+		if bdio == nil {
+			bdio = &ecr.BatchDeleteImageOutput{}
+		}
 		log.Printf(
 			"deleted %d images from Elastic Container Registry repository %s",
 			len(bdio.ImageIds),
-			name,
+			*repo.RepositoryName,
 		)
 		gc.statsd.Count("prune.prune_repo_deleted", int64(len(bdio.ImageIds)), nil, 1)
-		deletedImageRefs, err := repoImageRefsFromURIAndImageIDs(ctx, *repo.RepositoryUri, bdio.ImageIds)
+		reclaimed += reclaimedBytes(bdio.ImageIds, imagesByDigest)
+		deletedImageRefs, err := repoImageRefsFromURIAndImageIDs(
+			ctx,
+			*repo.RepositoryUri,
+			bdio.ImageIds,
+			imagesByDigest,
+		)
 		if err != nil {
-			span.Finish(tracer.WithError(err))
-			return pruned, fmt.Errorf("error formatting deleted image names: %w", err)
+			return deleted, reclaimed, fmt.Errorf("error formatting deleted image names: %w", err)
 		}
-		pruned = append(pruned, deletedImageRefs...)
+		deleted = append(deleted, deletedImageRefs...)
 		if batchDeleteImageErr != nil {
-			span.Finish(tracer.WithError(batchDeleteImageErr))
-			return pruned, fmt.Errorf("error deleting images: %w", batchDeleteImageErr)
+			return deleted, reclaimed, fmt.Errorf("error deleting images: %w", batchDeleteImageErr)
 		}
+	}
+	return deleted, reclaimed, nil
+}
 
+// describeRepositories returns every repository in the Elastic Container
+// Registry associated with gc.
+func (gc *Client) describeRepositories(ctx context.Context) ([]*ecr.Repository, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.describeRepositories")
+	defer span.Finish()
+	repos := []*ecr.Repository{}
+	if err := gc.client.DescribeRepositoriesPagesWithContext(
+		ctx,
+		&ecr.DescribeRepositoriesInput{
+			MaxResults: gc.maxResults(),
+			RegistryId: gc.registryID(),
+		},
+		func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+			repos = append(repos, page.Repositories...)
+			return true
+		},
+	); err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error describing Elastic Container Registry repositories: %w", err)
 	}
-	return pruned, nil
+	return repos, nil
 }
 
 func (gc *Client) repoFromName(ctx context.Context, name string) (*ecr.Repository, error) {
@@ -321,6 +835,7 @@ func (gc *Client) repoFromName(ctx context.Context, name string) (*ecr.Repositor
 	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.repoFromName")
 	defer span.Finish()
 	dro, err := gc.client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      gc.registryID(),
 		RepositoryNames: []*string{aws.String(name)},
 	})
 	if err != nil {
@@ -347,39 +862,102 @@ func (gc *Client) repoTagsFromARN(ctx context.Context, arn string) ([]*ecr.Tag,
 	return ltfro.Tags, nil
 }
 
-func (gc *Client) repoPrunePeriodFromARN(
-	ctx context.Context,
-	arn string,
-) (period int, ok bool, err error) {
+// logDecision logs which rule decided whether to prune the image described by
+// d in the repository with the given URI.
+func (gc *Client) logDecision(uri string, d decision) {
+	action := "keeping"
+	switch {
+	case gc.quarantines(d) && gc.removeImages:
+		action = "quarantining"
+	case gc.quarantines(d):
+		action = "would quarantine"
+	case d.prune && gc.removeImages:
+		action = "pruning"
+	case d.prune:
+		action = "would prune"
+	}
+	pulled := "never pulled"
+	if d.imageDetail.LastRecordedPullTime != nil {
+		pulled = "last pulled at " + d.imageDetail.LastRecordedPullTime.UTC().Format(time.RFC3339)
+	}
+	if d.rule == VulnerableRuleName {
+		pulled += " with findings " + formatFindings(d.imageDetail)
+	}
+	gc.logger.Printf(
+		"%s %s pushed at %s, %s (rule %s)",
+		action,
+		strings.Join(imageRefsFromImageDetail(uri, d.imageDetail), ", "),
+		d.imageDetail.ImagePushedAt.UTC().Format(time.RFC3339),
+		pulled,
+		d.rule,
+	)
+}
+
+// describeImages returns the details of every image in repo.
+func (gc *Client) describeImages(ctx context.Context, repo *ecr.Repository) ([]*ecr.ImageDetail, error) {
 	var span tracer.Span
-	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.repoPrunePeriodFromARN")
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.describeImages")
 	defer span.Finish()
-	tags, err := gc.repoTagsFromARN(ctx, arn)
-	if err != nil {
+	images := []*ecr.ImageDetail{}
+	var pageErr error
+	if err := gc.client.DescribeImagesPagesWithContext(
+		ctx,
+		&ecr.DescribeImagesInput{
+			RegistryId:     gc.registryID(),
+			RepositoryName: repo.RepositoryName,
+			MaxResults:     gc.maxResults(),
+		},
+		func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+			for _, imageDetail := range page.ImageDetails {
+				for _, imageTag := range imageDetail.ImageTags {
+					if imageTag == nil {
+						pageErr = fmt.Errorf(
+							"found unexpected nil image tag in Elastic Container Registry repository %s",
+							*repo.RepositoryUri,
+						)
+						return false
+					}
+				}
+				if (len(imageDetail.ImageTags) == 0 || gc.deleteByDigest) && imageDetail.ImageDigest == nil {
+					pageErr = fmt.Errorf(
+						"found unexpected nil image digest in Elastic Container Registry repository %s",
+						*repo.RepositoryUri,
+					)
+					return false
+				}
+				if imageDetail.ImagePushedAt == nil {
+					pageErr = fmt.Errorf(
+						"found unexpected nil image pushed at time in Elastic Container Registry repository %s",
+						*repo.RepositoryUri,
+					)
+					return false
+				}
+				images = append(images, imageDetail)
+			}
+			return true
+		},
+	); err != nil {
 		span.Finish(tracer.WithError(err))
-		return 0, false, fmt.Errorf("error looking up tags: %w", err)
+		return nil, fmt.Errorf(
+			"error describing images in Elastic Container Registry repository %s: %w",
+			*repo.RepositoryName,
+			err,
+		)
 	}
-	period, ok = 0, false
-	for _, tag := range tags {
-		if tag.Key == nil || *tag.Key != gc.PeriodTagKey() {
-			continue
-		}
-		if tag.Value == nil {
-			log.Printf("prune period tag key %s for %s has nil value", *tag.Key, arn)
-			break
-		}
-		period64, err := strconv.ParseUint(*tag.Value, 10, 0)
-		if err != nil {
-			log.Printf("prune period tag value %s for %s is not parseable as an unsigned integer", *tag.Value, arn)
-			break
-		}
-		if period64 == 0 {
-			log.Printf("prune period for %s is zero", arn)
-			break
-		}
-		period, ok = int(period64), true
+	if pageErr != nil {
+		span.Finish(tracer.WithError(pageErr))
+		return nil, pageErr
+	}
+	return images, nil
+}
+
+// registryID returns the RegistryId to request from Elastic Container Registry,
+// which is nil for the default registry.
+func (gc *Client) registryID() *string {
+	if gc.registry == "" {
+		return nil
 	}
-	return period, ok, nil
+	return aws.String(gc.registry)
 }
 
 func (gc *Client) maxResults() *int64 {
@@ -390,14 +968,93 @@ func (gc *Client) maxResults() *int64 {
 	return aws.Int64(maxResults)
 }
 
-func repoImageRefsFromURIAndImageIDs(ctx context.Context, uri string, imageIDs []*ecr.ImageIdentifier) ([]string, error) {
+// repoImageRefsFromURIAndImageIDs returns a reference to each of imageIDs in
+// the repository with the given URI. Images deleted by digest are referred to
+// by every tag they had according to imagesByDigest, so that no tag of a
+// deleted image goes unreported. Each image deleted by digest is reported
+// once, however many of imageIDs refer to it.
+func repoImageRefsFromURIAndImageIDs(
+	ctx context.Context,
+	uri string,
+	imageIDs []*ecr.ImageIdentifier,
+	imagesByDigest map[string]*ecr.ImageDetail,
+) ([]string, error) {
 	imageRefs := make([]string, 0, len(imageIDs))
+	reported := make(map[string]bool)
 	for _, imageID := range imageIDs {
-		if imageID.ImageTag == nil {
-			return nil, fmt.Errorf("imageID.ImageTag must not be nil")
+		if imageID.ImageDigest != nil {
+			if imageDetail, ok := imagesByDigest[*imageID.ImageDigest]; ok {
+				if !reported[*imageID.ImageDigest] {
+					reported[*imageID.ImageDigest] = true
+					imageRefs = append(imageRefs, imageRefsFromImageDetail(uri, imageDetail)...)
+				}
+				continue
+			}
+		}
+		switch {
+		case imageID.ImageTag != nil:
+			imageRefs = append(imageRefs, fmt.Sprintf("%s:%s", uri, *imageID.ImageTag))
+		case imageID.ImageDigest != nil:
+			imageRefs = append(imageRefs, fmt.Sprintf("%s@%s", uri, *imageID.ImageDigest))
+		default:
+			return nil, fmt.Errorf("imageID.ImageTag and imageID.ImageDigest must not both be nil")
 		}
-		imageRef := fmt.Sprintf("%s:%s", uri, *imageID.ImageTag)
-		imageRefs = append(imageRefs, imageRef)
 	}
 	return imageRefs, nil
 }
+
+// reclaimedBytes returns the combined size of the images in imagesByDigest
+// that imageIDs refer to. Only images deleted by digest are in imagesByDigest,
+// since deleting some tags of an image leaves its manifest and layers in place.
+func reclaimedBytes(imageIDs []*ecr.ImageIdentifier, imagesByDigest map[string]*ecr.ImageDetail) int64 {
+	var reclaimed int64
+	counted := make(map[string]bool)
+	for _, imageID := range imageIDs {
+		if imageID.ImageDigest == nil || counted[*imageID.ImageDigest] {
+			continue
+		}
+		imageDetail, ok := imagesByDigest[*imageID.ImageDigest]
+		if !ok || imageDetail.ImageSizeInBytes == nil {
+			continue
+		}
+		counted[*imageID.ImageDigest] = true
+		reclaimed += *imageDetail.ImageSizeInBytes
+	}
+	return reclaimed
+}
+
+// imageRefsFromImageDetail returns a reference to imageDetail in the repository
+// with the given URI for each of its tags, or by digest if it has none.
+func imageRefsFromImageDetail(uri string, imageDetail *ecr.ImageDetail) []string {
+	if len(imageDetail.ImageTags) == 0 && imageDetail.ImageDigest != nil {
+		return []string{fmt.Sprintf("%s@%s", uri, *imageDetail.ImageDigest)}
+	}
+	imageRefs := make([]string, 0, len(imageDetail.ImageTags))
+	for _, imageTag := range imageDetail.ImageTags {
+		imageRefs = append(imageRefs, fmt.Sprintf("%s:%s", uri, *imageTag))
+	}
+	return imageRefs
+}
+
+// anyInRegistry returns whether any of imageRefs refers to an image in the
+// registry hosting repos.
+func anyInRegistry(repos []*ecr.Repository, imageRefs []string) bool {
+	hosts := make(map[string]struct{}, 1)
+	for _, repo := range repos {
+		if repo.RepositoryUri == nil {
+			continue
+		}
+		host := strings.SplitN(*repo.RepositoryUri, "/", 2)[0]
+		hosts[host] = struct{}{}
+	}
+	if len(hosts) == 0 {
+		return true
+	}
+	for _, imageRef := range imageRefs {
+		host := strings.SplitN(imageRef, "/", 2)[0]
+		if _, ok := hosts[host]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -2,24 +2,42 @@ package prune
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/dollarshaveclub/thermite/pkg/journal"
+	"github.com/dollarshaveclub/thermite/pkg/ledger"
+	"github.com/dollarshaveclub/thermite/pkg/store"
 	"github.com/google/go-cmp/cmp"
 )
 
 type mockedClient struct {
 	ecriface.ECRAPI
-	Repositories                 []*ecr.Repository
-	TagsByResourceARN            map[string][]*ecr.Tag
-	ImageDetailsByRepositoryName map[string][]*ecr.ImageDetail
-	deletedCount                 int
+	RegistryID                    string
+	CallerRegistryID              string
+	Repositories                  []*ecr.Repository
+	TagsByResourceARN             map[string][]*ecr.Tag
+	ImageDetailsByRepositoryName  map[string][]*ecr.ImageDetail
+	ManifestsByDigest             map[string]string
+	FindingSeverityCountsByDigest map[string]map[string]*int64
+	LifecyclePolicyByName         map[string]string
+	PreviewResultsByName          map[string][]*ecr.LifecyclePolicyPreviewResult
+	ReplicationConfiguration      *ecr.ReplicationConfiguration
+	PullThroughCacheRules         []*ecr.PullThroughCacheRule
+	PullThroughCacheRulesErr      error
+	deletedCount                  int
+	deletedImageIDs               []*ecr.ImageIdentifier
+	putImageIDs                   []*ecr.ImageIdentifier
 }
 
 func (m mockedClient) DescribeRepositoriesWithContext(
@@ -33,8 +51,8 @@ func (m mockedClient) DescribeRepositoriesWithContext(
 	if input.NextToken != nil {
 		return nil, fmt.Errorf("input.NextToken must be nil")
 	}
-	if input.RegistryId != nil {
-		return nil, fmt.Errorf("input.RegistryId must be nil")
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
 	}
 	repositoriesByName := make(map[string]*ecr.Repository, len(m.Repositories))
 	for _, repo := range m.Repositories {
@@ -54,6 +72,9 @@ func (m mockedClient) DescribeRepositoriesWithContext(
 		}
 		repos = append(repos, repo)
 	}
+	if len(repos) < len(input.RepositoryNames) {
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+	}
 	return &ecr.DescribeRepositoriesOutput{
 		Repositories: repos,
 	}, nil
@@ -72,9 +93,10 @@ func (m mockedClient) DescribeRepositoriesPagesWithContext(
 	repos := dro.Repositories
 	if input.MaxResults != nil {
 		for int64(len(repos)) > *input.MaxResults {
-			repos = repos[:*input.MaxResults]
+			page := repos[:*input.MaxResults]
+			repos = repos[*input.MaxResults:]
 			if !fn(&ecr.DescribeRepositoriesOutput{
-				Repositories: repos,
+				Repositories: page,
 			}, false) {
 				return nil
 			}
@@ -124,8 +146,8 @@ func (m mockedClient) DescribeImagesPagesWithContext(
 	if input.NextToken != nil {
 		return fmt.Errorf("input.NextToken must be nil")
 	}
-	if input.RegistryId != nil {
-		return fmt.Errorf("input.RegistryId must be nil")
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
 	}
 	if input.RepositoryName == nil {
 		return fmt.Errorf("input.RepositoryName must not be nil")
@@ -150,6 +172,191 @@ func (m mockedClient) DescribeImagesPagesWithContext(
 	return nil
 }
 
+func (m mockedClient) BatchGetImageWithContext(
+	ctx aws.Context,
+	input *ecr.BatchGetImageInput,
+	opts ...request.Option,
+) (*ecr.BatchGetImageOutput, error) {
+	if opts != nil {
+		return nil, fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if input.RepositoryName == nil {
+		return nil, fmt.Errorf("input.RepositoryName must not be nil")
+	}
+	output := &ecr.BatchGetImageOutput{
+		Failures: []*ecr.ImageFailure{},
+		Images:   []*ecr.Image{},
+	}
+	for _, imageID := range input.ImageIds {
+		if imageID.ImageDigest == nil {
+			return nil, fmt.Errorf("input.ImageIds must contain only non-nil ImageDigest fields")
+		}
+		manifest, ok := m.ManifestsByDigest[*imageID.ImageDigest]
+		if !ok {
+			output.Failures = append(output.Failures, &ecr.ImageFailure{
+				FailureCode:   aws.String(ecr.ImageFailureCodeImageNotFound),
+				FailureReason: aws.String("image not found"),
+				ImageId:       imageID,
+			})
+			continue
+		}
+		output.Images = append(output.Images, &ecr.Image{
+			ImageId:        imageID,
+			ImageManifest:  aws.String(manifest),
+			RepositoryName: input.RepositoryName,
+		})
+	}
+	return output, nil
+}
+
+func (m mockedClient) DescribeImageScanFindingsWithContext(
+	ctx aws.Context,
+	input *ecr.DescribeImageScanFindingsInput,
+	opts ...request.Option,
+) (*ecr.DescribeImageScanFindingsOutput, error) {
+	if opts != nil {
+		return nil, fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if input.RepositoryName == nil {
+		return nil, fmt.Errorf("input.RepositoryName must not be nil")
+	}
+	if input.ImageId == nil || input.ImageId.ImageDigest == nil {
+		return nil, fmt.Errorf("input.ImageId.ImageDigest must not be nil")
+	}
+	counts, ok := m.FindingSeverityCountsByDigest[*input.ImageId.ImageDigest]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeScanNotFoundException, "scan not found", nil)
+	}
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageId: input.ImageId,
+		ImageScanFindings: &ecr.ImageScanFindings{
+			FindingSeverityCounts: counts,
+		},
+		RepositoryName: input.RepositoryName,
+	}, nil
+}
+
+func (m mockedClient) GetLifecyclePolicyWithContext(
+	ctx aws.Context,
+	input *ecr.GetLifecyclePolicyInput,
+	opts ...request.Option,
+) (*ecr.GetLifecyclePolicyOutput, error) {
+	if opts != nil {
+		return nil, fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if input.RepositoryName == nil {
+		return nil, fmt.Errorf("input.RepositoryName must not be nil")
+	}
+	text, ok := m.LifecyclePolicyByName[*input.RepositoryName]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "lifecycle policy not found", nil)
+	}
+	return &ecr.GetLifecyclePolicyOutput{
+		LifecyclePolicyText: aws.String(text),
+		RepositoryName:      input.RepositoryName,
+	}, nil
+}
+
+func (m mockedClient) StartLifecyclePolicyPreviewWithContext(
+	ctx aws.Context,
+	input *ecr.StartLifecyclePolicyPreviewInput,
+	opts ...request.Option,
+) (*ecr.StartLifecyclePolicyPreviewOutput, error) {
+	if opts != nil {
+		return nil, fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if input.RepositoryName == nil {
+		return nil, fmt.Errorf("input.RepositoryName must not be nil")
+	}
+	if _, ok := m.LifecyclePolicyByName[*input.RepositoryName]; input.LifecyclePolicyText == nil && !ok {
+		return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "lifecycle policy not found", nil)
+	}
+	if _, ok := m.PreviewResultsByName[*input.RepositoryName]; !ok {
+		return nil, fmt.Errorf("repository with name %s not found", *input.RepositoryName)
+	}
+	return &ecr.StartLifecyclePolicyPreviewOutput{
+		LifecyclePolicyText: input.LifecyclePolicyText,
+		RepositoryName:      input.RepositoryName,
+		Status:              aws.String(ecr.LifecyclePolicyPreviewStatusInProgress),
+	}, nil
+}
+
+func (m mockedClient) GetLifecyclePolicyPreviewPagesWithContext(
+	ctx aws.Context,
+	input *ecr.GetLifecyclePolicyPreviewInput,
+	fn func(*ecr.GetLifecyclePolicyPreviewOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if opts != nil {
+		return fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if input.RepositoryName == nil {
+		return fmt.Errorf("input.RepositoryName must not be nil")
+	}
+	results, ok := m.PreviewResultsByName[*input.RepositoryName]
+	if !ok {
+		return fmt.Errorf("repository with name %s not found", *input.RepositoryName)
+	}
+	fn(&ecr.GetLifecyclePolicyPreviewOutput{
+		PreviewResults: results,
+		RepositoryName: input.RepositoryName,
+		Status:         aws.String(ecr.LifecyclePolicyPreviewStatusComplete),
+	}, true)
+	return nil
+}
+
+func (m mockedClient) DescribePullThroughCacheRulesPagesWithContext(
+	ctx aws.Context,
+	input *ecr.DescribePullThroughCacheRulesInput,
+	fn func(*ecr.DescribePullThroughCacheRulesOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if opts != nil {
+		return fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if m.PullThroughCacheRulesErr != nil {
+		return m.PullThroughCacheRulesErr
+	}
+	fn(&ecr.DescribePullThroughCacheRulesOutput{PullThroughCacheRules: m.PullThroughCacheRules}, true)
+	return nil
+}
+
+func (m mockedClient) DescribeRegistryWithContext(
+	ctx aws.Context,
+	input *ecr.DescribeRegistryInput,
+	opts ...request.Option,
+) (*ecr.DescribeRegistryOutput, error) {
+	if opts != nil {
+		return nil, fmt.Errorf("opts must be nil")
+	}
+	registryID := m.RegistryID
+	if m.CallerRegistryID != "" {
+		registryID = m.CallerRegistryID
+	}
+	return &ecr.DescribeRegistryOutput{
+		RegistryId:               aws.String(registryID),
+		ReplicationConfiguration: m.ReplicationConfiguration,
+	}, nil
+}
+
 func (m *mockedClient) BatchDeleteImageWithContext(
 	ctx aws.Context,
 	input *ecr.BatchDeleteImageInput,
@@ -158,18 +365,19 @@ func (m *mockedClient) BatchDeleteImageWithContext(
 	if opts != nil {
 		return nil, fmt.Errorf("opts must be nil")
 	}
-	if input.RegistryId != nil {
-		return nil, fmt.Errorf("input.RegistryId must be nil")
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
 	}
 	if input.RepositoryName == nil {
 		return nil, fmt.Errorf("input.RepositoryName must not be nil")
 	}
 	deletedImageIDs := make([]*ecr.ImageIdentifier, 0, len(input.ImageIds))
 	for _, imageID := range input.ImageIds {
-		if imageID.ImageTag == nil || imageID.ImageDigest != nil {
-			return nil, fmt.Errorf("input.ImageIds must contain only non-nil ImageTag fields")
+		if (imageID.ImageTag == nil) == (imageID.ImageDigest == nil) {
+			return nil, fmt.Errorf("input.ImageIds must contain exactly one of ImageTag and ImageDigest")
 		}
 		deletedImageIDs = append(deletedImageIDs, imageID)
+		m.deletedImageIDs = append(m.deletedImageIDs, imageID)
 		m.deletedCount++
 	}
 	return &ecr.BatchDeleteImageOutput{
@@ -182,6 +390,36 @@ func (m mockedClient) DeletedCount() int {
 	return m.deletedCount
 }
 
+func (m *mockedClient) PutImageWithContext(
+	ctx aws.Context,
+	input *ecr.PutImageInput,
+	opts ...request.Option,
+) (*ecr.PutImageOutput, error) {
+	if opts != nil {
+		return nil, fmt.Errorf("opts must be nil")
+	}
+	if aws.StringValue(input.RegistryId) != m.RegistryID {
+		return nil, fmt.Errorf("input.RegistryId must be %q", m.RegistryID)
+	}
+	if input.RepositoryName == nil {
+		return nil, fmt.Errorf("input.RepositoryName must not be nil")
+	}
+	if input.ImageDigest == nil || input.ImageManifest == nil {
+		return nil, fmt.Errorf("input.ImageDigest and input.ImageManifest must not be nil")
+	}
+	if manifest := m.ManifestsByDigest[*input.ImageDigest]; manifest != *input.ImageManifest {
+		return nil, fmt.Errorf("input.ImageManifest must be the manifest of %s", *input.ImageDigest)
+	}
+	m.putImageIDs = append(m.putImageIDs, &ecr.ImageIdentifier{ImageDigest: input.ImageDigest, ImageTag: input.ImageTag})
+	return &ecr.PutImageOutput{
+		Image: &ecr.Image{
+			ImageId:        &ecr.ImageIdentifier{ImageDigest: input.ImageDigest, ImageTag: input.ImageTag},
+			ImageManifest:  input.ImageManifest,
+			RepositoryName: input.RepositoryName,
+		},
+	}, nil
+}
+
 func TestGarbageCollector_PruneAllRepos(t *testing.T) {
 	until := time.Now().UTC()
 	tests := []struct {
@@ -382,6 +620,69 @@ func TestGarbageCollector_PruneAllRepos(t *testing.T) {
 			},
 			DeletedCount: 0,
 		},
+		{
+			Name: "WithKeepCount",
+			Repositories: []*ecr.Repository{
+				{
+					RepositoryArn: aws.String(
+						"arn:aws:ecr:us-east-1:000123456789:repository/thermite",
+					),
+					RepositoryName: aws.String("thermite"),
+					RepositoryUri: aws.String(
+						"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite",
+					),
+				},
+			},
+			TagsByResourceARN: map[string][]*ecr.Tag{
+				"arn:aws:ecr:us-east-1:000123456789:repository/thermite": {
+					{
+						Key:   aws.String("thermite:prune-period"),
+						Value: aws.String("30"),
+					},
+					{
+						Key:   aws.String("thermite:keep-count"),
+						Value: aws.String("2"),
+					},
+				},
+			},
+			ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+				"thermite": {
+					{
+						ImagePushedAt: aws.Time(until.Add(-90 * 24 * time.Hour)),
+						ImageTags: []*string{
+							aws.String("0437aec133abca7f3d054a5be48dde8ed9b2af22"),
+						},
+					},
+					{
+						ImagePushedAt: aws.Time(until.Add(-80 * 24 * time.Hour)),
+						ImageTags: []*string{
+							aws.String("878d0cb2b7e6f6017c096fa613b1b521b95325a6"),
+						},
+					},
+					{
+						ImagePushedAt: aws.Time(until.Add(-70 * 24 * time.Hour)),
+						ImageTags: []*string{
+							aws.String("5379a3dcddb42eb007a68ea7990c643066263fb8"),
+						},
+					},
+					{
+						ImagePushedAt: aws.Time(until.Add(-60 * 24 * time.Hour)),
+						ImageTags: []*string{
+							aws.String("d1b0b4f2c3a9e8f7d6c5b4a3928170605f4e3d2c"),
+						},
+					},
+				},
+			},
+			Opts:  []Option{WithRemoveImages()},
+			Until: until,
+			Excluded: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+			},
+			Pruned: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+			},
+			DeletedCount: 1,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
@@ -414,3 +715,2535 @@ func TestGarbageCollector_PruneAllRepos(t *testing.T) {
 		})
 	}
 }
+
+func TestGarbageCollector_PruneAllReposWithoutRegistryExclusions(t *testing.T) {
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn: aws.String(
+					"arn:aws:ecr:us-east-1:000123456789:repository/thermite",
+				),
+				RepositoryName: aws.String("thermite"),
+				RepositoryUri: aws.String(
+					"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite",
+				),
+			},
+		},
+	}
+	// Allowing zero exclusions does not also allow exclusions that all
+	// belong to other registries.
+	for _, opts := range [][]Option{
+		{WithRemoveImages()},
+		{WithRemoveImages(), WithAllowZeroExclusions()},
+	} {
+		gc, err := NewClient(client, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = gc.PruneAllRepos(
+			context.Background(),
+			time.Now().UTC(),
+			"dollarshaveclub/thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+		)
+		if !errors.Is(err, ErrNoRegistryExclusions) {
+			t.Fatalf("expected ErrNoRegistryExclusions, got %v", err)
+		}
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithRules(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn: aws.String(
+					"arn:aws:ecr:us-east-1:000123456789:repository/web",
+				),
+				RepositoryName: aws.String("web"),
+				RepositoryUri: aws.String(
+					"000123456789.dkr.ecr.us-east-1.amazonaws.com/web",
+				),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/web": {
+				{
+					Key:   aws.String("thermite:prune-period"),
+					Value: aws.String("30"),
+				},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				{ImagePushedAt: daysAgo(10), ImageTags: []*string{aws.String("pr-1234-0437aec")}},
+				{ImagePushedAt: daysAgo(3), ImageTags: []*string{aws.String("pr-1235-878d0cb")}},
+				{ImagePushedAt: daysAgo(30), ImageTags: []*string{aws.String("main-5379a3d")}},
+				{ImagePushedAt: daysAgo(90), ImageTags: []*string{aws.String("main-0437aec")}},
+				{ImagePushedAt: daysAgo(400), ImageTags: []*string{aws.String("v1.2.3")}},
+				{ImagePushedAt: daysAgo(400), ImageTags: []*string{aws.String("pr-1000-878d0cb"), aws.String("v1.0.0")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("feature-x")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("deployed")}},
+			},
+		},
+	}
+	gc, err := NewClient(
+		client,
+		WithRemoveImages(),
+		WithRepoRules(map[string][]Rule{
+			"web": {
+				{Name: "pull-requests", Glob: "pr-*", Period: 7},
+				{Name: "main", Regexp: `^main-[0-9a-f]{7,40}$`, Period: 60},
+				{Name: "releases", Regexp: `^v\d+\.\d+\.\d+$`, Never: true},
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(
+		context.Background(),
+		"web",
+		until,
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:feature-x",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:main-0437aec",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:pr-1234-0437aec",
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := NewClient(client, WithRepoRules(map[string][]Rule{
+		"web": {{Name: "invalid", Glob: "pr-*", Regexp: "^pr-"}},
+	})); err == nil {
+		t.Fatal("expected error creating Client with invalid rule")
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithProtectedTags(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/web"),
+				RepositoryName: aws.String("web"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/web"),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/web": {
+				{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+				{Key: aws.String("thermite:protect-tags"), Value: aws.String("latest  release-*")},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("latest"), aws.String("main-1")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("release-2022")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("stable")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("main-2")}},
+			},
+		},
+	}
+	gc, err := NewClient(client, WithAllowZeroExclusions(), WithProtectedTags("stable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(context.Background(), "web", until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:main-2"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	policy, _, _, err := gc.EffectivePolicy(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"stable", "latest", "release-*"}, policy.ProtectTags); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := NewClient(client, WithProtectedTags("release-[")); err == nil {
+		t.Fatal("expected error creating Client with invalid protected tag pattern")
+	}
+}
+
+func TestGarbageCollector_PruneRepoUntagged(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	tests := []struct {
+		Name   string
+		Tags   []*ecr.Tag
+		Pruned []string
+	}{
+		{
+			Name: "",
+			Tags: []*ecr.Tag{
+				{
+					Key:   aws.String("thermite:untagged-period"),
+					Value: aws.String("7"),
+				},
+			},
+			Pruned: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+			},
+		},
+		{
+			Name: "WithPrunePeriod",
+			Tags: []*ecr.Tag{
+				{
+					Key:   aws.String("thermite:prune-period"),
+					Value: aws.String("30"),
+				},
+				{
+					Key:   aws.String("thermite:untagged-period"),
+					Value: aws.String("7"),
+				},
+			},
+			Pruned: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:main-5379a3d",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+			},
+		},
+		{
+			Name: "WithoutUntaggedPeriod",
+			Tags: []*ecr.Tag{
+				{
+					Key:   aws.String("thermite:prune-period"),
+					Value: aws.String("30"),
+				},
+			},
+			Pruned: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:main-5379a3d",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := &mockedClient{
+				Repositories: []*ecr.Repository{
+					{
+						RepositoryArn: aws.String(
+							"arn:aws:ecr:us-east-1:000123456789:repository/web",
+						),
+						RepositoryName: aws.String("web"),
+						RepositoryUri: aws.String(
+							"000123456789.dkr.ecr.us-east-1.amazonaws.com/web",
+						),
+					},
+				},
+				TagsByResourceARN: map[string][]*ecr.Tag{
+					"arn:aws:ecr:us-east-1:000123456789:repository/web": test.Tags,
+				},
+				ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+					"web": {
+						{
+							ImageDigest:   aws.String("sha256:0437aec133abca7f3d054a5be48dde8ed9b2af22"),
+							ImagePushedAt: daysAgo(10),
+						},
+						{
+							ImageDigest:   aws.String("sha256:878d0cb2b7e6f6017c096fa613b1b521b95325a6"),
+							ImagePushedAt: daysAgo(3),
+						},
+						{
+							ImageDigest:   aws.String("sha256:5379a3d5b8c4f1e0a9d2c6b7e8f90123456789ab"),
+							ImagePushedAt: daysAgo(100),
+						},
+						{
+							ImageDigest:   aws.String("sha256:9a1b2c3d4e5f60718293a4b5c6d7e8f901234567"),
+							ImagePushedAt: daysAgo(100),
+							ImageTags:     []*string{aws.String("main-5379a3d")},
+						},
+					},
+				},
+			}
+			gc, err := NewClient(client, WithRemoveImages())
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gc.PruneRepo(
+				context.Background(),
+				"web",
+				until,
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:5379a3d5b8c4f1e0a9d2c6b7e8f90123456789ab",
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.Pruned, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_PruneRepoByDigest(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	for _, removeImages := range []bool{false, true} {
+		t.Run(fmt.Sprintf("RemoveImages=%t", removeImages), func(t *testing.T) {
+			client := &mockedClient{
+				Repositories: []*ecr.Repository{
+					{
+						RepositoryArn: aws.String(
+							"arn:aws:ecr:us-east-1:000123456789:repository/web",
+						),
+						RepositoryName: aws.String("web"),
+						RepositoryUri: aws.String(
+							"000123456789.dkr.ecr.us-east-1.amazonaws.com/web",
+						),
+					},
+				},
+				TagsByResourceARN: map[string][]*ecr.Tag{
+					"arn:aws:ecr:us-east-1:000123456789:repository/web": {
+						{
+							Key:   aws.String("thermite:prune-period"),
+							Value: aws.String("30"),
+						},
+					},
+				},
+				ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+					"web": {
+						{
+							ImageDigest:      aws.String("sha256:0437aec133abca7f3d054a5be48dde8ed9b2af22"),
+							ImagePushedAt:    daysAgo(100),
+							ImageSizeInBytes: aws.Int64(1000),
+							ImageTags:        []*string{aws.String("main-0437aec"), aws.String("v1.0.0")},
+						},
+						{
+							ImageDigest:      aws.String("sha256:878d0cb2b7e6f6017c096fa613b1b521b95325a6"),
+							ImagePushedAt:    daysAgo(100),
+							ImageSizeInBytes: aws.Int64(200),
+							ImageTags:        []*string{aws.String("main-878d0cb")},
+						},
+						{
+							ImageDigest:      aws.String("sha256:5379a3d5b8c4f1e0a9d2c6b7e8f90123456789ab"),
+							ImagePushedAt:    daysAgo(3),
+							ImageSizeInBytes: aws.Int64(30),
+							ImageTags:        []*string{aws.String("main-5379a3d")},
+						},
+					},
+				},
+			}
+			opts := []Option{WithDeleteByDigest(), WithAllowZeroExclusions()}
+			if removeImages {
+				opts = append(opts, WithRemoveImages())
+			}
+			gc, err := NewClient(client, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gc.PruneRepo(context.Background(), "web", until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:main-0437aec",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:main-878d0cb",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:v1.0.0",
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatal(diff)
+			}
+			wantDeletedCount := 0
+			if removeImages {
+				wantDeletedCount = 2
+			}
+			if deletedCount := client.DeletedCount(); deletedCount != wantDeletedCount {
+				t.Fatalf("expected %d deleted images, got %d", wantDeletedCount, deletedCount)
+			}
+		})
+	}
+}
+
+func TestWhitelist_ExcludesImage(t *testing.T) {
+	uri := "000123456789.dkr.ecr.us-east-1.amazonaws.com/foo"
+	imageDetail := &ecr.ImageDetail{
+		ImageDigest: aws.String("sha256:0437aec"),
+		ImageTags:   aws.StringSlice([]string{"v1.0.0"}),
+	}
+	tests := []struct {
+		Name     string
+		Excluded []string
+		Want     bool
+	}{
+		{
+			Name:     "Tag",
+			Excluded: []string{uri + ":v1.0.0"},
+			Want:     true,
+		},
+		{
+			Name:     "Digest",
+			Excluded: []string{uri + "@sha256:0437aec"},
+			Want:     true,
+		},
+		{
+			Name:     "TagAndDigest",
+			Excluded: []string{uri + ":v2.0.0@sha256:0437aec"},
+			Want:     true,
+		},
+		{
+			Name:     "OtherRepositoryWithPrefix",
+			Excluded: []string{uri + "bar@sha256:0437aec", uri + "bar:v1.0.0"},
+		},
+		{
+			Name:     "OtherDigest",
+			Excluded: []string{uri + "@sha256:878d0cb"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if got := newWhitelist(test.Excluded...).ExcludesImage(uri, imageDetail); got != test.Want {
+				t.Fatalf("expected %t, got %t", test.Want, got)
+			}
+		})
+	}
+}
+
+func TestReclaimedBytes(t *testing.T) {
+	imagesByDigest := map[string]*ecr.ImageDetail{
+		"sha256:0437aec": {ImageSizeInBytes: aws.Int64(1000)},
+		"sha256:878d0cb": {ImageSizeInBytes: aws.Int64(200)},
+		"sha256:5379a3d": {},
+	}
+	imageIDs := []*ecr.ImageIdentifier{
+		{ImageDigest: aws.String("sha256:0437aec"), ImageTag: aws.String("main-0437aec")},
+		{ImageDigest: aws.String("sha256:0437aec"), ImageTag: aws.String("v1.0.0")},
+		{ImageDigest: aws.String("sha256:878d0cb")},
+		{ImageDigest: aws.String("sha256:5379a3d")},
+		{ImageDigest: aws.String("sha256:9a1b2c3"), ImageTag: aws.String("untagged-only")},
+		{ImageTag: aws.String("main-9a1b2c3")},
+	}
+	if got, want := reclaimedBytes(imageIDs, imagesByDigest), int64(1200); got != want {
+		t.Fatalf("expected %d reclaimed bytes, got %d", want, got)
+	}
+}
+
+func TestResolveIndexes(t *testing.T) {
+	image := func(digest string, tags ...string) *ecr.ImageDetail {
+		return &ecr.ImageDetail{ImageDigest: aws.String(digest), ImageTags: aws.StringSlice(tags)}
+	}
+	index, amd64, arm64, shared, single := image("index", "v1"), image("amd64"), image("arm64"), image("shared"), image("single", "v2")
+	otherIndex := image("other-index")
+	images := []*ecr.ImageDetail{index, amd64, arm64, shared, single, otherIndex}
+	type result struct {
+		Digest string
+		Prune  bool
+		Rule   string
+	}
+	tests := []struct {
+		Name      string
+		Decisions []decision
+		Children  map[string][]string
+		Want      []result
+	}{
+		{
+			Name: "KeptIndex",
+			Decisions: []decision{
+				{imageDetail: index, rule: DeployedRuleName},
+				{imageDetail: amd64, prune: true, rule: UntaggedRuleName},
+				{imageDetail: single, prune: true, rule: DefaultRuleName},
+			},
+			Children: map[string][]string{"index": {"amd64", "arm64"}},
+			Want: []result{
+				{Digest: "index", Rule: DeployedRuleName},
+				{Digest: "amd64", Rule: IndexRuleName},
+				{Digest: "single", Prune: true, Rule: DefaultRuleName},
+			},
+		},
+		{
+			Name: "PrunedIndex",
+			Decisions: []decision{
+				{imageDetail: index, prune: true, rule: DefaultRuleName},
+				{imageDetail: single, rule: DefaultRuleName},
+			},
+			Children: map[string][]string{
+				"index":       {"amd64", "arm64", "shared"},
+				"other-index": {"shared"},
+			},
+			Want: []result{
+				{Digest: "index", Prune: true, Rule: DefaultRuleName},
+				{Digest: "single", Rule: DefaultRuleName},
+				{Digest: "amd64", Prune: true, Rule: IndexRuleName},
+				{Digest: "arm64", Prune: true, Rule: IndexRuleName},
+			},
+		},
+		{
+			Name: "PrunedIndexWithDeployedChild",
+			Decisions: []decision{
+				{imageDetail: index, prune: true, rule: DefaultRuleName},
+				{imageDetail: arm64, rule: DeployedRuleName},
+			},
+			Children: map[string][]string{"index": {"amd64", "arm64"}},
+			Want: []result{
+				{Digest: "index", Prune: true, Rule: DefaultRuleName},
+				{Digest: "arm64", Rule: DeployedRuleName},
+				{Digest: "amd64", Prune: true, Rule: IndexRuleName},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got := []result{}
+			for _, d := range resolveIndexes(test.Decisions, images, test.Children) {
+				got = append(got, result{Digest: *d.imageDetail.ImageDigest, Prune: d.prune, Rule: d.rule})
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithIndex(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn: aws.String(
+					"arn:aws:ecr:us-east-1:000123456789:repository/web",
+				),
+				RepositoryName: aws.String("web"),
+				RepositoryUri: aws.String(
+					"000123456789.dkr.ecr.us-east-1.amazonaws.com/web",
+				),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/web": {
+				{
+					Key:   aws.String("thermite:prune-period"),
+					Value: aws.String("30"),
+				},
+				{
+					Key:   aws.String("thermite:untagged-period"),
+					Value: aws.String("1"),
+				},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				{ImageDigest: aws.String("sha256:old-amd64"), ImagePushedAt: daysAgo(100)},
+				{ImageDigest: aws.String("sha256:old-arm64"), ImagePushedAt: daysAgo(100)},
+				{
+					ImageDigest:            aws.String("sha256:old"),
+					ImageManifestMediaType: aws.String(ociImageIndexMediaType),
+					ImagePushedAt:          daysAgo(100),
+					ImageTags:              []*string{aws.String("old")},
+				},
+				{ImageDigest: aws.String("sha256:deployed-amd64"), ImagePushedAt: daysAgo(100)},
+				{
+					ImageDigest:            aws.String("sha256:deployed"),
+					ImageManifestMediaType: aws.String(dockerManifestListMediaType),
+					ImagePushedAt:          daysAgo(100),
+					ImageTags:              []*string{aws.String("deployed")},
+				},
+			},
+		},
+		ManifestsByDigest: map[string]string{
+			"sha256:old":      `{"schemaVersion":2,"manifests":[{"digest":"sha256:old-amd64"},{"digest":"sha256:old-arm64"}]}`,
+			"sha256:deployed": `{"schemaVersion":2,"manifests":[{"digest":"sha256:deployed-amd64"}]}`,
+		},
+	}
+	gc, err := NewClient(client, WithRemoveImages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(
+		context.Background(),
+		"web",
+		until,
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:old",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:old-amd64",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:old-arm64",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	delete(client.ManifestsByDigest, "sha256:old")
+	if _, err := gc.PruneRepo(
+		context.Background(),
+		"web",
+		until,
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed",
+	); err == nil {
+		t.Fatal("expected error pruning repository with unreadable index")
+	}
+}
+
+func TestPolicy_DecideWithPullWindow(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	images := []*ecr.ImageDetail{
+		{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("pulled")}, LastRecordedPullTime: daysAgo(2)},
+		{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("stale")}, LastRecordedPullTime: daysAgo(60)},
+		{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("never")}},
+		{ImagePushedAt: daysAgo(100), ImageDigest: aws.String("sha256:untagged"), LastRecordedPullTime: daysAgo(1)},
+		{ImagePushedAt: daysAgo(3), ImageTags: []*string{aws.String("new")}, LastRecordedPullTime: daysAgo(1)},
+	}
+	type result struct {
+		Prune bool
+		Rule  string
+	}
+	tests := []struct {
+		Name       string
+		PullWindow int
+		Want       []result
+	}{
+		{
+			Name: "",
+			Want: []result{
+				{Prune: true, Rule: DefaultRuleName},
+				{Prune: true, Rule: DefaultRuleName},
+				{Prune: true, Rule: DefaultRuleName},
+				{Prune: true, Rule: UntaggedRuleName},
+				{Rule: DefaultRuleName},
+			},
+		},
+		{
+			Name:       "WithPullWindow",
+			PullWindow: 30,
+			Want: []result{
+				{Rule: PulledRuleName},
+				{Prune: true, Rule: DefaultRuleName},
+				{Prune: true, Rule: DefaultRuleName},
+				{Rule: PulledRuleName},
+				{Rule: DefaultRuleName},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			policy := Policy{Period: Period{Days: 30}, UntaggedPeriod: 7, PullWindow: test.PullWindow}
+			got := []result{}
+			for _, d := range policy.decide("000123456789.dkr.ecr.us-east-1.amazonaws.com/web", images, until, newWhitelist()) {
+				got = append(got, result{Prune: d.prune, Rule: d.rule})
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		Tag     string
+		Version string
+		OK      bool
+	}{
+		{Tag: "1.2.3", Version: "1.2.3", OK: true},
+		{Tag: "v1.2.3", Version: "1.2.3", OK: true},
+		{Tag: "v1.2.3-rc.1", Version: "1.2.3-rc.1", OK: true},
+		{Tag: "v1.2.3+build.5", Version: "1.2.3", OK: true},
+		{Tag: "v1.2"},
+		{Tag: "v01.2.3"},
+		{Tag: "v1.2.3-"},
+		{Tag: "v1.2.3-rc..1"},
+		{Tag: "main-0437aec"},
+	}
+	for _, test := range tests {
+		t.Run(test.Tag, func(t *testing.T) {
+			v, ok := parseVersion(test.Tag)
+			if ok != test.OK {
+				t.Fatalf("expected ok %t, got %t", test.OK, ok)
+			}
+			if ok && v.String() != test.Version {
+				t.Fatalf("expected version %s, got %s", test.Version, v)
+			}
+		})
+	}
+	// Precedence example from the Semantic Versioning 2.0.0 specification.
+	ordered := []string{
+		"1.0.0-alpha",
+		"1.0.0-alpha.1",
+		"1.0.0-alpha.beta",
+		"1.0.0-beta",
+		"1.0.0-beta.2",
+		"1.0.0-beta.11",
+		"1.0.0-rc.1",
+		"1.0.0",
+		"1.0.1",
+		"1.1.0",
+		"2.0.0",
+	}
+	for i := 1; i < len(ordered); i++ {
+		lower, _ := parseVersion(ordered[i-1])
+		higher, _ := parseVersion(ordered[i])
+		if lower.compare(higher) != -1 || higher.compare(lower) != 1 {
+			t.Fatalf("expected %s to have lower precedence than %s", lower, higher)
+		}
+	}
+}
+
+func TestPolicy_DecideWithSemver(t *testing.T) {
+	until := time.Now().UTC()
+	tags := []string{
+		"v3.0.0",
+		"v2.2.1", "v2.2.0",
+		"v2.1.4", "v2.1.3", "v2.1.2", "v2.1.1",
+		"v2.0.0",
+		"v1.9.9", "v1.9.8",
+		"v1.5.0-rc.1",
+		"v2.3.0-rc.1",
+		"nightly",
+	}
+	images := make([]*ecr.ImageDetail, 0, len(tags))
+	for _, tag := range tags {
+		images = append(images, &ecr.ImageDetail{
+			ImagePushedAt: aws.Time(until.Add(-100 * 24 * time.Hour)),
+			ImageTags:     []*string{aws.String(tag)},
+		})
+	}
+	tests := []struct {
+		Name   string
+		Semver SemverRetention
+		Kept   []string
+	}{
+		{
+			Name:   "MinorsAndPatches",
+			Semver: SemverRetention{Minors: 3, Patches: 3},
+			Kept:   []string{"v3.0.0", "v2.2.1", "v2.2.0", "v2.1.4", "v2.1.3", "v2.1.2"},
+		},
+		{
+			Name:   "NewestPerMajor",
+			Semver: SemverRetention{NewestPerMajor: true},
+			Kept:   []string{"v3.0.0", "v2.2.1", "v1.9.9"},
+		},
+		{
+			Name:   "Prereleases",
+			Semver: SemverRetention{Minors: 1, Patches: 1, Prereleases: true},
+			Kept:   []string{"v3.0.0"},
+		},
+		{
+			Name:   "PrereleasesNewest",
+			Semver: SemverRetention{Minors: 2, Prereleases: true},
+			Kept:   []string{"v3.0.0", "v2.3.0-rc.1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			semver := test.Semver
+			rules, err := compileRules([]Rule{{Name: "releases", Semver: &semver}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Tags that the rule does not match fall back to the prune
+			// period, which keeps them.
+			policy := Policy{Period: Period{Days: 200}, Rules: rules}
+			got := []string{}
+			for _, d := range policy.decide("000123456789.dkr.ecr.us-east-1.amazonaws.com/web", images, until, newWhitelist()) {
+				if !d.prune {
+					got = append(got, *d.imageDetail.ImageTags[0])
+				}
+			}
+			want := append(append([]string{}, test.Kept...), "nightly")
+			if !test.Semver.Prereleases {
+				want = append(want, "v1.5.0-rc.1", "v2.3.0-rc.1")
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithSeverityPeriods(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	image := func(tag string, days int) *ecr.ImageDetail {
+		return &ecr.ImageDetail{
+			ImageDigest:   aws.String("sha256:" + tag),
+			ImagePushedAt: daysAgo(days),
+			ImageTags:     []*string{aws.String(tag)},
+		}
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn: aws.String(
+					"arn:aws:ecr:us-east-1:000123456789:repository/web",
+				),
+				RepositoryName: aws.String("web"),
+				RepositoryUri: aws.String(
+					"000123456789.dkr.ecr.us-east-1.amazonaws.com/web",
+				),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/web": {
+				{
+					Key:   aws.String("thermite:prune-period"),
+					Value: aws.String("90"),
+				},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				image("critical", 10),
+				image("critical-new", 3),
+				image("critical-deployed", 10),
+				image("high", 10),
+				image("high-old", 40),
+				image("medium", 40),
+				image("unscanned", 40),
+				image("old", 100),
+			},
+		},
+		FindingSeverityCountsByDigest: map[string]map[string]*int64{
+			"sha256:critical":          {"CRITICAL": aws.Int64(2), "HIGH": aws.Int64(5)},
+			"sha256:critical-new":      {"CRITICAL": aws.Int64(1)},
+			"sha256:critical-deployed": {"CRITICAL": aws.Int64(1)},
+			"sha256:high":              {"HIGH": aws.Int64(1), "CRITICAL": aws.Int64(0)},
+			"sha256:high-old":          {"HIGH": aws.Int64(1)},
+			"sha256:medium":            {"MEDIUM": aws.Int64(9)},
+		},
+	}
+	gc, err := NewClient(client, WithSeverityPeriods(map[string]int{
+		"CRITICAL": 7,
+		"HIGH":     30,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(
+		context.Background(),
+		"web",
+		until,
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:critical-deployed",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:critical",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:high-old",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:old",
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := NewClient(client, WithSeverityPeriods(map[string]int{"SEVERE": 7})); err == nil {
+		t.Fatal("expected error creating Client with unknown severity")
+	}
+}
+
+func TestFormatFindings(t *testing.T) {
+	imageDetail := &ecr.ImageDetail{
+		ImageScanFindingsSummary: &ecr.ImageScanFindingsSummary{
+			FindingSeverityCounts: map[string]*int64{
+				"HIGH":      aws.Int64(5),
+				"LOW":       aws.Int64(0),
+				"UNDEFINED": aws.Int64(1),
+				"CRITICAL":  aws.Int64(2),
+			},
+		},
+	}
+	if got, want := formatFindings(imageDetail), "CRITICAL=2, HIGH=5, UNDEFINED=1"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestGarbageCollector_EffectivePolicy(t *testing.T) {
+	days := func(n int) *int {
+		return &n
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/team-a/web"),
+				RepositoryName: aws.String("team-a/web"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/web"),
+			},
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/team-b/api"),
+				RepositoryName: aws.String("team-b/api"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/team-b/api"),
+			},
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/base"),
+				RepositoryName: aws.String("base"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/base"),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/team-a/web": {
+				{Key: aws.String("thermite:prune-period"), Value: aws.String("60")},
+			},
+			"arn:aws:ecr:us-east-1:000123456789:repository/team-b/api": {},
+			"arn:aws:ecr:us-east-1:000123456789:repository/base":       {},
+		},
+	}
+	policyFile := PolicyFile{
+		Defaults: PolicySettings{UntaggedPeriod: days(7)},
+		Repositories: []RepositoryPolicy{
+			{
+				Match: "team-a/*",
+				PolicySettings: PolicySettings{
+					Period:    &Period{Days: 30},
+					KeepCount: days(5),
+				},
+			},
+			{
+				Match: "team-*/*",
+				PolicySettings: PolicySettings{
+					Period: &Period{Days: 90},
+					Rules:  []Rule{{Name: "pull-requests", Glob: "pr-*", Period: 7}},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		Name       string
+		Repo       string
+		Precedence string
+		Policy     Policy
+		Match      string
+		OK         bool
+	}{
+		{
+			Name:   "TagsOverFile",
+			Repo:   "team-a/web",
+			Policy: Policy{Period: Period{Days: 60}, KeepCount: 5, UntaggedPeriod: 7},
+			Match:  "team-a/*",
+			OK:     true,
+		},
+		{
+			Name:       "FileOverTags",
+			Repo:       "team-a/web",
+			Precedence: PrecedenceFile,
+			Policy:     Policy{Period: Period{Days: 30}, KeepCount: 5, UntaggedPeriod: 7},
+			Match:      "team-a/*",
+			OK:         true,
+		},
+		{
+			Name: "FirstMatch",
+			Repo: "team-b/api",
+			Policy: Policy{
+				Period:         Period{Days: 90},
+				UntaggedPeriod: 7,
+				Rules:          []Rule{{Name: "pull-requests", Glob: "pr-*", Period: 7}},
+			},
+			Match: "team-*/*",
+			OK:    true,
+		},
+		{
+			Name:   "Defaults",
+			Repo:   "base",
+			Policy: Policy{UntaggedPeriod: 7},
+			OK:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			pf := policyFile
+			pf.Precedence = test.Precedence
+			gc, err := NewClient(client, WithPolicyFile(&pf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy, match, ok, err := gc.EffectivePolicy(context.Background(), test.Repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Policy, policy, cmp.Comparer(func(a, b Rule) bool {
+				return a.Name == b.Name && a.Glob == b.Glob && a.Period == b.Period
+			})); diff != "" {
+				t.Fatal(diff)
+			}
+			if match != test.Match || ok != test.OK {
+				t.Fatalf("expected match %q and ok %t, got %q and %t", test.Match, test.OK, match, ok)
+			}
+		})
+	}
+	for _, invalid := range []PolicyFile{
+		{Precedence: "repository"},
+		{Repositories: []RepositoryPolicy{{PolicySettings: PolicySettings{Period: &Period{Days: 30}}}}},
+		{Repositories: []RepositoryPolicy{{Match: "[", PolicySettings: PolicySettings{Period: &Period{Days: 30}}}}},
+		{Defaults: PolicySettings{Period: &Period{Days: -1}}},
+		{Defaults: PolicySettings{Rules: []Rule{{Name: "no-action", Glob: "*"}}}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("expected error validating %+v", invalid)
+		}
+	}
+}
+
+func TestPolicy_LifecyclePolicy(t *testing.T) {
+	tests := []struct {
+		Name            string
+		Policy          Policy
+		LifecyclePolicy LifecyclePolicy
+		Err             bool
+	}{
+		{
+			Name: "Translatable",
+			Policy: Policy{
+				Period:         Period{Days: 30},
+				UntaggedPeriod: 1,
+				Rules: []Rule{
+					{Name: "releases", Glob: "release-*", KeepCount: 10},
+					{Name: "pull-requests", Glob: "pr-*", Period: 7},
+				},
+			},
+			LifecyclePolicy: LifecyclePolicy{Rules: []LifecycleRule{
+				{
+					RulePriority: 1,
+					Description:  UntaggedRuleName,
+					Selection: LifecycleSelection{
+						TagStatus:   LifecycleTagStatusUntagged,
+						CountType:   LifecycleCountTypeSinceImagePushed,
+						CountUnit:   LifecycleCountUnitDays,
+						CountNumber: 1,
+					},
+					Action: LifecycleAction{Type: LifecycleActionTypeExpire},
+				},
+				{
+					RulePriority: 2,
+					Description:  "releases",
+					Selection: LifecycleSelection{
+						TagStatus:      LifecycleTagStatusTagged,
+						TagPatternList: []string{"release-*"},
+						CountType:      LifecycleCountTypeImageCountMoreThan,
+						CountNumber:    10,
+					},
+					Action: LifecycleAction{Type: LifecycleActionTypeExpire},
+				},
+				{
+					RulePriority: 3,
+					Description:  "pull-requests",
+					Selection: LifecycleSelection{
+						TagStatus:      LifecycleTagStatusTagged,
+						TagPatternList: []string{"pr-*"},
+						CountType:      LifecycleCountTypeSinceImagePushed,
+						CountUnit:      LifecycleCountUnitDays,
+						CountNumber:    7,
+					},
+					Action: LifecycleAction{Type: LifecycleActionTypeExpire},
+				},
+				{
+					RulePriority: 4,
+					Description:  DefaultRuleName,
+					Selection: LifecycleSelection{
+						TagStatus:      LifecycleTagStatusTagged,
+						TagPatternList: []string{"*"},
+						CountType:      LifecycleCountTypeSinceImagePushed,
+						CountUnit:      LifecycleCountUnitDays,
+						CountNumber:    30,
+					},
+					Action: LifecycleAction{Type: LifecycleActionTypeExpire},
+				},
+			}},
+		},
+		{
+			Name:   "Regexp",
+			Policy: Policy{Rules: []Rule{{Name: "pull-requests", Regexp: "^pr-", Period: 7}}},
+			Err:    true,
+		},
+		{
+			Name:   "GlobCharacterClass",
+			Policy: Policy{Rules: []Rule{{Name: "pull-requests", Glob: "pr-[0-9]*", Period: 7}}},
+			Err:    true,
+		},
+		{
+			Name:   "Never",
+			Policy: Policy{Period: Period{Days: 30}, Rules: []Rule{{Name: "releases", Glob: "v*", Never: true}}},
+			Err:    true,
+		},
+		{
+			Name:   "PeriodAndKeepCount",
+			Policy: Policy{Period: Period{Days: 30}, KeepCount: 5},
+			Err:    true,
+		},
+		{
+			Name:   "PullWindow",
+			Policy: Policy{Period: Period{Days: 30}, PullWindow: 14},
+			Err:    true,
+		},
+		{
+			Name: "NothingPruned",
+			Err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			lp, err := test.Policy.LifecyclePolicy()
+			if test.Err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", lp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.LifecyclePolicy, lp); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestLifecyclePolicy_Settings(t *testing.T) {
+	days := func(n int) *int {
+		return &n
+	}
+	tests := []struct {
+		Name     string
+		Text     string
+		Settings PolicySettings
+		Err      bool
+	}{
+		{
+			Name: "Translatable",
+			Text: `{"rules": [
+				{"rulePriority": 20, "selection": {"tagStatus": "any", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 90}, "action": {"type": "expire"}},
+				{"rulePriority": 1, "selection": {"tagStatus": "untagged", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 3}, "action": {"type": "expire"}},
+				{"rulePriority": 2, "selection": {"tagStatus": "tagged", "tagPrefixList": ["release-"], "countType": "imageCountMoreThan", "countNumber": 10}, "action": {"type": "expire"}},
+				{"rulePriority": 3, "selection": {"tagStatus": "tagged", "tagPatternList": ["pr-*-build"], "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 7}, "action": {"type": "expire"}}
+			]}`,
+			Settings: PolicySettings{
+				UntaggedPeriod: days(3),
+				Rules: []Rule{
+					{Name: "lifecycle-2", Glob: "release-*", KeepCount: 10},
+					{Name: "lifecycle-3", Glob: "pr-*-build", Period: 7},
+					{Name: "lifecycle-20", Glob: "*", Period: 90},
+				},
+			},
+		},
+		{
+			Name: "UntaggedKeepCount",
+			Text: `{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "untagged", "countType": "imageCountMoreThan", "countNumber": 3}, "action": {"type": "expire"}}]}`,
+			Err:  true,
+		},
+		{
+			Name: "SeveralPatterns",
+			Text: `{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "tagged", "tagPatternList": ["prod*", "*release"], "countType": "imageCountMoreThan", "countNumber": 3}, "action": {"type": "expire"}}]}`,
+			Err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var lp LifecyclePolicy
+			if err := json.Unmarshal([]byte(test.Text), &lp); err != nil {
+				t.Fatal(err)
+			}
+			settings, err := lp.Settings()
+			if test.Err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", settings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Settings, settings, cmp.Comparer(func(a, b Rule) bool {
+				return a.Name == b.Name && a.Glob == b.Glob && a.Period == b.Period && a.KeepCount == b.KeepCount
+			})); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_CompareLifecyclePolicy(t *testing.T) {
+	until := time.Now().UTC()
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/web"),
+				RepositoryName: aws.String("web"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/web"),
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				{
+					ImageDigest:   aws.String("sha256:1"),
+					ImagePushedAt: aws.Time(until.Add(-40 * 24 * time.Hour)),
+					ImageTags:     aws.StringSlice([]string{"old"}),
+				},
+				{
+					ImageDigest:   aws.String("sha256:2"),
+					ImagePushedAt: aws.Time(until.Add(-20 * 24 * time.Hour)),
+					ImageTags:     aws.StringSlice([]string{"pr-1"}),
+				},
+				{
+					ImageDigest:   aws.String("sha256:3"),
+					ImagePushedAt: aws.Time(until.Add(-10 * 24 * time.Hour)),
+				},
+			},
+		},
+		LifecyclePolicyByName: map[string]string{
+			"web": `{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "any", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 30}, "action": {"type": "expire"}}]}`,
+		},
+		PreviewResultsByName: map[string][]*ecr.LifecyclePolicyPreviewResult{
+			"web": {
+				{
+					Action:              &ecr.LifecyclePolicyRuleAction{Type: aws.String(ecr.ImageActionTypeExpire)},
+					AppliedRulePriority: aws.Int64(1),
+					ImageDigest:         aws.String("sha256:1"),
+					ImageTags:           aws.StringSlice([]string{"old"}),
+				},
+			},
+		},
+	}
+	gc, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lp, ok, err := gc.RepositoryLifecyclePolicy(context.Background(), "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected lifecycle policy")
+	}
+	if _, ok, err := gc.RepositoryLifecyclePolicy(context.Background(), "missing"); err != nil || ok {
+		t.Fatalf("expected no lifecycle policy, got %v, %v", ok, err)
+	}
+	policy := Policy{
+		Period:         Period{Days: 30},
+		UntaggedPeriod: 7,
+		Rules:          []Rule{{Name: "pull-requests", Glob: "pr-*", Period: 14}},
+	}
+	differences, err := gc.CompareLifecyclePolicy(context.Background(), "web", lp, policy, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LifecycleDifference{
+		{
+			ImageRefs: []string{"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:pr-1"},
+			PushedAt:  until.Add(-20 * 24 * time.Hour),
+			Pruned:    true,
+			Rule:      "pull-requests",
+		},
+		{
+			ImageRefs: []string{"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:3"},
+			PushedAt:  until.Add(-10 * 24 * time.Hour),
+			Pruned:    true,
+			Rule:      UntaggedRuleName,
+		},
+	}
+	if diff := cmp.Diff(expected, differences); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestGarbageCollector_AuditLifecyclePolicies(t *testing.T) {
+	until := time.Now().UTC()
+	expire := func(digest string) *ecr.LifecyclePolicyPreviewResult {
+		return &ecr.LifecyclePolicyPreviewResult{
+			Action:              &ecr.LifecyclePolicyRuleAction{Type: aws.String(ecr.ImageActionTypeExpire)},
+			AppliedRulePriority: aws.Int64(1),
+			ImageDigest:         aws.String(digest),
+		}
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/web"),
+				RepositoryName: aws.String("web"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/web"),
+			},
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/api"),
+				RepositoryName: aws.String("api"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/api"),
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				{
+					ImageDigest:   aws.String("sha256:1"),
+					ImagePushedAt: aws.Time(until.Add(-40 * 24 * time.Hour)),
+					ImageTags:     aws.StringSlice([]string{"deployed"}),
+				},
+				{
+					ImageDigest:   aws.String("sha256:2"),
+					ImagePushedAt: aws.Time(until.Add(-40 * 24 * time.Hour)),
+					ImageTags:     aws.StringSlice([]string{"old"}),
+				},
+				{
+					ImageDigest:            aws.String("sha256:3"),
+					ImageManifestMediaType: aws.String(ociImageIndexMediaType),
+					ImagePushedAt:          aws.Time(until.Add(-10 * 24 * time.Hour)),
+					ImageTags:              aws.StringSlice([]string{"multi"}),
+				},
+				{
+					ImageDigest:   aws.String("sha256:4"),
+					ImagePushedAt: aws.Time(until.Add(-10 * 24 * time.Hour)),
+				},
+			},
+			"api": {},
+		},
+		ManifestsByDigest: map[string]string{
+			"sha256:3": `{"manifests": [{"digest": "sha256:4"}]}`,
+		},
+		LifecyclePolicyByName: map[string]string{
+			"web": `{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "any", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 30}, "action": {"type": "expire"}}]}`,
+		},
+		PreviewResultsByName: map[string][]*ecr.LifecyclePolicyPreviewResult{
+			"web": {expire("sha256:1"), expire("sha256:2"), expire("sha256:4")},
+		},
+	}
+	gc, err := NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	violations, err := gc.AuditLifecyclePolicies(
+		context.Background(),
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:multi",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/api:latest",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LifecycleViolation{
+		{
+			Repository:   "web",
+			ImageRefs:    []string{"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed"},
+			PushedAt:     until.Add(-40 * 24 * time.Hour),
+			RulePriority: 1,
+		},
+		{
+			Repository:   "web",
+			ImageRefs:    []string{"000123456789.dkr.ecr.us-east-1.amazonaws.com/web@sha256:4"},
+			PushedAt:     until.Add(-10 * 24 * time.Hour),
+			RulePriority: 1,
+		},
+	}
+	if diff := cmp.Diff(expected, violations); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Period Period
+		Err    bool
+	}{
+		{Input: "30", Period: Period{Days: 30}},
+		{Input: "36h", Period: Period{Duration: 36 * time.Hour}},
+		{Input: "90m", Period: Period{Duration: 90 * time.Minute}},
+		{Input: "2w", Period: Period{Days: 14}},
+		{Input: "3mo", Period: Period{Months: 3}},
+		{Input: "1mo2w1d12h", Period: Period{Months: 1, Days: 15, Duration: 12 * time.Hour}},
+		{Input: "", Err: true},
+		{Input: "-3", Err: true},
+		{Input: "3", Period: Period{Days: 3}},
+		{Input: "3y", Err: true},
+		{Input: "mo", Err: true},
+		{Input: "1.5d", Err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Input, func(t *testing.T) {
+			period, err := ParsePeriod(test.Input)
+			if test.Err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", period)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Period, period); diff != "" {
+				t.Fatal(diff)
+			}
+			var decoded Period
+			data, err := json.Marshal(period)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.before(time.Time{}) != period.before(time.Time{}) {
+				t.Fatalf("expected %s to round trip, got %s", period, decoded)
+			}
+		})
+	}
+}
+
+func TestPeriod_Before(t *testing.T) {
+	until := time.Date(2022, time.March, 31, 12, 0, 0, 0, time.UTC)
+	if got, want := (Period{Months: 1}).before(until), time.Date(2022, time.March, 3, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		// AddDate normalizes February 31 to March 3.
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if got, want := (Period{Days: 1, Duration: 6 * time.Hour}).before(until), time.Date(2022, time.March, 30, 6, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithPeriodUnits(t *testing.T) {
+	until := time.Now().UTC()
+	hoursAgo := func(hours int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(hours) * time.Hour))
+	}
+	newClient := func(period string) *mockedClient {
+		return &mockedClient{
+			Repositories: []*ecr.Repository{
+				{
+					RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/preview"),
+					RepositoryName: aws.String("preview"),
+					RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/preview"),
+				},
+			},
+			TagsByResourceARN: map[string][]*ecr.Tag{
+				"arn:aws:ecr:us-east-1:000123456789:repository/preview": {
+					{Key: aws.String("thermite:prune-period"), Value: aws.String(period)},
+				},
+			},
+			ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+				"preview": {
+					{ImagePushedAt: hoursAgo(13), ImageTags: []*string{aws.String("pr-1")}},
+					{ImagePushedAt: hoursAgo(11), ImageTags: []*string{aws.String("pr-2")}},
+				},
+			},
+		}
+	}
+	gc, err := NewClient(newClient("12h"), WithAllowZeroExclusions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(context.Background(), "preview", until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"000123456789.dkr.ecr.us-east-1.amazonaws.com/preview:pr-1"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	gc, err = NewClient(newClient("12 hours"), WithAllowZeroExclusions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "preview", until); !errors.Is(err, ErrNoPrunePeriodTag) {
+		t.Fatalf("expected ErrNoPrunePeriodTag, got %v", err)
+	}
+	gc, err = NewClient(newClient("12 hours"), WithAllowZeroExclusions(), WithStrictTags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "preview", until); err == nil || errors.Is(err, ErrNoPrunePeriodTag) {
+		t.Fatalf("expected error for invalid prune period tag, got %v", err)
+	}
+}
+
+func TestGarbageCollector_PruneAllReposWithFilters(t *testing.T) {
+	until := time.Now().UTC()
+	names := []string{"team-a/web", "team-a/legacy-api", "team-a/worker", "team-ab/web", "team-b/api"}
+	client := &mockedClient{
+		TagsByResourceARN:            map[string][]*ecr.Tag{},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{},
+	}
+	for _, name := range names {
+		arn := "arn:aws:ecr:us-east-1:000123456789:repository/" + name
+		client.Repositories = append(client.Repositories, &ecr.Repository{
+			RepositoryArn:  aws.String(arn),
+			RepositoryName: aws.String(name),
+			RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/" + name),
+		})
+		owner := strings.SplitN(name, "/", 2)[0]
+		if name == "team-a/worker" {
+			owner = "platform"
+		}
+		client.TagsByResourceARN[arn] = []*ecr.Tag{
+			{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+			{Key: aws.String("owner"), Value: aws.String(owner)},
+		}
+		client.ImageDetailsByRepositoryName[name] = []*ecr.ImageDetail{
+			{ImagePushedAt: aws.Time(until.Add(-100 * 24 * time.Hour)), ImageTags: []*string{aws.String("old")}},
+		}
+	}
+	tests := []struct {
+		Name    string
+		Options []Option
+		Want    []string
+	}{
+		{
+			Name: "Prefix",
+			Options: []Option{WithRepositoryFilter(RepositoryFilter{
+				Prefixes: []string{"team-a/"},
+				Exclude:  []string{"team-a/legacy-*"},
+			})},
+			Want: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/web:old",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/worker:old",
+			},
+		},
+		{
+			Name: "Tags",
+			Options: []Option{
+				WithRepositoryFilter(RepositoryFilter{Include: []string{"team-a*/*"}}),
+				WithPolicyFile(&PolicyFile{Filter: &RepositoryFilter{Tags: map[string]string{"owner": "team-a*"}}}),
+			},
+			Want: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/legacy-api:old",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/web:old",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-ab/web:old",
+			},
+		},
+		{
+			Name: "Regexp",
+			Options: []Option{WithRepositoryFilter(RepositoryFilter{
+				IncludeRegexp: "/(web|api)$",
+				ExcludeRegexp: "^team-b/",
+			})},
+			Want: []string{
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-a/web:old",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/team-ab/web:old",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			opts := append([]Option{WithAllowZeroExclusions(), WithAllowNoRegistryExclusions(), WithPageSize(2)}, test.Options...)
+			gc, err := NewClient(client, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gc.PruneAllRepos(context.Background(), until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+	if _, err := NewClient(client, WithRepositoryFilter(RepositoryFilter{IncludeRegexp: "("})); err == nil {
+		t.Fatal("expected error creating Client with invalid repository filter")
+	}
+}
+
+func TestGarbageCollector_PruneAllReposWithRegistryID(t *testing.T) {
+	until := time.Now().UTC()
+	client := &mockedClient{
+		RegistryID: "000987654321",
+		Repositories: []*ecr.Repository{
+			{
+				RegistryId:     aws.String("000987654321"),
+				RepositoryArn:  aws.String("arn:aws:ecr:us-west-2:000987654321:repository/web"),
+				RepositoryName: aws.String("web"),
+				RepositoryUri:  aws.String("000987654321.dkr.ecr.us-west-2.amazonaws.com/web"),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-west-2:000987654321:repository/web": {
+				{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"web": {
+				{ImagePushedAt: aws.Time(until.Add(-100 * 24 * time.Hour)), ImageTags: []*string{aws.String("old")}},
+				{ImagePushedAt: aws.Time(until.Add(-100 * 24 * time.Hour)), ImageTags: []*string{aws.String("deployed")}},
+			},
+		},
+	}
+	gc, err := NewClient(client, WithRegistryID("000987654321"), WithRemoveImages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gc.RegistryID(); got != "000987654321" {
+		t.Fatalf("expected registry ID 000987654321, got %s", got)
+	}
+	got, err := gc.PruneAllRepos(context.Background(), until, "000987654321.dkr.ecr.us-west-2.amazonaws.com/web:deployed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"000987654321.dkr.ecr.us-west-2.amazonaws.com/web:old"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+	gc, err = NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneAllRepos(context.Background(), until, "000987654321.dkr.ecr.us-west-2.amazonaws.com/web:deployed"); err == nil {
+		t.Fatal("expected error pruning the default registry instead of the specified registry")
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithReplication(t *testing.T) {
+	until := time.Now().UTC()
+	pushedAt := aws.Time(until.Add(-100 * 24 * time.Hour))
+	images := func() []*ecr.ImageDetail {
+		return []*ecr.ImageDetail{
+			{ImageDigest: aws.String("sha256:1"), ImagePushedAt: pushedAt, ImageTags: []*string{aws.String("old1")}},
+			{ImageDigest: aws.String("sha256:2"), ImagePushedAt: pushedAt, ImageTags: []*string{aws.String("old2")}},
+			{ImageDigest: aws.String("sha256:3"), ImagePushedAt: pushedAt, ImageTags: []*string{aws.String("deployed")}},
+		}
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/web"),
+				RepositoryName: aws.String("web"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/web"),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/web": {
+				{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{"web": images()},
+		ReplicationConfiguration: &ecr.ReplicationConfiguration{
+			Rules: []*ecr.ReplicationRule{
+				{
+					Destinations: []*ecr.ReplicationDestination{
+						{Region: aws.String("us-west-2"), RegistryId: aws.String("000123456789")},
+					},
+				},
+				{
+					Destinations: []*ecr.ReplicationDestination{
+						{Region: aws.String("eu-west-1"), RegistryId: aws.String("000987654321")},
+					},
+					RepositoryFilters: []*ecr.RepositoryFilter{
+						{Filter: aws.String("team-a/"), FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch)},
+					},
+				},
+				{
+					Destinations: []*ecr.ReplicationDestination{
+						{Region: aws.String("ap-south-1"), RegistryId: aws.String("000123456789")},
+						{Region: aws.String("us-west-2"), RegistryId: aws.String("000123456789")},
+					},
+					RepositoryFilters: []*ecr.RepositoryFilter{
+						{Filter: aws.String("we"), FilterType: aws.String(ecr.RepositoryFilterTypePrefixMatch)},
+					},
+				},
+			},
+		},
+	}
+	west := &mockedClient{
+		RegistryID: "000123456789",
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-west-2:000123456789:repository/web"),
+				RepositoryName: aws.String("web"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-west-2.amazonaws.com/web"),
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{"web": images()},
+	}
+	south := &mockedClient{RegistryID: "000123456789"}
+	replicas := map[string]ecriface.ECRAPI{"us-west-2": west, "ap-south-1": south}
+	newReplicaClient := func(region string) (ecriface.ECRAPI, error) {
+		replica, ok := replicas[region]
+		if !ok {
+			return nil, fmt.Errorf("unexpected region %s", region)
+		}
+		return replica, nil
+	}
+	gc, err := NewClient(client, WithReplication(newReplicaClient), WithRemoveImages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(
+		context.Background(),
+		"web",
+		until,
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed",
+		"000123456789.dkr.ecr.us-west-2.amazonaws.com/web@sha256:2",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:old1",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:old2",
+		"000123456789.dkr.ecr.us-west-2.amazonaws.com/web:old1",
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := west.DeletedCount(); got != 1 {
+		t.Fatalf("expected 1 image deleted from replica, got %d", got)
+	}
+	// The replication configuration of another registry cannot be read.
+	other := &mockedClient{
+		RegistryID:                   "000123456789",
+		CallerRegistryID:             "000555555555",
+		Repositories:                 client.Repositories,
+		TagsByResourceARN:            client.TagsByResourceARN,
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{"web": images()},
+		ReplicationConfiguration:     client.ReplicationConfiguration,
+	}
+	gc, err = NewClient(other, WithRegistryID("000123456789"), WithReplication(newReplicaClient), WithRemoveImages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = gc.PruneRepo(
+		context.Background(),
+		"web",
+		until,
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:deployed",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:old1",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/web:old2",
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if got := west.DeletedCount(); got != 1 {
+		t.Fatalf("expected no more images deleted from replica, got %d", got)
+	}
+}
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		ImageRef string
+		Want     []string
+	}{
+		{ImageRef: "nginx", Want: []string{"docker.io", "library/nginx", ":latest"}},
+		{ImageRef: "nginx:1.25", Want: []string{"docker.io", "library/nginx", ":1.25"}},
+		{ImageRef: "docker.io/library/nginx:1.25", Want: []string{"docker.io", "library/nginx", ":1.25"}},
+		{ImageRef: "index.docker.io/bitnami/redis@sha256:1", Want: []string{"docker.io", "bitnami/redis", "@sha256:1"}},
+		{ImageRef: "quay.io/prometheus/node-exporter:v1.5.0", Want: []string{"quay.io", "prometheus/node-exporter", ":v1.5.0"}},
+		{ImageRef: "localhost:5000/web:main", Want: []string{"localhost:5000", "web", ":main"}},
+	}
+	for _, test := range tests {
+		t.Run(test.ImageRef, func(t *testing.T) {
+			host, repoPath, suffix := parseImageRef(test.ImageRef)
+			if diff := cmp.Diff(test.Want, []string{host, repoPath, suffix}); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithPullThroughCache(t *testing.T) {
+	until := time.Now().UTC()
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/docker-hub/library/nginx"),
+				RepositoryName: aws.String("docker-hub/library/nginx"),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/docker-hub/library/nginx"),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/docker-hub/library/nginx": {},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"docker-hub/library/nginx": {
+				{ImagePushedAt: daysAgo(100), LastRecordedPullTime: daysAgo(2), ImageTags: []*string{aws.String("1.25")}},
+				{ImagePushedAt: daysAgo(100), LastRecordedPullTime: daysAgo(60), ImageTags: []*string{aws.String("1.24")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("1.23")}},
+				{ImagePushedAt: daysAgo(100), ImageTags: []*string{aws.String("1.22")}},
+			},
+		},
+		PullThroughCacheRules: []*ecr.PullThroughCacheRule{
+			{EcrRepositoryPrefix: aws.String("docker-hub"), UpstreamRegistryUrl: aws.String("registry-1.docker.io")},
+			{EcrRepositoryPrefix: aws.String("quay"), UpstreamRegistryUrl: aws.String("quay.io")},
+		},
+	}
+	gc, err := NewClient(client, WithPolicyFile(&PolicyFile{
+		Defaults: PolicySettings{Period: &Period{Days: 365}},
+		PullThroughCache: []PullThroughCachePolicy{
+			{Prefix: "docker-*", PolicySettings: PolicySettings{Period: &Period{Days: 30}}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, _, ok, err := gc.EffectivePolicy(context.Background(), "docker-hub/library/nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !policy.FromLastPull || policy.Period != (Period{Days: 30}) {
+		t.Fatalf("expected pull-through cache policy with a 30 day period, got %+v", policy)
+	}
+	got, err := gc.PruneRepo(context.Background(), "docker-hub/library/nginx", until, "nginx:1.23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/docker-hub/library/nginx:1.22",
+		"000123456789.dkr.ecr.us-east-1.amazonaws.com/docker-hub/library/nginx:1.24",
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := NewClient(client, WithPolicyFile(&PolicyFile{
+		PullThroughCache: []PullThroughCachePolicy{{PolicySettings: PolicySettings{Period: &Period{Days: 30}}}},
+	})); err == nil {
+		t.Fatal("expected error creating Client with a pull-through cache policy without a prefix")
+	}
+
+	// Without permission to describe the rules, pruning fails rather than
+	// treat cache repositories as ordinary ones, unless they are ignored.
+	client.PullThroughCacheRulesErr = awserr.New("AccessDeniedException", "not authorized", nil)
+	gc, err = NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "docker-hub/library/nginx", until, "nginx:1.23"); err == nil {
+		t.Fatal("expected error pruning without permission to describe pull-through cache rules")
+	}
+	gc, err = NewClient(client, WithIgnorePullThroughCacheRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "docker-hub/library/nginx", until, "nginx:1.23"); !errors.Is(err, ErrNoPrunePeriodTag) {
+		t.Fatalf("expected ErrNoPrunePeriodTag for an ordinary repository without tags, got %v", err)
+	}
+}
+
+func TestGarbageCollector_PruneAllReposWithBudgets(t *testing.T) {
+	until := time.Now().UTC()
+	hoursAgo := func(hours int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(hours) * time.Hour))
+	}
+	newClient := func() *mockedClient {
+		client := &mockedClient{
+			TagsByResourceARN: map[string][]*ecr.Tag{},
+			ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+				"web": {
+					{ImagePushedAt: hoursAgo(101 * 24), ImageTags: []*string{aws.String("w1")}},
+					{ImagePushedAt: hoursAgo(102 * 24), ImageTags: []*string{aws.String("w2")}},
+					{ImagePushedAt: hoursAgo(103 * 24), ImageTags: []*string{aws.String("w3")}},
+					{ImagePushedAt: hoursAgo(104 * 24), ImageTags: []*string{aws.String("w4")}},
+					{ImagePushedAt: hoursAgo(105 * 24), ImageTags: []*string{aws.String("w5")}},
+					{ImagePushedAt: hoursAgo(200 * 24), ImageTags: []*string{aws.String("deployed")}},
+				},
+				"api": {
+					{ImagePushedAt: hoursAgo(110 * 24), ImageTags: []*string{aws.String("a1")}},
+					{ImagePushedAt: hoursAgo(103*24 + 12), ImageTags: []*string{aws.String("a2")}},
+					{ImagePushedAt: hoursAgo(50 * 24), ImageTags: []*string{aws.String("a3")}},
+				},
+			},
+		}
+		for _, name := range []string{"api", "web"} {
+			arn := "arn:aws:ecr:us-east-1:000123456789:repository/" + name
+			client.Repositories = append(client.Repositories, &ecr.Repository{
+				RepositoryArn:  aws.String(arn),
+				RepositoryName: aws.String(name),
+				RepositoryUri:  aws.String("000123456789.dkr.ecr.us-east-1.amazonaws.com/" + name),
+			})
+			client.TagsByResourceARN[arn] = []*ecr.Tag{
+				{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+			}
+		}
+		return client
+	}
+	ref := func(name, tag string) string {
+		return "000123456789.dkr.ecr.us-east-1.amazonaws.com/" + name + ":" + tag
+	}
+	tests := []struct {
+		Name    string
+		Options []Option
+		Want    []string
+		Error   bool
+	}{
+		{
+			Name: "Unlimited",
+			Options: []Option{
+				WithMaxDeletions(8),
+			},
+			Want: []string{
+				ref("api", "a1"), ref("api", "a2"), ref("api", "a3"),
+				ref("web", "w1"), ref("web", "w2"), ref("web", "w3"), ref("web", "w4"), ref("web", "w5"),
+			},
+		},
+		{
+			Name:    "Abort",
+			Options: []Option{WithMaxDeletions(5)},
+			Error:   true,
+		},
+		{
+			Name:    "Oldest",
+			Options: []Option{WithMaxDeletions(5), WithBudgetAction(BudgetActionOldest)},
+			Want: []string{
+				ref("api", "a1"), ref("api", "a2"),
+				ref("web", "w3"), ref("web", "w4"), ref("web", "w5"),
+			},
+		},
+		{
+			Name: "Percent",
+			Options: []Option{
+				WithMaxDeletePercent(50),
+				WithBudgetAction(BudgetActionOldest),
+				WithPolicyFile(&PolicyFile{
+					Repositories: []RepositoryPolicy{
+						{Match: "web", PolicySettings: PolicySettings{MaxDeletions: aws.Int(2)}},
+					},
+				}),
+			},
+			Want: []string{
+				ref("api", "a1"), ref("api", "a2"),
+				ref("web", "w4"), ref("web", "w5"),
+			},
+		},
+		{
+			Name: "RepositoryAbort",
+			Options: []Option{
+				WithPolicyFile(&PolicyFile{
+					Defaults: PolicySettings{MaxDeletePercent: aws.Float64(50)},
+				}),
+			},
+			Error: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := newClient()
+			opts := append([]Option{WithRemoveImages()}, test.Options...)
+			gc, err := NewClient(client, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gc.PruneAllRepos(context.Background(), until, ref("web", "deployed"))
+			if test.Error {
+				if !errors.Is(err, ErrDeletionBudgetExceeded) {
+					t.Fatalf("expected ErrDeletionBudgetExceeded, got %v", err)
+				}
+				if client.DeletedCount() != 0 {
+					t.Fatalf("expected no images deleted, got %d", client.DeletedCount())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+	// A shared budget is spent across registries.
+	shared, err := NewBudget(6, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := NewClient(newClient(), WithRemoveImages(), WithBudget(shared), WithBudgetAction(BudgetActionOldest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := first.PruneAllRepos(context.Background(), until, ref("web", "deployed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 6 {
+		t.Fatalf("expected 6 images pruned from the first registry, got %d", len(got))
+	}
+	second, err := NewClient(newClient(), WithRemoveImages(), WithBudget(shared))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.PruneAllRepos(context.Background(), until, ref("web", "deployed")); !errors.Is(err, ErrDeletionBudgetExceeded) {
+		t.Fatalf("expected ErrDeletionBudgetExceeded from the second registry, got %v", err)
+	}
+	for _, opts := range [][]Option{
+		{WithMaxDeletions(-1)},
+		{WithMaxDeletePercent(101)},
+		{WithBudgetAction("ignore")},
+		{WithBudget(shared), WithMaxDeletions(1)},
+		{WithPolicyFile(&PolicyFile{Defaults: PolicySettings{MaxDeletePercent: aws.Float64(-1)}})},
+	} {
+		if _, err := NewClient(newClient(), opts...); err == nil {
+			t.Fatal("expected error creating Client with invalid deletion budget")
+		}
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithLedger(t *testing.T) {
+	start := time.Date(2021, 8, 1, 0, 0, 0, 0, time.UTC)
+	uri := "000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite"
+	client := &mockedClient{
+		Repositories: []*ecr.Repository{
+			{
+				RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/thermite"),
+				RepositoryName: aws.String("thermite"),
+				RepositoryUri:  aws.String(uri),
+			},
+		},
+		TagsByResourceARN: map[string][]*ecr.Tag{
+			"arn:aws:ecr:us-east-1:000123456789:repository/thermite": {
+				{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+			},
+		},
+		ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+			"thermite": {
+				{
+					ImageDigest:   aws.String("sha256:1"),
+					ImagePushedAt: aws.Time(start.Add(-40 * 24 * time.Hour)),
+					ImageTags:     []*string{aws.String("old")},
+				},
+				{
+					ImageDigest:   aws.String("sha256:2"),
+					ImagePushedAt: aws.Time(start.Add(-50 * 24 * time.Hour)),
+					ImageTags:     []*string{aws.String("redeployed")},
+				},
+				{
+					ImageDigest:   aws.String("sha256:3"),
+					ImagePushedAt: aws.Time(start.Add(-60 * 24 * time.Hour)),
+					ImageTags:     []*string{aws.String("deployed")},
+				},
+			},
+		},
+	}
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ledger.NewClient(s, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun, err := NewClient(client, WithLedger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc, err := NewClient(client, WithRemoveImages(), WithLedger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Name     string
+		Client   *Client
+		Until    time.Time
+		Excluded []string
+		Want     []string
+	}{
+		{
+			// A dry run a day before the first run must not let the
+			// second run sweep.
+			Name:     "DryRun",
+			Client:   dryRun,
+			Until:    start.Add(-24 * time.Hour),
+			Excluded: []string{uri + ":deployed"},
+			Want:     []string{},
+		},
+		{
+			Name:     "Mark",
+			Until:    start,
+			Excluded: []string{uri + ":deployed"},
+			Want:     []string{},
+		},
+		{
+			Name:     "TooSoon",
+			Until:    start.Add(12 * time.Hour),
+			Excluded: []string{uri + ":deployed"},
+			Want:     []string{},
+		},
+		{
+			Name:     "Sweep",
+			Until:    start.Add(25 * time.Hour),
+			Excluded: []string{uri + ":deployed", uri + ":redeployed"},
+			Want:     []string{uri + ":old"},
+		},
+		{
+			Name:     "Remark",
+			Until:    start.Add(50 * time.Hour),
+			Excluded: []string{uri + ":deployed"},
+			Want:     []string{uri + ":old"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := test.Client
+			if client == nil {
+				client = gc
+			}
+			got, err := client.PruneRepo(context.Background(), "thermite", test.Until, test.Excluded...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithQuarantine(t *testing.T) {
+	until := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	uri := "000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite"
+	daysAgo := func(days int) *time.Time {
+		return aws.Time(until.Add(-time.Duration(days) * 24 * time.Hour))
+	}
+	newClient := func() *mockedClient {
+		return &mockedClient{
+			Repositories: []*ecr.Repository{
+				{
+					RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/thermite"),
+					RepositoryName: aws.String("thermite"),
+					RepositoryUri:  aws.String(uri),
+				},
+			},
+			TagsByResourceARN: map[string][]*ecr.Tag{
+				"arn:aws:ecr:us-east-1:000123456789:repository/thermite": {
+					{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+				},
+			},
+			ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+				"thermite": {
+					{
+						ImageDigest:   aws.String("sha256:1"),
+						ImagePushedAt: daysAgo(40),
+						ImageTags:     aws.StringSlice([]string{"v1", "stable"}),
+					},
+					{
+						ImageDigest:            aws.String("sha256:2"),
+						ImageManifestMediaType: aws.String(ociImageIndexMediaType),
+						ImagePushedAt:          daysAgo(40),
+						ImageTags:              aws.StringSlice([]string{"v2"}),
+					},
+					{
+						ImageDigest:   aws.String("sha256:2-amd64"),
+						ImagePushedAt: daysAgo(40),
+					},
+					{
+						ImageDigest:   aws.String("sha256:3"),
+						ImagePushedAt: daysAgo(60),
+						ImageTags:     aws.StringSlice([]string{"thermite-quarantine-20210720T000000Z-v0"}),
+					},
+					{
+						ImageDigest:   aws.String("sha256:4"),
+						ImagePushedAt: daysAgo(60),
+						ImageTags:     aws.StringSlice([]string{"thermite-quarantine-20210729T000000Z-v3"}),
+					},
+					{
+						ImageDigest:   aws.String("sha256:5"),
+						ImagePushedAt: daysAgo(60),
+						ImageTags:     aws.StringSlice([]string{"thermite-quarantine-20210701-v4"}),
+					},
+					// Quarantined late on a day, which must not shorten the
+					// quarantine period, whether or not the tag records the time.
+					{
+						ImageDigest:   aws.String("sha256:7"),
+						ImagePushedAt: daysAgo(60),
+						ImageTags:     aws.StringSlice([]string{"thermite-quarantine-20210725T230000Z-v7"}),
+					},
+					{
+						ImageDigest:   aws.String("sha256:8"),
+						ImagePushedAt: daysAgo(60),
+						ImageTags:     aws.StringSlice([]string{"thermite-quarantine-20210725-v8"}),
+					},
+					{
+						ImageDigest:   aws.String("sha256:6"),
+						ImagePushedAt: daysAgo(60),
+						ImageTags:     aws.StringSlice([]string{"deployed"}),
+					},
+				},
+			},
+			ManifestsByDigest: map[string]string{
+				"sha256:1": `{"schemaVersion":2,"layers":[]}`,
+				"sha256:2": `{"schemaVersion":2,"manifests":[{"digest":"sha256:2-amd64"}]}`,
+				"sha256:3": `{"schemaVersion":2,"layers":[]}`,
+				"sha256:4": `{"schemaVersion":2,"layers":[]}`,
+				"sha256:5": `{"schemaVersion":2,"layers":[]}`,
+				"sha256:7": `{"schemaVersion":2,"layers":[]}`,
+				"sha256:8": `{"schemaVersion":2,"layers":[]}`,
+			},
+		}
+	}
+	excluded := []string{uri + ":deployed", uri + ":v4"}
+	client := newClient()
+	gc, err := NewClient(client, WithRemoveImages(), WithQuarantine(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gc.PruneRepo(context.Background(), "thermite", until, excluded...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{
+		uri + ":stable",
+		uri + ":thermite-quarantine-20210720T000000Z-v0",
+		uri + ":v1",
+		uri + ":v2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	wantPut := map[string]string{
+		"thermite-quarantine-20210801T120000Z-v1":     "sha256:1",
+		"thermite-quarantine-20210801T120000Z-stable": "sha256:1",
+		"thermite-quarantine-20210801T120000Z-v2":     "sha256:2",
+	}
+	put := map[string]string{}
+	for _, imageID := range client.putImageIDs {
+		put[aws.StringValue(imageID.ImageTag)] = aws.StringValue(imageID.ImageDigest)
+	}
+	if diff := cmp.Diff(wantPut, put); diff != "" {
+		t.Fatal(diff)
+	}
+	deleted := []string{}
+	for _, imageID := range client.deletedImageIDs {
+		deleted = append(deleted, aws.StringValue(imageID.ImageTag)+aws.StringValue(imageID.ImageDigest))
+	}
+	sort.Strings(deleted)
+	wantDeleted := []string{"stable", "thermite-quarantine-20210720T000000Z-v0", "v1", "v2"}
+	if diff := cmp.Diff(wantDeleted, deleted); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// The image quarantined at 23:00 is deleted once its full quarantine period
+	// has passed, and the one quarantined on that date is kept until the end of
+	// the day.
+	client = newClient()
+	gc, err = NewClient(client, WithRemoveImages(), WithQuarantine(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = gc.PruneRepo(context.Background(), "thermite", until.Add(11*time.Hour), excluded...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruned := map[string]bool{}
+	for _, image := range got {
+		pruned[image] = true
+	}
+	if !pruned[uri+":thermite-quarantine-20210725T230000Z-v7"] {
+		t.Fatalf("expected image quarantined late in the day pruned, got %v", got)
+	}
+	if pruned[uri+":thermite-quarantine-20210725-v8"] {
+		t.Fatalf("expected image quarantined on a date kept until the end of the day, got %v", got)
+	}
+
+	tests := []struct {
+		Name        string
+		TagOrDigest string
+		Want        []string
+		Deleted     []string
+		Error       bool
+	}{
+		{
+			Name:        "OriginalTag",
+			TagOrDigest: "v3",
+			Want:        []string{uri + ":v3"},
+			Deleted:     []string{"thermite-quarantine-20210729T000000Z-v3"},
+		},
+		{
+			Name:        "QuarantineTag",
+			TagOrDigest: "thermite-quarantine-20210720T000000Z-v0",
+			Want:        []string{uri + ":v0"},
+			Deleted:     []string{"thermite-quarantine-20210720T000000Z-v0"},
+		},
+		{
+			Name:        "Digest",
+			TagOrDigest: "sha256:5",
+			Want:        []string{uri + ":v4"},
+			Deleted:     []string{"thermite-quarantine-20210701-v4"},
+		},
+		{
+			Name:        "Live",
+			TagOrDigest: "deployed",
+			Error:       true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := newClient()
+			gc, err := NewClient(client, WithQuarantine(7*24*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gc.Unquarantine(context.Background(), "thermite", test.TagOrDigest)
+			if test.Error {
+				if !errors.Is(err, ErrNotQuarantined) {
+					t.Fatalf("expected ErrNotQuarantined, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+			deleted := []string{}
+			for _, imageID := range client.deletedImageIDs {
+				deleted = append(deleted, aws.StringValue(imageID.ImageTag))
+			}
+			if diff := cmp.Diff(test.Deleted, deleted); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestGarbageCollector_PruneRepoWithJournal(t *testing.T) {
+	until := time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC)
+	uri := "000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite"
+	pushedAt := until.Add(-40 * 24 * time.Hour)
+	deployed := &ecr.ImageDetail{
+		ImageDigest:   aws.String("sha256:deployed"),
+		ImagePushedAt: aws.Time(pushedAt),
+		ImageTags:     aws.StringSlice([]string{"deployed"}),
+	}
+	newClient := func(images ...*ecr.ImageDetail) *mockedClient {
+		return &mockedClient{
+			Repositories: []*ecr.Repository{
+				{
+					RepositoryArn:  aws.String("arn:aws:ecr:us-east-1:000123456789:repository/thermite"),
+					RepositoryName: aws.String("thermite"),
+					RepositoryUri:  aws.String(uri),
+				},
+			},
+			TagsByResourceARN: map[string][]*ecr.Tag{
+				"arn:aws:ecr:us-east-1:000123456789:repository/thermite": {
+					{Key: aws.String("thermite:prune-period"), Value: aws.String("30")},
+				},
+			},
+			ImageDetailsByRepositoryName: map[string][]*ecr.ImageDetail{
+				"thermite": images,
+			},
+			ManifestsByDigest: map[string]string{
+				"sha256:0":       `{"schemaVersion":2,"layers":[]}`,
+				"sha256:1":       `{"schemaVersion":2,"manifests":[{"digest":"sha256:1-amd64"}]}`,
+				"sha256:1-amd64": `{"schemaVersion":2,"layers":[]}`,
+				"sha256:9":       `{"schemaVersion":2,"layers":[]}`,
+			},
+		}
+	}
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := journal.NewClient(s, 30*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newClient(
+		&ecr.ImageDetail{
+			ImageDigest:            aws.String("sha256:0"),
+			ImageManifestMediaType: aws.String("application/vnd.oci.image.manifest.v1+json"),
+			ImagePushedAt:          aws.Time(pushedAt),
+			ImageTags:              aws.StringSlice([]string{"v0", "stable"}),
+		},
+		&ecr.ImageDetail{
+			ImageDigest:            aws.String("sha256:1"),
+			ImageManifestMediaType: aws.String(ociImageIndexMediaType),
+			ImagePushedAt:          aws.Time(pushedAt),
+			ImageTags:              aws.StringSlice([]string{"v1"}),
+		},
+		&ecr.ImageDetail{
+			ImageDigest:            aws.String("sha256:1-amd64"),
+			ImageManifestMediaType: aws.String("application/vnd.oci.image.manifest.v1+json"),
+			ImagePushedAt:          aws.Time(pushedAt),
+		},
+		deployed,
+	)
+	gc, err := NewClient(client, WithRemoveImages(), WithJournal(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "thermite", until, uri+":deployed"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := j.Load(context.Background(), uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(entries, func(i, k int) bool {
+		return entries[i].Digest < entries[k].Digest
+	})
+	wantEntries := []journal.Entry{
+		{
+			Repository: uri,
+			Digest:     "sha256:0",
+			Tags:       []string{"v0", "stable"},
+			Manifest:   `{"schemaVersion":2,"layers":[]}`,
+			MediaType:  "application/vnd.oci.image.manifest.v1+json",
+			PushedAt:   pushedAt,
+			DeletedAt:  until,
+		},
+		{
+			Repository: uri,
+			Digest:     "sha256:1",
+			Tags:       []string{"v1"},
+			Manifest:   `{"schemaVersion":2,"manifests":[{"digest":"sha256:1-amd64"}]}`,
+			MediaType:  ociImageIndexMediaType,
+			PushedAt:   pushedAt,
+			DeletedAt:  until,
+		},
+		{
+			Repository: uri,
+			Digest:     "sha256:1-amd64",
+			Manifest:   `{"schemaVersion":2,"layers":[]}`,
+			MediaType:  "application/vnd.oci.image.manifest.v1+json",
+			PushedAt:   pushedAt,
+			DeletedAt:  until,
+		},
+	}
+	if diff := cmp.Diff(wantEntries, entries); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// An image is quarantined, and then deleted once its quarantine expires,
+	// under its original tag.
+	quarantineTag := "thermite-quarantine-20210801T120000Z-v9"
+	client = newClient(
+		&ecr.ImageDetail{
+			ImageDigest:   aws.String("sha256:9"),
+			ImagePushedAt: aws.Time(pushedAt),
+			ImageTags:     aws.StringSlice([]string{"v9"}),
+		},
+		deployed,
+	)
+	gc, err = NewClient(client, WithRemoveImages(), WithJournal(j), WithQuarantine(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "thermite", until, uri+":deployed"); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.putImageIDs) != 1 || aws.StringValue(client.putImageIDs[0].ImageTag) != quarantineTag {
+		t.Fatalf("expected image quarantined with tag %s, got %v", quarantineTag, client.putImageIDs)
+	}
+	client = newClient(
+		&ecr.ImageDetail{
+			ImageDigest:   aws.String("sha256:9"),
+			ImagePushedAt: aws.Time(pushedAt),
+			ImageTags:     aws.StringSlice([]string{quarantineTag}),
+		},
+		deployed,
+	)
+	gc, err = NewClient(client, WithRemoveImages(), WithJournal(j), WithQuarantine(7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gc.PruneRepo(context.Background(), "thermite", until.Add(8*24*time.Hour), uri+":deployed"); err != nil {
+		t.Fatal(err)
+	}
+	if client.DeletedCount() != 1 {
+		t.Fatalf("expected expired quarantined image deleted, got %d deletions", client.DeletedCount())
+	}
+
+	tests := []struct {
+		Name        string
+		Images      []*ecr.ImageDetail
+		TagOrDigest string
+		Want        []string
+		Put         []string
+		Error       error
+	}{
+		{
+			Name:        "Tag",
+			TagOrDigest: "stable",
+			Want:        []string{uri + ":v0", uri + ":stable"},
+			Put:         []string{"v0@sha256:0", "stable@sha256:0"},
+		},
+		{
+			Name:        "Index",
+			TagOrDigest: "sha256:1",
+			Want:        []string{uri + ":v1"},
+			Put:         []string{"@sha256:1-amd64", "v1@sha256:1"},
+		},
+		{
+			Name:        "Quarantined",
+			TagOrDigest: "v9",
+			Want:        []string{uri + ":v9"},
+			Put:         []string{"v9@sha256:9"},
+		},
+		{
+			Name:        "Child",
+			TagOrDigest: "sha256:1-amd64",
+			Want:        []string{uri + "@sha256:1-amd64"},
+			Put:         []string{"@sha256:1-amd64"},
+		},
+		{
+			Name: "TagReused",
+			Images: []*ecr.ImageDetail{
+				{
+					ImageDigest:   aws.String("sha256:2"),
+					ImagePushedAt: aws.Time(until),
+					ImageTags:     aws.StringSlice([]string{"v0"}),
+				},
+			},
+			TagOrDigest: "v0",
+			Error:       errors.New("tag v0 of repository thermite already refers to image sha256:2"),
+		},
+		{
+			Name:        "Missing",
+			TagOrDigest: "v2",
+			Error:       ErrNotJournaled,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			client := newClient(append([]*ecr.ImageDetail{deployed}, test.Images...)...)
+			gc, err := NewClient(client, WithJournal(j))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := gc.Restore(context.Background(), "thermite", test.TagOrDigest)
+			if test.Error != nil {
+				if err == nil || (!errors.Is(err, test.Error) && err.Error() != test.Error.Error()) {
+					t.Fatalf("expected error %v, got %v", test.Error, err)
+				}
+				if len(client.putImageIDs) != 0 {
+					t.Fatalf("expected no images put, got %d", len(client.putImageIDs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Fatal(diff)
+			}
+			put := []string{}
+			for _, imageID := range client.putImageIDs {
+				put = append(put, aws.StringValue(imageID.ImageTag)+"@"+aws.StringValue(imageID.ImageDigest))
+			}
+			if diff := cmp.Diff(test.Put, put); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
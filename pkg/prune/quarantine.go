@@ -0,0 +1,436 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// QuarantineTagPrefix is the prefix of the tags that a Client gives the images
+// it quarantines, followed by the time of quarantine in UTC and an original
+// tag, such as thermite-quarantine-20210801T120000Z-v1.2.3.
+const QuarantineTagPrefix = "thermite-quarantine-"
+
+// QuarantineRuleName is the name of the rule that keeps quarantined images
+// until their quarantine period has passed, and then prunes them.
+const QuarantineRuleName = "quarantine"
+
+// quarantineTimeLayout is the layout of the time in a quarantine tag.
+const quarantineTimeLayout = "20060102T150405Z"
+
+// quarantineDateLayout is the layout of the date in quarantine tags written
+// before they recorded the time of quarantine.
+const quarantineDateLayout = "20060102"
+
+// maxImageTagLength is the length of the longest tag that Elastic Container
+// Registry accepts.
+const maxImageTagLength = 128
+
+// ErrNotQuarantined is returned by Unquarantine when no quarantined image
+// matches the given tag or digest.
+var ErrNotQuarantined = errors.New("no quarantined image found")
+
+// WithQuarantine makes a Client quarantine the tagged images that it prunes
+// instead of deleting them, by tagging each with QuarantineTagPrefix, the time,
+// and each of its tags, and then removing its original tags. Quarantined images
+// are deleted by a later run once period has passed, unless they are excluded by
+// digest or by an original tag, and can be restored until then with
+// Unquarantine. Quarantined images are decided by the rule QuarantineRuleName,
+// and neither count towards keep counts nor are deleted from replicas. Untagged
+// images are still deleted immediately, except for the children of quarantined
+// indexes.
+func WithQuarantine(period time.Duration) Option {
+	return func(gc *Client) {
+		gc.quarantine = period
+	}
+}
+
+// quarantineTag returns the tag with which an image tagged tag is quarantined
+// at t.
+func quarantineTag(tag string, t time.Time) string {
+	return QuarantineTagPrefix + t.UTC().Format(quarantineTimeLayout) + "-" + tag
+}
+
+// parseQuarantineTag returns the original tag and the time of quarantine
+// encoded in tag, and whether tag is a quarantine tag. A tag that records only
+// the date of quarantine is taken to be quarantined at the end of that day, so
+// that its image is never pruned before its quarantine period has passed.
+func parseQuarantineTag(tag string) (original string, quarantinedAt time.Time, ok bool) {
+	if !strings.HasPrefix(tag, QuarantineTagPrefix) {
+		return "", time.Time{}, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(tag, QuarantineTagPrefix), "-", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", time.Time{}, false
+	}
+	quarantinedAt, err := time.Parse(quarantineTimeLayout, parts[0])
+	if err == nil {
+		return parts[1], quarantinedAt, true
+	}
+	quarantinedOn, err := time.Parse(quarantineDateLayout, parts[0])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[1], quarantinedOn.AddDate(0, 0, 1), true
+}
+
+// quarantined returns the original tags of imageDetail and the latest time at
+// which it was quarantined, if every one of its tags is a quarantine tag.
+func quarantined(imageDetail *ecr.ImageDetail) (originals []string, quarantinedAt time.Time, ok bool) {
+	if len(imageDetail.ImageTags) == 0 {
+		return nil, time.Time{}, false
+	}
+	originals = make([]string, 0, len(imageDetail.ImageTags))
+	for _, imageTag := range imageDetail.ImageTags {
+		original, at, ok := parseQuarantineTag(aws.StringValue(imageTag))
+		if !ok {
+			return nil, time.Time{}, false
+		}
+		originals = append(originals, original)
+		if at.After(quarantinedAt) {
+			quarantinedAt = at
+		}
+	}
+	return originals, quarantinedAt, true
+}
+
+// originalTags returns the tags that imageDetail had before it was
+// quarantined, without duplicates, or its tags if it is not quarantined.
+func originalTags(imageDetail *ecr.ImageDetail) []string {
+	originals, _, ok := quarantined(imageDetail)
+	if !ok {
+		return aws.StringValueSlice(imageDetail.ImageTags)
+	}
+	seen := make(map[string]bool, len(originals))
+	tags := make([]string, 0, len(originals))
+	for _, original := range originals {
+		if !seen[original] {
+			seen[original] = true
+			tags = append(tags, original)
+		}
+	}
+	return tags
+}
+
+// quarantines returns whether gc quarantines the image decided by d instead of
+// deleting it.
+func (gc *Client) quarantines(d decision) bool {
+	if gc.quarantine <= 0 || !d.prune || len(d.imageDetail.ImageTags) == 0 {
+		return false
+	}
+	_, _, ok := quarantined(d.imageDetail)
+	return !ok
+}
+
+// partitionQuarantined splits images into those that are live and those that
+// are quarantined, if gc quarantines images.
+func (gc *Client) partitionQuarantined(images []*ecr.ImageDetail) (live, isolated []*ecr.ImageDetail) {
+	if gc.quarantine <= 0 {
+		return images, nil
+	}
+	live = make([]*ecr.ImageDetail, 0, len(images))
+	isolated = []*ecr.ImageDetail{}
+	for _, imageDetail := range images {
+		if _, _, ok := quarantined(imageDetail); ok {
+			isolated = append(isolated, imageDetail)
+			continue
+		}
+		live = append(live, imageDetail)
+	}
+	return live, isolated
+}
+
+// decideQuarantined returns a decision for each of the quarantined images in
+// the repository with the given URI, pruning those whose quarantine period
+// passed before until. An image that wl refers to, by digest or by one of its
+// original tags, is kept.
+func (gc *Client) decideQuarantined(uri string, images []*ecr.ImageDetail, until time.Time, wl whitelist) []decision {
+	decisions := make([]decision, 0, len(images))
+	for _, imageDetail := range images {
+		originals, quarantinedAt, _ := quarantined(imageDetail)
+		excluded := wl.ExcludesImage(uri, imageDetail)
+		for _, original := range originals {
+			excluded = excluded || wl.IsExcluded(fmt.Sprintf("%s:%s", uri, original))
+		}
+		switch {
+		case excluded:
+			decisions = append(decisions, decision{imageDetail: imageDetail, rule: DeployedRuleName})
+		case !quarantinedAt.Add(gc.quarantine).After(until.UTC()):
+			decisions = append(decisions, decision{imageDetail: imageDetail, prune: true, rule: QuarantineRuleName})
+		default:
+			decisions = append(decisions, decision{imageDetail: imageDetail, rule: QuarantineRuleName})
+		}
+	}
+	return decisions
+}
+
+// spareQuarantined keeps the images of plan that gc would quarantine but whose
+// quarantine tags would be too long, and the children of indexes that gc
+// quarantines, so that they can be restored with them.
+func (gc *Client) spareQuarantined(plan *repoPlan) {
+	if gc.quarantine <= 0 {
+		return
+	}
+	for i, d := range plan.decisions {
+		if !gc.quarantines(d) {
+			continue
+		}
+		for _, imageTag := range d.imageDetail.ImageTags {
+			if len(quarantineTag(*imageTag, plan.until)) > maxImageTagLength {
+				gc.logger.Printf(
+					"keeping %s, whose tags are too long to quarantine",
+					strings.Join(imageRefsFromImageDetail(*plan.repo.RepositoryUri, d.imageDetail), ", "),
+				)
+				plan.holdBack(i, QuarantineRuleName)
+				break
+			}
+		}
+	}
+	for _, d := range plan.decisions {
+		if gc.quarantines(d) {
+			plan.holdBackChildren(aws.StringValue(d.imageDetail.ImageDigest), QuarantineRuleName)
+		}
+	}
+}
+
+// quarantineImages quarantines each of images in repo at until, and returns
+// references to them by their original tags.
+func (gc *Client) quarantineImages(
+	ctx context.Context,
+	repo *ecr.Repository,
+	images []*ecr.ImageDetail,
+	until time.Time,
+) (quarantinedRefs []string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.quarantineImages")
+	defer span.Finish()
+	quarantinedRefs = []string{}
+	for _, imageDetail := range images {
+		tags := aws.StringValueSlice(imageDetail.ImageTags)
+		quarantineTags := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			quarantineTags = append(quarantineTags, quarantineTag(tag, until))
+		}
+		// The quarantine tags are added before the original tags are
+		// removed, since removing the last tag of an image deletes it.
+		if err := gc.putImageTags(ctx, repo, imageDetail, quarantineTags); err != nil {
+			span.Finish(tracer.WithError(err))
+			return quarantinedRefs, err
+		}
+		if err := gc.removeImageTags(ctx, repo, tags); err != nil {
+			span.Finish(tracer.WithError(err))
+			return quarantinedRefs, err
+		}
+		quarantinedRefs = append(quarantinedRefs, imageRefsFromImageDetail(*repo.RepositoryUri, imageDetail)...)
+	}
+	gc.logger.Printf(
+		"quarantined %d images in Elastic Container Registry repository %s",
+		len(images),
+		*repo.RepositoryName,
+	)
+	gc.statsd.Count("prune.quarantined", int64(len(images)), nil, 1)
+	return quarantinedRefs, nil
+}
+
+// Unquarantine restores the original tags of the quarantined image in the
+// named repository that has the given digest, quarantine tag, or original tag,
+// and removes its quarantine tags. If several quarantined images had the same
+// original tag, the one quarantined last is restored. Unquarantine fails
+// without changing anything if any original tag refers to a live image, and
+// returns ErrNotQuarantined if no quarantined image matches. Unquarantine
+// returns references to the restored image by its original tags.
+func (gc *Client) Unquarantine(ctx context.Context, name, tagOrDigest string) (restored []string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.Unquarantine")
+	defer span.Finish()
+	restored = []string{}
+	repo, err := gc.repoFromName(ctx, name)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, fmt.Errorf("error looking up repository: %w", err)
+	}
+	images, err := gc.describeImages(ctx, repo)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	var match *ecr.ImageDetail
+	var matchedAt time.Time
+	liveTags := map[string]bool{}
+	for _, imageDetail := range images {
+		originals, quarantinedAt, ok := quarantined(imageDetail)
+		if !ok {
+			for _, imageTag := range imageDetail.ImageTags {
+				liveTags[*imageTag] = true
+			}
+			continue
+		}
+		matches := aws.StringValue(imageDetail.ImageDigest) == tagOrDigest
+		for i, imageTag := range imageDetail.ImageTags {
+			matches = matches || *imageTag == tagOrDigest || originals[i] == tagOrDigest
+		}
+		if matches && (match == nil || quarantinedAt.After(matchedAt)) {
+			match, matchedAt = imageDetail, quarantinedAt
+		}
+	}
+	if match == nil {
+		err := fmt.Errorf("%w for %s in repository %s", ErrNotQuarantined, tagOrDigest, name)
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	tags := originalTags(match)
+	for _, tag := range tags {
+		if liveTags[tag] {
+			err := fmt.Errorf("tag %s of repository %s already refers to a live image", tag, name)
+			span.Finish(tracer.WithError(err))
+			return restored, err
+		}
+	}
+	if err := gc.putImageTags(ctx, repo, match, tags); err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	if err := gc.removeImageTags(ctx, repo, aws.StringValueSlice(match.ImageTags)); err != nil {
+		span.Finish(tracer.WithError(err))
+		return restored, err
+	}
+	for _, tag := range tags {
+		restored = append(restored, fmt.Sprintf("%s:%s", *repo.RepositoryUri, tag))
+	}
+	gc.logger.Printf("restored %s from quarantine", strings.Join(restored, ", "))
+	gc.statsd.Count("prune.unquarantined", 1, nil, 1)
+	return restored, nil
+}
+
+// putImageTags tags the image described by imageDetail in repo with each of
+// tags, by putting its manifest again.
+func (gc *Client) putImageTags(ctx context.Context, repo *ecr.Repository, imageDetail *ecr.ImageDetail, tags []string) error {
+	manifests, err := gc.getManifests(ctx, repo, []*ecr.ImageDetail{imageDetail})
+	if err != nil {
+		return err
+	}
+	image := manifests[aws.StringValue(imageDetail.ImageDigest)]
+	for _, tag := range tags {
+		if err := gc.putManifest(ctx, repo, imageDetail.ImageDigest, image.ImageManifest, image.ImageManifestMediaType, aws.String(tag)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getManifests returns the manifest of each of images in repo, keyed by digest,
+// as it was pushed.
+func (gc *Client) getManifests(
+	ctx context.Context,
+	repo *ecr.Repository,
+	images []*ecr.ImageDetail,
+) (map[string]*ecr.Image, error) {
+	manifests := make(map[string]*ecr.Image, len(images))
+	remaining := images
+	for len(remaining) > 0 {
+		batch := remaining
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		remaining = remaining[len(batch):]
+		input := &ecr.BatchGetImageInput{
+			RegistryId:     gc.registryID(),
+			ImageIds:       make([]*ecr.ImageIdentifier, 0, len(batch)),
+			RepositoryName: repo.RepositoryName,
+		}
+		// Manifests must not be converted to other media types, so that
+		// their digests are unchanged.
+		accepted := map[string]bool{}
+		for _, imageDetail := range batch {
+			input.ImageIds = append(input.ImageIds, &ecr.ImageIdentifier{ImageDigest: imageDetail.ImageDigest})
+			if mediaType := aws.StringValue(imageDetail.ImageManifestMediaType); mediaType != "" && !accepted[mediaType] {
+				accepted[mediaType] = true
+				input.AcceptedMediaTypes = append(input.AcceptedMediaTypes, aws.String(mediaType))
+			}
+		}
+		bgio, err := gc.client.BatchGetImageWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("error getting image manifests: %w", err)
+		}
+		for _, failure := range bgio.Failures {
+			return nil, fmt.Errorf(
+				"error getting image manifest %s: %s",
+				aws.StringValue(failure.ImageId.ImageDigest),
+				aws.StringValue(failure.FailureReason),
+			)
+		}
+		for _, image := range bgio.Images {
+			if image.ImageId == nil || image.ImageId.ImageDigest == nil || image.ImageManifest == nil {
+				return nil, fmt.Errorf("found unexpected incomplete image in Elastic Container Registry repository %s", *repo.RepositoryUri)
+			}
+			manifests[*image.ImageId.ImageDigest] = image
+		}
+	}
+	for _, imageDetail := range images {
+		image, ok := manifests[aws.StringValue(imageDetail.ImageDigest)]
+		if !ok {
+			return nil, fmt.Errorf("found no manifest for image %s", aws.StringValue(imageDetail.ImageDigest))
+		}
+		if image.ImageManifestMediaType == nil {
+			image.ImageManifestMediaType = imageDetail.ImageManifestMediaType
+		}
+	}
+	return manifests, nil
+}
+
+// putManifest puts manifest, with the given digest and media type, into repo
+// with tag, or untagged if tag is nil. Putting a manifest that repo already
+// has with tag succeeds without changing anything.
+func (gc *Client) putManifest(ctx context.Context, repo *ecr.Repository, digest, manifest, mediaType, tag *string) error {
+	_, err := gc.client.PutImageWithContext(ctx, &ecr.PutImageInput{
+		RegistryId:             gc.registryID(),
+		RepositoryName:         repo.RepositoryName,
+		ImageDigest:            digest,
+		ImageManifest:          manifest,
+		ImageManifestMediaType: mediaType,
+		ImageTag:               tag,
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+		return nil
+	}
+	if err != nil && tag != nil {
+		return fmt.Errorf("error putting image %s with tag %s: %w", aws.StringValue(digest), *tag, err)
+	}
+	if err != nil {
+		return fmt.Errorf("error putting image %s: %w", aws.StringValue(digest), err)
+	}
+	return nil
+}
+
+// removeImageTags removes tags from repo, leaving the images they refer to in
+// place as long as they have other tags.
+func (gc *Client) removeImageTags(ctx context.Context, repo *ecr.Repository, tags []string) error {
+	imageIDs := make([]*ecr.ImageIdentifier, 0, len(tags))
+	for _, tag := range tags {
+		imageIDs = append(imageIDs, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+	}
+	bdio, err := gc.client.BatchDeleteImageWithContext(ctx, &ecr.BatchDeleteImageInput{
+		RegistryId:     gc.registryID(),
+		ImageIds:       imageIDs,
+		RepositoryName: repo.RepositoryName,
+	})
+	if err != nil {
+		return fmt.Errorf("error removing image tags: %w", err)
+	}
+	for _, failure := range bdio.Failures {
+		return fmt.Errorf(
+			"error removing image tag %s: %s",
+			aws.StringValue(failure.ImageId.ImageTag),
+			aws.StringValue(failure.FailureReason),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// A ReplicaClientFunc returns a client for Elastic Container Registry in the
+// given region, with credentials allowed to delete images from the replication
+// destinations of a registry in that region.
+type ReplicaClientFunc func(region string) (ecriface.ECRAPI, error)
+
+// WithReplication makes a Client delete the images that it prunes from a
+// repository from the same repository in every destination of the replication
+// configuration of its registry, using clients returned by newClient. Elastic
+// Container Registry replicates pushes but not deletions, so replicas otherwise
+// keep every image ever pushed. The replication configuration can only be read
+// for the registry of the credentials of the Client, so if WithRegistryID names
+// another registry, replicas are left alone.
+//
+// Replicas follow the source repository: an image is deleted from them only
+// once it is deleted from the source, after any ledger or deletion budget has
+// held images back there, and is kept in a replica if an excluded image refers
+// to it by the replica's URI. Deletions from replicas are not journaled, marked
+// in a ledger, or charged to deletion budgets themselves.
+func WithReplication(newClient ReplicaClientFunc) Option {
+	return func(gc *Client) {
+		gc.replicaClient = newClient
+	}
+}
+
+// A replicationDestination is a registry to which Elastic Container Registry
+// replicates the repositories matching its prefixes, or every repository if it
+// has none.
+type replicationDestination struct {
+	region     string
+	registryID string
+	prefixes   []string
+}
+
+// replicates returns whether d receives replicas of the named repository.
+func (d replicationDestination) replicates(name string) bool {
+	if len(d.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range d.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// replicationDestinations returns the destinations of the replication
+// configuration of the registry of gc, which is read once and then reused.
+// Destinations with several rules matching different repositories are
+// returned once per rule. If the registry of gc is not the registry of its
+// credentials, whose configuration is the only one that can be read, none are
+// returned.
+func (gc *Client) replicationDestinations(ctx context.Context) ([]replicationDestination, error) {
+	if gc.replication != nil {
+		return gc.replication, nil
+	}
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.replicationDestinations")
+	defer span.Finish()
+	dro, err := gc.client.DescribeRegistryWithContext(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error describing registry: %w", err)
+	}
+	destinations := []replicationDestination{}
+	if gc.registry != "" && aws.StringValue(dro.RegistryId) != gc.registry {
+		gc.logger.Printf(
+			"skipping replication of registry %s, since only the replication configuration of registry %s can be read",
+			gc.registry,
+			aws.StringValue(dro.RegistryId),
+		)
+		gc.replication = destinations
+		return destinations, nil
+	}
+	if dro.ReplicationConfiguration != nil {
+		for _, rule := range dro.ReplicationConfiguration.Rules {
+			prefixes := []string{}
+			for _, filter := range rule.RepositoryFilters {
+				if aws.StringValue(filter.FilterType) != ecr.RepositoryFilterTypePrefixMatch {
+					err := fmt.Errorf("unsupported replication repository filter type %s", aws.StringValue(filter.FilterType))
+					span.Finish(tracer.WithError(err))
+					return nil, err
+				}
+				prefixes = append(prefixes, aws.StringValue(filter.Filter))
+			}
+			for _, destination := range rule.Destinations {
+				destinations = append(destinations, replicationDestination{
+					region:     aws.StringValue(destination.Region),
+					registryID: aws.StringValue(destination.RegistryId),
+					prefixes:   prefixes,
+				})
+			}
+		}
+	}
+	gc.logger.Printf("found %d Elastic Container Registry replication destinations", len(destinations))
+	gc.replication = destinations
+	return destinations, nil
+}
+
+// newReplicaClient returns a Client for the registry of destination, which
+// deletes by digest with the options of gc.
+func (gc *Client) newReplicaClient(destination replicationDestination) (*Client, error) {
+	client, err := gc.replicaClient(destination.region)
+	if err != nil {
+		return nil, fmt.Errorf("error creating client for region %s: %w", destination.region, err)
+	}
+	return &Client{
+		client:         client,
+		registry:       destination.registryID,
+		pageSize:       gc.pageSize,
+		removeImages:   gc.removeImages,
+		deleteByDigest: true,
+		logger:         gc.logger,
+		statsd:         gc.statsd,
+	}, nil
+}
+
+// pruneReplicas deletes the images with the given digests from the replicas of
+// repo in every replication destination of gc that receives them, deleting
+// indexes, whose children are given by children, before other images. An image
+// that is excluded by wl in a replica, by the reference of the replica, is kept
+// in that replica along with its children, so that a census of the
+// destination region can veto deletions there. pruneReplicas returns
+// references to the images pruned (or that would have been pruned) from
+// replicas.
+func (gc *Client) pruneReplicas(
+	ctx context.Context,
+	repo *ecr.Repository,
+	digests []string,
+	children map[string][]string,
+	wl whitelist,
+) (pruned []string, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.pruneReplicas")
+	defer span.Finish()
+	pruned = []string{}
+	if len(digests) == 0 {
+		return pruned, nil
+	}
+	destinations, err := gc.replicationDestinations(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return pruned, err
+	}
+	replicated := make(map[string]bool, len(destinations))
+	for _, destination := range destinations {
+		key := destination.region + "/" + destination.registryID
+		if replicated[key] || !destination.replicates(*repo.RepositoryName) {
+			continue
+		}
+		replicated[key] = true
+		replicaPruned, err := gc.pruneReplica(ctx, destination, *repo.RepositoryName, digests, children, wl)
+		pruned = append(pruned, replicaPruned...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return pruned, fmt.Errorf(
+				"error pruning replica of repository %s in registry %s of region %s: %w",
+				*repo.RepositoryName,
+				destination.registryID,
+				destination.region,
+				err,
+			)
+		}
+	}
+	return pruned, nil
+}
+
+// pruneReplica deletes the images with the given digests from the named
+// repository in the registry of destination.
+func (gc *Client) pruneReplica(
+	ctx context.Context,
+	destination replicationDestination,
+	name string,
+	digests []string,
+	children map[string][]string,
+	wl whitelist,
+) (pruned []string, err error) {
+	pruned = []string{}
+	replica, err := gc.newReplicaClient(destination)
+	if err != nil {
+		return pruned, err
+	}
+	repo, err := replica.repoFromName(ctx, name)
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ecr.ErrCodeRepositoryNotFoundException {
+		gc.logger.Printf(
+			"skipping missing replica of Elastic Container Registry repository %s in region %s",
+			name,
+			destination.region,
+		)
+		return pruned, nil
+	}
+	if err != nil {
+		return pruned, fmt.Errorf("error looking up repository: %w", err)
+	}
+	images, err := replica.describeImages(ctx, repo)
+	if err != nil {
+		return pruned, err
+	}
+	imagesByDigest := make(map[string]*ecr.ImageDetail, len(images))
+	for _, imageDetail := range images {
+		imagesByDigest[aws.StringValue(imageDetail.ImageDigest)] = imageDetail
+	}
+	vetoed := map[string]bool{}
+	for _, digest := range digests {
+		imageDetail, ok := imagesByDigest[digest]
+		if !ok || !wl.ExcludesImage(*repo.RepositoryUri, imageDetail) {
+			continue
+		}
+		gc.logger.Printf(
+			"keeping %s deployed from replica in region %s",
+			strings.Join(imageRefsFromImageDetail(*repo.RepositoryUri, imageDetail), ", "),
+			destination.region,
+		)
+		vetoed[digest] = true
+		for _, child := range children[digest] {
+			vetoed[child] = true
+		}
+	}
+	gc.statsd.Count("prune.replica_vetoed", int64(len(vetoed)), nil, 1)
+	indexIDs := []*ecr.ImageIdentifier{}
+	imageIDs := []*ecr.ImageIdentifier{}
+	for _, digest := range digests {
+		if _, ok := imagesByDigest[digest]; !ok || vetoed[digest] {
+			continue
+		}
+		imageID := &ecr.ImageIdentifier{ImageDigest: aws.String(digest)}
+		if _, ok := children[digest]; ok {
+			indexIDs = append(indexIDs, imageID)
+			continue
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+	gc.logger.Printf(
+		"found %d pruneable images in replica of Elastic Container Registry repository %s in region %s",
+		len(indexIDs)+len(imageIDs),
+		name,
+		destination.region,
+	)
+	if !gc.removeImages {
+		return repoImageRefsFromURIAndImageIDs(ctx, *repo.RepositoryUri, append(indexIDs, imageIDs...), imagesByDigest)
+	}
+	for _, ids := range [][]*ecr.ImageIdentifier{indexIDs, imageIDs} {
+		deleted, _, err := replica.deleteImages(ctx, repo, ids, imagesByDigest)
+		pruned = append(pruned, deleted...)
+		gc.statsd.Count("prune.replica_deleted", int64(len(deleted)), nil, 1)
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
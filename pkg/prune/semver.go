@@ -0,0 +1,220 @@
+package prune
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// A SemverRetention selects images to keep among those tagged with semantic
+// versions, such as v1.2.3 or 1.2.3-rc.1.
+type SemverRetention struct {
+	// Minors is the number of newest minor versions whose patch versions are
+	// kept. If Minors is zero and Patches is not, every minor version is
+	// considered.
+	Minors int `json:"minors,omitempty"`
+	// Patches is the number of newest patch versions kept of each considered
+	// minor version. If Patches is zero and Minors is not, every patch
+	// version is kept.
+	Patches int `json:"patches,omitempty"`
+	// NewestPerMajor keeps the newest version of every major version.
+	NewestPerMajor bool `json:"newestPerMajor,omitempty"`
+	// Prereleases makes pre-release versions match, ordered by semantic
+	// version precedence among the releases. Otherwise pre-release tags are
+	// left to later rules.
+	Prereleases bool `json:"prereleases,omitempty"`
+}
+
+// validate returns an error if s has negative counts.
+func (s SemverRetention) validate() error {
+	if s.Minors < 0 || s.Patches < 0 {
+		return fmt.Errorf("semver minors and patches must not be negative")
+	}
+	return nil
+}
+
+// retains returns whether s keeps any images.
+func (s SemverRetention) retains() bool {
+	return s.Minors > 0 || s.Patches > 0 || s.NewestPerMajor
+}
+
+// matches returns whether imageTag is a version that s applies to.
+func (s SemverRetention) matches(imageTag string) bool {
+	v, ok := parseVersion(imageTag)
+	return ok && (s.Prereleases || len(v.prerelease) == 0)
+}
+
+// retained returns the images with a tag, among tagged, that s selects.
+func (s SemverRetention) retained(tagged []taggedImage) map[*ecr.ImageDetail]struct{} {
+	type versionedImage struct {
+		version     version
+		imageDetail *ecr.ImageDetail
+	}
+	versioned := make([]versionedImage, 0, len(tagged))
+	for _, t := range tagged {
+		if v, ok := parseVersion(t.imageTag); ok {
+			versioned = append(versioned, versionedImage{version: v, imageDetail: t.imageDetail})
+		}
+	}
+	sort.SliceStable(versioned, func(i, j int) bool {
+		return versioned[i].version.compare(versioned[j].version) > 0
+	})
+	retained := make(map[*ecr.ImageDetail]struct{})
+	// Tags are visited from the newest version down, so that counting the
+	// distinct versions seen so far ranks them.
+	minors := []string{}
+	patchesByMinor := make(map[string][]string)
+	newestByMajor := make(map[uint64]version)
+	for _, t := range versioned {
+		minor := fmt.Sprintf("%d.%d", t.version.major, t.version.minor)
+		if len(minors) == 0 || minors[len(minors)-1] != minor {
+			minors = append(minors, minor)
+		}
+		patches := patchesByMinor[minor]
+		if len(patches) == 0 || patches[len(patches)-1] != t.version.String() {
+			patches = append(patches, t.version.String())
+			patchesByMinor[minor] = patches
+		}
+		if s.Minors > 0 || s.Patches > 0 {
+			if (s.Minors == 0 || len(minors) <= s.Minors) && (s.Patches == 0 || len(patches) <= s.Patches) {
+				retained[t.imageDetail] = struct{}{}
+			}
+		}
+		if s.NewestPerMajor {
+			newest, ok := newestByMajor[t.version.major]
+			if !ok {
+				newest = t.version
+				newestByMajor[t.version.major] = newest
+			}
+			if newest.compare(t.version) == 0 {
+				retained[t.imageDetail] = struct{}{}
+			}
+		}
+	}
+	return retained
+}
+
+// A version is a semantic version, without build metadata.
+type version struct {
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// parseVersion parses a semantic version with an optional v prefix. Build
+// metadata is ignored.
+func parseVersion(s string) (version, bool) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var prerelease string
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		s, prerelease = s[:i], s[i+1:]
+		if prerelease == "" {
+			return version{}, false
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return version{}, false
+	}
+	numbers := make([]uint64, 3)
+	for i, part := range parts {
+		if !isNumeric(part) || (len(part) > 1 && part[0] == '0') {
+			return version{}, false
+		}
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return version{}, false
+		}
+		numbers[i] = n
+	}
+	v := version{major: numbers[0], minor: numbers[1], patch: numbers[2]}
+	if prerelease != "" {
+		v.prerelease = strings.Split(prerelease, ".")
+		for _, identifier := range v.prerelease {
+			if identifier == "" {
+				return version{}, false
+			}
+		}
+	}
+	return v, true
+}
+
+// compare returns -1, 0, or 1 as v has lower, equal, or higher precedence
+// than o.
+func (v version) compare(o version) int {
+	for _, pair := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// A release has higher precedence than its pre-releases.
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := compareIdentifiers(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.prerelease) < len(o.prerelease):
+		return -1
+	case len(v.prerelease) > len(o.prerelease):
+		return 1
+	}
+	return 0
+}
+
+// String returns v without a v prefix.
+func (v version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if len(v.prerelease) > 0 {
+		s += "-" + strings.Join(v.prerelease, ".")
+	}
+	return s
+}
+
+// compareIdentifiers compares pre-release identifiers. Numeric identifiers
+// have lower precedence than alphanumeric ones.
+func compareIdentifiers(a, b string) int {
+	aNumeric, bNumeric := isNumeric(a), isNumeric(b)
+	switch {
+	case aNumeric && bNumeric:
+		if len(a) != len(b) {
+			if len(a) < len(b) {
+				return -1
+			}
+			return 1
+		}
+	case aNumeric:
+		return -1
+	case bNumeric:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
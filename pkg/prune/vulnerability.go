@@ -0,0 +1,144 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+)
+
+// VulnerableRuleName is the name of the rule that prunes images early because
+// of their scan findings.
+const VulnerableRuleName = "vulnerable"
+
+// severities are the ordered finding severities that a severity period also
+// applies to when more severe findings have no period of their own.
+var severities = []string{
+	ecr.FindingSeverityInformational,
+	ecr.FindingSeverityLow,
+	ecr.FindingSeverityMedium,
+	ecr.FindingSeverityHigh,
+	ecr.FindingSeverityCritical,
+}
+
+// validateSeverityPeriods returns an error if severityPeriods has an unknown
+// severity or a non-positive period.
+func validateSeverityPeriods(severityPeriods map[string]int) error {
+	known := make(map[string]bool)
+	for _, severity := range ecr.FindingSeverity_Values() {
+		known[severity] = true
+	}
+	for severity, period := range severityPeriods {
+		if !known[severity] {
+			return fmt.Errorf("unknown finding severity %s", severity)
+		}
+		if period <= 0 {
+			return fmt.Errorf("period for finding severity %s must be positive", severity)
+		}
+	}
+	return nil
+}
+
+// vulnerabilityPeriod returns the shortest of the SeverityPeriods of p that
+// applies to the scan findings of imageDetail. The period of a severity applies
+// to findings of that severity or higher. ok is false if none applies.
+func (p Policy) vulnerabilityPeriod(imageDetail *ecr.ImageDetail) (period int, ok bool) {
+	if len(p.SeverityPeriods) == 0 || imageDetail.ImageScanFindingsSummary == nil {
+		return 0, false
+	}
+	rank := make(map[string]int, len(severities))
+	for i, severity := range severities {
+		rank[severity] = i + 1
+	}
+	for found, count := range imageDetail.ImageScanFindingsSummary.FindingSeverityCounts {
+		if aws.Int64Value(count) == 0 {
+			continue
+		}
+		for severity, severityPeriod := range p.SeverityPeriods {
+			applies := severity == found || (rank[severity] > 0 && rank[severity] <= rank[found])
+			if applies && (!ok || severityPeriod < period) {
+				period, ok = severityPeriod, true
+			}
+		}
+	}
+	return period, ok
+}
+
+// shortestSeverityPeriod returns the shortest of the SeverityPeriods of p, or
+// zero if it has none.
+func (p Policy) shortestSeverityPeriod() int {
+	shortest := 0
+	for _, period := range p.SeverityPeriods {
+		if shortest == 0 || period < shortest {
+			shortest = period
+		}
+	}
+	return shortest
+}
+
+// describeFindings replaces the scan findings summary of imageDetail in repo
+// with the finding counts of its most recent basic or enhanced scan. An image
+// that has not been scanned is left without findings.
+func (gc *Client) describeFindings(ctx context.Context, repo *ecr.Repository, imageDetail *ecr.ImageDetail) error {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "prune.Client.describeFindings")
+	defer span.Finish()
+	disfo, err := gc.client.DescribeImageScanFindingsWithContext(ctx, &ecr.DescribeImageScanFindingsInput{
+		RegistryId: gc.registryID(),
+		ImageId:    &ecr.ImageIdentifier{ImageDigest: imageDetail.ImageDigest},
+		// Only the finding counts are read, which are returned whatever
+		// the number of findings.
+		MaxResults:     aws.Int64(1),
+		RepositoryName: repo.RepositoryName,
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == ecr.ErrCodeScanNotFoundException {
+		imageDetail.ImageScanFindingsSummary = nil
+		return nil
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error describing scan findings of image %s: %w", aws.StringValue(imageDetail.ImageDigest), err)
+	}
+	imageDetail.ImageScanFindingsSummary = nil
+	if disfo.ImageScanFindings != nil {
+		imageDetail.ImageScanFindingsSummary = &ecr.ImageScanFindingsSummary{
+			FindingSeverityCounts: disfo.ImageScanFindings.FindingSeverityCounts,
+		}
+	}
+	return nil
+}
+
+// formatFindings returns the finding counts of imageDetail, from most to least
+// severe, such as "CRITICAL=2, HIGH=5".
+func formatFindings(imageDetail *ecr.ImageDetail) string {
+	if imageDetail.ImageScanFindingsSummary == nil {
+		return ""
+	}
+	rank := make(map[string]int, len(severities))
+	for i, severity := range severities {
+		rank[severity] = i + 1
+	}
+	counts := []string{}
+	for severity, count := range imageDetail.ImageScanFindingsSummary.FindingSeverityCounts {
+		if aws.Int64Value(count) > 0 {
+			counts = append(counts, severity)
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if rank[counts[i]] != rank[counts[j]] {
+			return rank[counts[i]] > rank[counts[j]]
+		}
+		return counts[i] < counts[j]
+	})
+	for i, severity := range counts {
+		counts[i] = fmt.Sprintf("%s=%d", severity, aws.Int64Value(imageDetail.ImageScanFindingsSummary.FindingSeverityCounts[severity]))
+	}
+	return strings.Join(counts, ", ")
+}
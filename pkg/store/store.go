@@ -0,0 +1,271 @@
+// Package store persists the small documents that Thermite carries from one
+// run to the next.
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ErrNotFound is returned by a Store when no document exists for a key.
+var ErrNotFound = errors.New("document not found")
+
+// A Store reads and writes documents identified by key.
+type Store interface {
+	// Get returns the document stored under key, or ErrNotFound if there
+	// is none.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put replaces the document stored under key with data.
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// A FileStore is a Store that keeps each document in its own file in a local
+// directory.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a FileStore that keeps documents in dir, creating the
+// directory if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("dir must not be empty")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Get returns the contents of the file named key in the directory of s.
+func (s *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	span, _ := tracer.StartSpanFromContext(ctx, "store.FileStore.Get")
+	defer span.Finish()
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// Put atomically replaces the file named key in the directory of s with data.
+func (s *FileStore) Put(ctx context.Context, key string, data []byte) error {
+	span, _ := tracer.StartSpanFromContext(ctx, "store.FileStore.Put")
+	defer span.Finish()
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(s.dir, "."+key+".*")
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error creating temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error writing %s: %w", file.Name(), err)
+	}
+	if err := file.Close(); err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error closing %s: %w", file.Name(), err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error renaming %s to %s: %w", file.Name(), path, err)
+	}
+	return nil
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func validateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key must not be empty")
+	}
+	if strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return fmt.Errorf("key %q must be a plain file name", key)
+	}
+	return nil
+}
+
+// An S3Store is a Store that keeps each document in its own object in an
+// Amazon S3 bucket.
+type S3Store struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3Store returns an S3Store that keeps documents in bucket, under keys
+// beginning with prefix.
+func NewS3Store(client s3iface.S3API, bucket, prefix string) (*S3Store, error) {
+	if client == nil {
+		return nil, fmt.Errorf("client must not be nil")
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket must not be empty")
+	}
+	return &S3Store{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// Get returns the contents of the object named key under the prefix of s.
+func (s *S3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "store.S3Store.Get")
+	defer span.Finish()
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	goo, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error getting object %s: %w", s.prefix+key, err)
+	}
+	defer goo.Body.Close()
+	data, err := io.ReadAll(goo.Body)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error reading object %s: %w", s.prefix+key, err)
+	}
+	return data, nil
+}
+
+// Put replaces the object named key under the prefix of s with data.
+func (s *S3Store) Put(ctx context.Context, key string, data []byte) error {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "store.S3Store.Put")
+	defer span.Finish()
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if _, err := s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error putting object %s: %w", s.prefix+key, err)
+	}
+	return nil
+}
+
+// A ConfigMapStore is a Store that keeps each document under its own key in a
+// Kubernetes ConfigMap. Documents in a ConfigMap may total no more than 1 MiB.
+type ConfigMapStore struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapStore returns a ConfigMapStore that keeps documents in the
+// ConfigMap with the given namespace and name, creating it when the first
+// document is put.
+func NewConfigMapStore(clientset kubernetes.Interface, namespace, name string) (*ConfigMapStore, error) {
+	if clientset == nil {
+		return nil, fmt.Errorf("clientset must not be nil")
+	}
+	if namespace == "" || name == "" {
+		return nil, fmt.Errorf("namespace and name must not be empty")
+	}
+	return &ConfigMapStore{clientset: clientset, namespace: namespace, name: name}, nil
+}
+
+// Get returns the document stored under key in the ConfigMap of s.
+func (s *ConfigMapStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "store.ConfigMapStore.Get")
+	defer span.Finish()
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, fmt.Errorf("error getting ConfigMap %s/%s: %w", s.namespace, s.name, err)
+	}
+	data, ok := configMap.Data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return []byte(data), nil
+}
+
+// Put replaces the document stored under key in the ConfigMap of s with data.
+func (s *ConfigMapStore) Put(ctx context.Context, key string, data []byte) error {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "store.ConfigMapStore.Put")
+	defer span.Finish()
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+	configMap, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.namespace,
+				Name:      s.name,
+			},
+			Data: map[string]string{key: string(data)},
+		}
+		if _, err := configMaps.Create(ctx, configMap, metav1.CreateOptions{}); err != nil {
+			span.Finish(tracer.WithError(err))
+			return fmt.Errorf("error creating ConfigMap %s/%s: %w", s.namespace, s.name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error getting ConfigMap %s/%s: %w", s.namespace, s.name, err)
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string, 1)
+	}
+	configMap.Data[key] = string(data)
+	if _, err := configMaps.Update(ctx, configMap, metav1.UpdateOptions{}); err != nil {
+		span.Finish(tracer.WithError(err))
+		return fmt.Errorf("error updating ConfigMap %s/%s: %w", s.namespace, s.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type mockedS3Client struct {
+	s3iface.S3API
+	ObjectsByKey map[string][]byte
+}
+
+func (m *mockedS3Client) GetObjectWithContext(
+	ctx aws.Context,
+	input *s3.GetObjectInput,
+	opts ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	if input.Bucket == nil || *input.Bucket != "thermite" {
+		return nil, fmt.Errorf("input.Bucket must be thermite")
+	}
+	data, ok := m.ObjectsByKey[*input.Key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (m *mockedS3Client) PutObjectWithContext(
+	ctx aws.Context,
+	input *s3.PutObjectInput,
+	opts ...request.Option,
+) (*s3.PutObjectOutput, error) {
+	if input.Bucket == nil || *input.Bucket != "thermite" {
+		return nil, fmt.Errorf("input.Bucket must be thermite")
+	}
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	m.ObjectsByKey[*input.Key] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	if _, err := s.Get(ctx, "summary.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	for _, want := range []string{`{"images":1}`, `{"images":2}`} {
+		if err := s.Put(ctx, "summary.json", []byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get(ctx, "summary.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, string(got)); diff != "" {
+			t.Fatal(diff)
+		}
+	}
+	if _, err := s.Get(ctx, "history.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	for _, key := range []string{"", "../summary.json", ".hidden"} {
+		if err := s.Put(ctx, key, nil); err == nil {
+			t.Fatalf("expected error putting key %q", key)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	s, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestS3Store(t *testing.T) {
+	client := &mockedS3Client{ObjectsByKey: map[string][]byte{}}
+	s, err := NewS3Store(client, "thermite", "state/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+	if _, ok := client.ObjectsByKey["state/summary.json"]; !ok {
+		t.Fatal("expected object state/summary.json")
+	}
+}
+
+func TestConfigMapStore(t *testing.T) {
+	s, err := NewConfigMapStore(fake.NewSimpleClientset(), "default", "thermite-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
@@ -4,25 +4,108 @@ package thermite
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/dollarshaveclub/thermite/pkg/history"
 	"github.com/dollarshaveclub/thermite/pkg/prune"
+	"github.com/dollarshaveclub/thermite/pkg/store"
 	"gopkg.in/DataDog/dd-trace-go.v1/ddtrace/tracer"
 )
 
+// SummaryKey is the key under which a Client persists the Summary of its most
+// recent survey.
+const SummaryKey = "survey-summary.json"
+
+// DefaultMaxDropPercent is the default percentage by which the image count of
+// a PodSpecLister or namespace may drop between two surveys before a Client
+// refuses to prune.
+const DefaultMaxDropPercent = 50
+
 // A Client removes old images from Amazon Elastic Container Registry that are
 // not currently deployed in a Kubernetes cluster.
 type Client struct {
-	taker census.Taker
-	gc    prune.GarbageCollector
+	taker                   census.Taker
+	registries              []Registry
+	summaries               store.Store
+	history                 *history.Client
+	maxListerDropPercent    float64
+	maxNamespaceDropPercent float64
+}
+
+// A Registry is an Elastic Container Registry that a Client prunes, and the
+// name under which the Client reports the results of pruning it.
+type Registry struct {
+	Name             string
+	GarbageCollector prune.GarbageCollector
+}
+
+// A RegistryResult is the result of pruning a Registry.
+type RegistryResult struct {
+	Registry string
+	Pruned   []string
+	Err      error
+}
+
+// An Option is an option applied when creating a Client.
+type Option func(c *Client)
+
+// WithRegistryName sets the name under which a Client reports the results of
+// pruning with the GarbageCollector passed to NewClient.
+func WithRegistryName(name string) Option {
+	return func(c *Client) {
+		c.registries[0].Name = name
+	}
+}
+
+// WithRegistry adds a Registry that a Client prunes, after the
+// GarbageCollector passed to NewClient, excluding the same surveyed images.
+func WithRegistry(registry Registry) Option {
+	return func(c *Client) {
+		c.registries = append(c.registries, registry)
+	}
+}
+
+// WithSummaryStore sets a store in which a Client persists the Summary of each
+// survey, and against which it checks the next survey before pruning. The
+// Taker of the Client must be a census.Surveyor.
+func WithSummaryStore(s store.Store) Option {
+	return func(c *Client) {
+		c.summaries = s
+	}
+}
+
+// WithHistory sets a history.Client in which a Client records each survey, and
+// whose recently deployed images it excludes from removal along with the
+// surveyed images.
+func WithHistory(h *history.Client) Option {
+	return func(c *Client) {
+		c.history = h
+	}
+}
+
+// WithMaxListerDropPercent sets the percentage by which the image count of a
+// PodSpecLister may drop between two surveys before a Client refuses to prune.
+func WithMaxListerDropPercent(percent float64) Option {
+	return func(c *Client) {
+		c.maxListerDropPercent = percent
+	}
+}
+
+// WithMaxNamespaceDropPercent sets the percentage by which the image count of
+// a namespace may drop between two surveys before a Client refuses to prune.
+func WithMaxNamespaceDropPercent(percent float64) Option {
+	return func(c *Client) {
+		c.maxNamespaceDropPercent = percent
+	}
 }
 
-// NewClient returns a Client that removes eligible images from ecr, excluding
-// images currently deployed in kubernetes. If no WithPeriodTagKey options are
-// specified in opts, DefaultPeriodTagKey will be used.
-func NewClient(taker census.Taker, gc prune.GarbageCollector) (*Client, error) {
+// NewClient returns a Client that removes eligible images using gc, excluding
+// images surveyed by taker.
+func NewClient(taker census.Taker, gc prune.GarbageCollector, opts ...Option) (*Client, error) {
 	if taker == nil {
 		return nil, fmt.Errorf("taker must not be nil")
 	}
@@ -30,30 +113,125 @@ func NewClient(taker census.Taker, gc prune.GarbageCollector) (*Client, error) {
 		return nil, fmt.Errorf("gc must not be nil")
 	}
 	c := &Client{
-		taker: taker,
-		gc:    gc,
+		taker:                   taker,
+		registries:              []Registry{{GarbageCollector: gc}},
+		maxListerDropPercent:    DefaultMaxDropPercent,
+		maxNamespaceDropPercent: DefaultMaxDropPercent,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for _, registry := range c.registries[1:] {
+		if registry.GarbageCollector == nil {
+			return nil, fmt.Errorf("registry %s GarbageCollector must not be nil", registry.Name)
+		}
+	}
+	if _, ok := taker.(census.Surveyor); c.summaries != nil && !ok {
+		return nil, fmt.Errorf("taker must be a census.Surveyor to check survey summaries")
 	}
 	return c, nil
 }
 
 // Run looks at every repository in the Amazon Elastic Container Registry
 // associated with c, checks for an AWS resource tag on the repository that
-// specifies a prune period (a positive integer representing the number of days
-// that must pass after an image is pushed to the repository before it can be
-// removed), and if the tag is present, removes any images that were pushed that
-// many days before until. Run returns the list of image references that were
-// pruned, along with any error that occurred.
+// specifies a prune period (a number of days, or a period accepted by
+// prune.ParsePeriod, that must pass after an image is pushed to the repository
+// before it can be removed), and if the tag is present, removes any images that
+// were pushed more than that period before until. Run returns the list of image
+// references that were pruned, along with any error that occurred.
+//
+// If c was created with WithSummaryStore, Run refuses to prune when the survey
+// has dropped too far since the previous run. If c was created with
+// WithHistory, Run also excludes images seen deployed within its grace period.
+// If c was created with WithRegistry, Run prunes every registry, and fails if
+// pruning any of them fails.
 func (c *Client) Run(ctx context.Context, until time.Time) (pruned []string, err error) {
 	var span tracer.Span
 	span, ctx = tracer.StartSpanFromContext(ctx, "thermite.Client.Run")
 	defer span.Finish()
-	surveyed, err := c.taker.SurveyDeployedImages(ctx)
+	results, err := c.RunRegistries(ctx, until)
 	if err != nil {
+		span.Finish(tracer.WithError(err))
+		return nil, err
+	}
+	pruned = []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			span.Finish(tracer.WithError(result.Err))
+			return nil, result.Err
+		}
+		pruned = append(pruned, result.Pruned...)
+	}
+	return pruned, nil
+}
+
+// RunRegistries is like Run, but returns the result of pruning each registry
+// of c, in order. A registry that fails to be pruned does not stop the others
+// from being pruned against the same survey. RunRegistries only returns an
+// error if the survey fails.
+func (c *Client) RunRegistries(ctx context.Context, until time.Time) (results []RegistryResult, err error) {
+	var span tracer.Span
+	span, ctx = tracer.StartSpanFromContext(ctx, "thermite.Client.RunRegistries")
+	defer span.Finish()
+	surveyed, err := c.survey(ctx)
+	if err != nil {
+		span.Finish(tracer.WithError(err))
 		return nil, fmt.Errorf("error surveying Kubernetes images: %w", err)
 	}
-	pruned, err = c.gc.PruneAllRepos(ctx, until, surveyed...)
+	if c.history != nil {
+		surveyed, err = c.history.Update(ctx, until, surveyed...)
+		if err != nil {
+			span.Finish(tracer.WithError(err))
+			return nil, fmt.Errorf("error updating image history: %w", err)
+		}
+	}
+	results = make([]RegistryResult, 0, len(c.registries))
+	for _, registry := range c.registries {
+		result := RegistryResult{Registry: registry.Name}
+		result.Pruned, result.Err = registry.GarbageCollector.PruneAllRepos(ctx, until, surveyed...)
+		switch {
+		case result.Err != nil && registry.Name == "":
+			result.Err = fmt.Errorf("error pruning ECR images: %w", result.Err)
+		case result.Err != nil:
+			result.Err = fmt.Errorf("error pruning ECR images in registry %s: %w", registry.Name, result.Err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (c *Client) survey(ctx context.Context) ([]string, error) {
+	if c.summaries == nil {
+		return c.taker.SurveyDeployedImages(ctx)
+	}
+	survey, err := c.taker.(census.Surveyor).TakeSurvey(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("error pruning ECR images: %w", err)
+		return nil, err
 	}
-	return pruned, nil
+	data, err := c.summaries.Get(ctx, SummaryKey)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("error loading previous survey summary: %w", err)
+	default:
+		var previous census.Summary
+		if err := json.Unmarshal(data, &previous); err != nil {
+			return nil, fmt.Errorf("error decoding previous survey summary: %w", err)
+		}
+		if err := survey.Summary.CheckDrop(
+			previous,
+			c.maxListerDropPercent,
+			c.maxNamespaceDropPercent,
+		); err != nil {
+			return nil, err
+		}
+	}
+	data, err = json.Marshal(survey.Summary)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding survey summary: %w", err)
+	}
+	if err := c.summaries.Put(ctx, SummaryKey, data); err != nil {
+		return nil, fmt.Errorf("error saving survey summary: %w", err)
+	}
+	return survey.Images, nil
 }
@@ -7,6 +7,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dollarshaveclub/thermite/pkg/census"
+	"github.com/dollarshaveclub/thermite/pkg/history"
+	"github.com/dollarshaveclub/thermite/pkg/store"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -20,8 +23,23 @@ func (m mockedCensusClient) SurveyDeployedImages(
 	return m.ImageRefs, nil
 }
 
+type mockedSurveyClient struct {
+	Survey census.Survey
+}
+
+func (m mockedSurveyClient) SurveyDeployedImages(
+	ctx context.Context,
+) (deployed []string, err error) {
+	return m.Survey.Images, nil
+}
+
+func (m mockedSurveyClient) TakeSurvey(ctx context.Context) (census.Survey, error) {
+	return m.Survey, nil
+}
+
 type mockedPruneClient struct {
 	ImageRefsByRepo map[string][]string
+	Err             error
 }
 
 func (m mockedPruneClient) PruneAllRepos(
@@ -29,6 +47,9 @@ func (m mockedPruneClient) PruneAllRepos(
 	until time.Time,
 	excluded ...string,
 ) (pruned []string, err error) {
+	if m.Err != nil {
+		return []string{}, m.Err
+	}
 	pruned = make([]string, 0, len(m.ImageRefsByRepo))
 	for name := range m.ImageRefsByRepo {
 		repoPruned, err := m.PruneRepo(ctx, name, until, excluded...)
@@ -126,5 +147,217 @@ func TestThermite_Run(t *testing.T) {
 			}
 		})
 	}
+}
+
+func TestThermite_RunWithSummaryStore(t *testing.T) {
+	pruneClient := mockedPruneClient{
+		ImageRefsByRepo: map[string][]string{
+			"thermite": {
+				"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+				"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+			},
+		},
+	}
+	surveys := []struct {
+		Name   string
+		Survey census.Survey
+		Error  bool
+	}{
+		{
+			Name: "First",
+			Survey: census.Survey{
+				Images: []string{"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22"},
+				Summary: census.Summary{
+					Images:      1,
+					ByLister:    map[string]int{"Deployment": 1},
+					ByNamespace: map[string]int{"default": 1},
+				},
+			},
+		},
+		{
+			Name: "Dropped",
+			Survey: census.Survey{
+				Images: []string{},
+				Summary: census.Summary{
+					ByLister:    map[string]int{"Deployment": 0},
+					ByNamespace: map[string]int{},
+				},
+			},
+			Error: true,
+		},
+		{
+			Name: "Recovered",
+			Survey: census.Survey{
+				Images: []string{"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22"},
+				Summary: census.Summary{
+					Images:      1,
+					ByLister:    map[string]int{"Deployment": 1},
+					ByNamespace: map[string]int{"default": 1},
+				},
+			},
+		},
+	}
+	summaries, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, survey := range surveys {
+		t.Run(survey.Name, func(t *testing.T) {
+			client, err := NewClient(
+				mockedSurveyClient{Survey: survey.Survey},
+				pruneClient,
+				WithSummaryStore(summaries),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Run(context.Background(), time.Now().UTC())
+			if gotError := err != nil; gotError != survey.Error {
+				t.Fatalf("expected error %t, got %v", survey.Error, err)
+			}
+		})
+	}
+	if _, err := NewClient(mockedCensusClient{}, pruneClient, WithSummaryStore(summaries)); err == nil {
+		t.Fatal("expected error creating Client with a Taker that is not a Surveyor")
+	}
+}
+
+func TestThermite_RunWithHistory(t *testing.T) {
+	pruneClient := mockedPruneClient{
+		ImageRefsByRepo: map[string][]string{
+			"thermite": {
+				"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+				"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+				"thermite:5379a3dcddb42eb007a68ea7990c643066263fb8",
+			},
+		},
+	}
+	s, err := store.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := history.NewClient(s, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().UTC()
+	runs := []struct {
+		Name     string
+		Until    time.Time
+		Surveyed []string
+		Pruned   []string
+	}{
+		{
+			Name:     "Deployed",
+			Until:    until,
+			Surveyed: []string{"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22"},
+			Pruned: []string{
+				"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+				"thermite:5379a3dcddb42eb007a68ea7990c643066263fb8",
+			},
+		},
+		{
+			Name:     "RecentlyUndeployed",
+			Until:    until.Add(24 * time.Hour),
+			Surveyed: []string{"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"},
+			Pruned: []string{
+				"thermite:5379a3dcddb42eb007a68ea7990c643066263fb8",
+			},
+		},
+		{
+			Name:     "GracePeriodElapsed",
+			Until:    until.Add(8 * 24 * time.Hour),
+			Surveyed: []string{"thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"},
+			Pruned: []string{
+				"thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+				"thermite:5379a3dcddb42eb007a68ea7990c643066263fb8",
+			},
+		},
+	}
+	for _, run := range runs {
+		t.Run(run.Name, func(t *testing.T) {
+			client, err := NewClient(
+				mockedCensusClient{ImageRefs: run.Surveyed},
+				pruneClient,
+				WithHistory(h),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := client.Run(context.Background(), run.Until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(run.Pruned)
+			sort.Strings(got)
+			if diff := cmp.Diff(run.Pruned, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
 
+func TestThermite_RunRegistries(t *testing.T) {
+	censusClient := mockedCensusClient{
+		ImageRefs: []string{
+			"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+			"000987654321.dkr.ecr.us-west-2.amazonaws.com/thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+		},
+	}
+	east := mockedPruneClient{
+		ImageRefsByRepo: map[string][]string{
+			"thermite": {
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+				"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6",
+			},
+		},
+	}
+	west := mockedPruneClient{
+		ImageRefsByRepo: map[string][]string{
+			"thermite": {
+				"000987654321.dkr.ecr.us-west-2.amazonaws.com/thermite:0437aec133abca7f3d054a5be48dde8ed9b2af22",
+				"000987654321.dkr.ecr.us-west-2.amazonaws.com/thermite:5379a3dcddb42eb007a68ea7990c643066263fb8",
+			},
+		},
+	}
+	broken := mockedPruneClient{Err: fmt.Errorf("access denied")}
+	client, err := NewClient(
+		censusClient,
+		east,
+		WithRegistryName("east"),
+		WithRegistry(Registry{Name: "broken", GarbageCollector: broken}),
+		WithRegistry(Registry{Name: "west", GarbageCollector: west}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := client.RunRegistries(context.Background(), time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]string, len(results))
+	errored := []string{}
+	for _, result := range results {
+		got[result.Registry] = result.Pruned
+		if result.Err != nil {
+			errored = append(errored, result.Registry)
+		}
+	}
+	want := map[string][]string{
+		"east":   {"000123456789.dkr.ecr.us-east-1.amazonaws.com/thermite:878d0cb2b7e6f6017c096fa613b1b521b95325a6"},
+		"broken": {},
+		"west":   {"000987654321.dkr.ecr.us-west-2.amazonaws.com/thermite:5379a3dcddb42eb007a68ea7990c643066263fb8"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"broken"}, errored); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := client.Run(context.Background(), time.Now().UTC()); err == nil {
+		t.Fatal("expected error running Client with a registry that fails to be pruned")
+	}
+	if _, err := NewClient(censusClient, east, WithRegistry(Registry{Name: "nil"})); err == nil {
+		t.Fatal("expected error creating Client with a nil registry GarbageCollector")
+	}
 }